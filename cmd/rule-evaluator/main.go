@@ -349,6 +349,7 @@ func main() {
 				http.Error(w, "Only POST requests allowed.", http.StatusMethodNotAllowed)
 			}
 		})
+		http.Handle("/debug/export", exporter.DebugHandler())
 		http.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
 			w.WriteHeader(http.StatusOK)
 		})
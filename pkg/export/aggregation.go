@@ -0,0 +1,311 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var (
+	samplesAggregated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_samples_aggregated_total",
+		Help: "Number of points that were merged into aggregated series instead of being exported.",
+	})
+	aggregatedSeries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcm_export_aggregated_series",
+		Help: "Number of series produced by aggregation rules.",
+	})
+)
+
+const (
+	// Interval at which aggregates are checked for points to export.
+	aggregationFlushInterval = time.Second
+	// Duration after which members that stopped receiving samples are removed from their
+	// aggregate, and aggregates without any members are removed. It matches the garbage
+	// collection of the series cache.
+	aggregationStaleness = 10 * time.Minute
+)
+
+// The functions that aggregation rules can apply to gauges.
+const (
+	aggregationSum   = "sum"
+	aggregationMin   = "min"
+	aggregationMax   = "max"
+	aggregationAvg   = "avg"
+	aggregationCount = "count"
+)
+
+// aggregationRule is the validated form of an AggregationRule.
+type aggregationRule struct {
+	selector labels.Selector
+	without  []string
+	function string
+	// The window in milliseconds.
+	window int64
+}
+
+// aggregator merges the points of series matching an aggregation rule into aggregate
+// series, which are periodically flushed.
+type aggregator struct {
+	mtx        sync.Mutex
+	aggregates map[uint64]*aggregate
+}
+
+// aggregate is the state of a single aggregated series.
+type aggregate struct {
+	rule *aggregationRule
+	// The series to which aggregated points are written without points.
+	series     hashedSeries
+	cumulative bool
+	// Start timestamp of the aggregated cumulative and the total increase of all its
+	// members since then.
+	start int64
+	total float64
+	// The member series by their reference.
+	members map[storage.SeriesRef]*aggregateMember
+	// The last points of stale members of a cumulative aggregate by their reference. They
+	// are kept for as long as the aggregate so that returning members only add their
+	// increase since then.
+	evicted map[storage.SeriesRef]*aggregateMember
+	// Timestamp of the most recent member point and of the last exported point.
+	lastTimestamp, lastExported int64
+	// Wall clock times of the last update and flush.
+	lastUpdate, lastFlush time.Time
+}
+
+// aggregateMember is the most recent point of a series merged into an aggregate.
+type aggregateMember struct {
+	start, timestamp int64
+	value            float64
+}
+
+func newAggregator() *aggregator {
+	return &aggregator{aggregates: map[uint64]*aggregate{}}
+}
+
+// clear removes all aggregates. Cumulative aggregates start over afterwards.
+func (a *aggregator) clear() {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	a.aggregates = map[uint64]*aggregate{}
+	aggregatedSeries.Set(0)
+}
+
+// add merges the points of the referenced series into their aggregates. The points must
+// hold double values.
+func (a *aggregator) add(rule *aggregationRule, ref storage.SeriesRef, samples []hashedSeries, now time.Time) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	for _, s := range samples {
+		p := s.proto.Points[0]
+		var (
+			t = p.Interval.EndTime.AsTime().UnixMilli()
+			v = p.Value.GetDoubleValue()
+		)
+		agg, ok := a.aggregates[s.hash]
+		if !ok {
+			agg = &aggregate{
+				series:     hashedSeries{hash: s.hash, proto: seriesWithoutPoints(s.proto), priority: s.priority},
+				cumulative: s.proto.MetricKind == metric_pb.MetricDescriptor_CUMULATIVE,
+				start:      t,
+				members:    map[storage.SeriesRef]*aggregateMember{},
+				lastFlush:  now,
+			}
+			a.aggregates[s.hash] = agg
+			aggregatedSeries.Inc()
+		}
+		// Changes of the rule and priority apply as its members are refreshed.
+		agg.rule = rule
+		agg.series.priority = s.priority
+		agg.lastUpdate = now
+		if t > agg.lastTimestamp {
+			agg.lastTimestamp = t
+		}
+		m, ok := agg.members[ref]
+		if !ok {
+			if m, ok = agg.evicted[ref]; ok {
+				delete(agg.evicted, ref)
+			} else {
+				m = &aggregateMember{}
+			}
+			agg.members[ref] = m
+		}
+		if agg.cumulative {
+			agg.total += cumulativeIncrease(agg, m, ok, p.Interval.StartTime.AsTime().UnixMilli(), v)
+			m.start = p.Interval.StartTime.AsTime().UnixMilli()
+		}
+		m.value = v
+		m.timestamp = t
+	}
+}
+
+// cumulativeIncrease returns the increase of the aggregate's total from a new cumulative
+// point of a member. The total only ever increases, no matter whether members join,
+// leave, or are reset.
+func cumulativeIncrease(agg *aggregate, m *aggregateMember, known bool, start int64, v float64) float64 {
+	switch {
+	case !known && start < agg.start:
+		// The increase of the member before the aggregate started is not part of it.
+		return 0
+	case !known, start != m.start, v < m.value:
+		// The member is new or was reset, so its entire value is an increase.
+		return v
+	default:
+		return v - m.value
+	}
+}
+
+// flush returns the points of all aggregates whose window passed since they were
+// last flushed. Stale members and aggregates are removed.
+func (a *aggregator) flush(now time.Time) []hashedSeries {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	var res []hashedSeries
+
+	for h, agg := range a.aggregates {
+		if now.Sub(agg.lastUpdate) > aggregationStaleness {
+			delete(a.aggregates, h)
+			aggregatedSeries.Dec()
+			continue
+		}
+		if now.Sub(agg.lastFlush).Milliseconds() < agg.rule.window || agg.lastTimestamp <= agg.lastExported {
+			continue
+		}
+		agg.lastFlush = now
+
+		if s, ok := agg.point(); ok {
+			res = append(res, s)
+			agg.lastExported = agg.lastTimestamp
+		}
+	}
+	return res
+}
+
+// point returns the current point of the aggregate and removes stale members.
+func (agg *aggregate) point() (hashedSeries, bool) {
+	var (
+		value float64
+		count int
+	)
+	for ref, m := range agg.members {
+		if agg.lastTimestamp-m.timestamp > aggregationStaleness.Milliseconds() {
+			// The increases of cumulative members remain part of the total.
+			delete(agg.members, ref)
+
+			if agg.cumulative {
+				if agg.evicted == nil {
+					agg.evicted = map[storage.SeriesRef]*aggregateMember{}
+				}
+				agg.evicted[ref] = m
+			}
+			continue
+		}
+		// Only gauges within the window of the most recent point are aggregated.
+		if agg.cumulative || agg.lastTimestamp-m.timestamp >= agg.rule.window {
+			continue
+		}
+		switch agg.rule.function {
+		case aggregationMin:
+			if count == 0 || m.value < value {
+				value = m.value
+			}
+		case aggregationMax:
+			if count == 0 || m.value > value {
+				value = m.value
+			}
+		default:
+			value += m.value
+		}
+		count++
+	}
+	interval := &monitoring_pb.TimeInterval{EndTime: getTimestamp(agg.lastTimestamp)}
+
+	if agg.cumulative {
+		// Cumulatives are always summed to remain monotonic.
+		if agg.lastTimestamp <= agg.start {
+			return hashedSeries{}, false
+		}
+		value = agg.total
+		interval.StartTime = getTimestamp(agg.start)
+	} else {
+		if count == 0 {
+			return hashedSeries{}, false
+		}
+		switch agg.rule.function {
+		case aggregationAvg:
+			value /= float64(count)
+		case aggregationCount:
+			value = float64(count)
+		}
+	}
+	ts := seriesWithoutPoints(agg.series.proto)
+	ts.Points = []*monitoring_pb.Point{{
+		Interval: interval,
+		Value: &monitoring_pb.TypedValue{
+			Value: &monitoring_pb.TypedValue_DoubleValue{value},
+		},
+	}}
+	return hashedSeries{hash: agg.series.hash, proto: ts, priority: agg.series.priority}, true
+}
+
+// runAggregation periodically exports the points of aggregated series until the context
+// is canceled.
+func (e *Exporter) runAggregation(ctx context.Context) {
+	tick := time.NewTicker(aggregationFlushInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			e.flushAggregates(time.Now())
+		}
+	}
+}
+
+// flushAggregates enqueues the points of aggregated series that are due.
+func (e *Exporter) flushAggregates(now time.Time) {
+	built := e.seriesCache.aggregator.flush(now)
+	if len(built) == 0 {
+		return
+	}
+	e.mtx.Lock()
+	draining := e.draining
+	start, end, ok := e.opts.Lease.Range()
+	e.mtx.Unlock()
+
+	if draining {
+		samplesDropped.WithLabelValues("shutdown").Add(float64(len(built)))
+		return
+	}
+	if !ok {
+		samplesDropped.WithLabelValues("no-ha-range").Add(float64(len(built)))
+		return
+	}
+	e.enqueueBuilt(built, start, end)
+}
@@ -0,0 +1,242 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/record"
+
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+func TestAggregator(t *testing.T) {
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1", "cluster", "c1")
+	series := seriesMap{
+		1: labels.FromStrings("__name__", "metric1_total", "job", "j1", "instance", "i1"),
+		2: labels.FromStrings("__name__", "metric1_total", "job", "j1", "instance", "i2"),
+		3: labels.FromStrings("__name__", "metric2", "job", "j1", "instance", "i1"),
+		4: labels.FromStrings("__name__", "metric2", "job", "j1", "instance", "i2"),
+		// Series not matching the rule are exported as is.
+		5: labels.FromStrings("__name__", "metric1_total", "job", "j2", "instance", "i1"),
+		// Series that join the aggregate later.
+		6: labels.FromStrings("__name__", "metric1_total", "job", "j1", "instance", "i3"),
+	}
+	metadata := testMetadataFunc(metricMetadataMap{
+		"metric1_total": {Type: textparse.MetricTypeCounter},
+		"metric2":       {Type: textparse.MetricTypeGauge},
+	})
+	rules, err := (&Config{
+		AggregationRules: []AggregationRule{{
+			Match:    `{job="j1"}`,
+			Without:  []string{"instance"},
+			Function: "sum",
+			Window:   model.Duration(time.Minute),
+		}},
+	}).aggregationRules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var now time.Time
+
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return series[ref]
+	}
+	cache.now = func() time.Time { return now }
+	cache.setAggregationRules(rules)
+
+	type result struct {
+		Type       string
+		Instance   string
+		Start, End int64
+		Value      float64
+	}
+	convert := func(samples []hashedSeries) []result {
+		var res []result
+		for _, s := range samples {
+			p := s.proto.Points[0]
+			res = append(res, result{
+				Type:     s.proto.Metric.Type,
+				Instance: s.proto.Resource.Labels["instance"],
+				Start:    p.Interval.GetStartTime().AsTime().UnixMilli(),
+				End:      p.Interval.EndTime.AsTime().UnixMilli(),
+				Value:    p.Value.GetDoubleValue(),
+			})
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].Type < res[j].Type })
+		return res
+	}
+	// Adds the batch at the time of its samples and returns the points exported as is.
+	add := func(batch []record.RefSample) []result {
+		now = time.UnixMilli(batch[0].T)
+
+		var res []hashedSeries
+		b := newSampleBuilder(cache)
+		defer b.close()
+
+		for len(batch) > 0 {
+			out, tail, err := b.next(metadata, externalLabels, batch, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, out...)
+			batch = tail
+		}
+		return convert(res)
+	}
+	flush := func(ts int64) []result {
+		return convert(cache.aggregator.flush(time.UnixMilli(ts)))
+	}
+
+	// The first samples of counters only initialize their reset state.
+	got := add([]record.RefSample{
+		{Ref: 1, T: 10000, V: 10}, {Ref: 2, T: 10000, V: 20}, {Ref: 3, T: 10000, V: 1}, {Ref: 4, T: 10000, V: 3}, {Ref: 5, T: 10000, V: 1},
+	})
+	if len(got) != 0 {
+		t.Fatalf("unexpected exported points %v", got)
+	}
+	got = add([]record.RefSample{
+		{Ref: 1, T: 20000, V: 15}, {Ref: 2, T: 20000, V: 25}, {Ref: 3, T: 20000, V: 2}, {Ref: 4, T: 20000, V: 4}, {Ref: 5, T: 20000, V: 3},
+	})
+	want := []result{
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Instance: "i1", Start: 10000, End: 20000, Value: 2},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected exported points (-want, +got): %s", diff)
+	}
+	// No window passed yet.
+	if got := flush(50000); len(got) != 0 {
+		t.Fatalf("unexpected aggregated points %v", got)
+	}
+	// The second series is reset, the second gauge stops receiving samples, and a third
+	// counter joins.
+	add([]record.RefSample{
+		{Ref: 1, T: 80000, V: 20}, {Ref: 2, T: 80000, V: 3}, {Ref: 3, T: 80000, V: 5}, {Ref: 6, T: 80000, V: 2},
+	})
+	want = []result{
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Start: 20000, End: 80000, Value: 8},
+		{Type: "prometheus.googleapis.com/metric2/gauge", Start: 0, End: 80000, Value: 5},
+	}
+	if diff := cmp.Diff(want, flush(80000)); diff != "" {
+		t.Fatalf("unexpected aggregated points (-want, +got): %s", diff)
+	}
+	// The increase of the joined counter since its first sample is included.
+	add([]record.RefSample{
+		{Ref: 1, T: 95000, V: 21}, {Ref: 6, T: 95000, V: 4},
+	})
+	if got := flush(100000); len(got) != 0 {
+		t.Fatalf("unexpected aggregated points %v", got)
+	}
+	want = []result{
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Start: 20000, End: 95000, Value: 11},
+	}
+	if diff := cmp.Diff(want, flush(140000)); diff != "" {
+		t.Fatalf("unexpected aggregated points (-want, +got): %s", diff)
+	}
+	// Stale aggregates are removed.
+	flush(95000 + aggregationStaleness.Milliseconds() + 1)
+	if n := len(cache.aggregator.aggregates); n != 0 {
+		t.Fatalf("expected no aggregates, got %d", n)
+	}
+}
+
+func TestAggregate_point(t *testing.T) {
+	cases := []struct {
+		function string
+		want     float64
+	}{
+		{function: "sum", want: 6},
+		{function: "min", want: 1},
+		{function: "max", want: 3},
+		{function: "avg", want: 2},
+		{function: "count", want: 3},
+	}
+	for _, c := range cases {
+		t.Run(c.function, func(t *testing.T) {
+			agg := &aggregate{
+				rule:   &aggregationRule{function: c.function, window: 60000},
+				series: hashedSeries{proto: &monitoring_pb.TimeSeries{}},
+				members: map[storage.SeriesRef]*aggregateMember{
+					1: {timestamp: 100000, value: 1},
+					2: {timestamp: 90000, value: 2},
+					3: {timestamp: 50000, value: 3},
+					// Outside of the window.
+					4: {timestamp: 40000, value: 100},
+				},
+				lastTimestamp: 100000,
+			}
+			s, ok := agg.point()
+			if !ok {
+				t.Fatal("expected point")
+			}
+			if got := s.proto.Points[0].Value.GetDoubleValue(); got != c.want {
+				t.Fatalf("expected %v, got %v", c.want, got)
+			}
+		})
+	}
+}
+
+func TestAggregator_returningMember(t *testing.T) {
+	a := newAggregator()
+	rule := &aggregationRule{function: aggregationSum, window: 60000}
+
+	add := func(ref storage.SeriesRef, t int64, v float64) {
+		a.add(rule, ref, []hashedSeries{{
+			hash: 1,
+			proto: &monitoring_pb.TimeSeries{
+				MetricKind: metric_pb.MetricDescriptor_CUMULATIVE,
+				Points: []*monitoring_pb.Point{{
+					Interval: &monitoring_pb.TimeInterval{
+						StartTime: getTimestamp(10000),
+						EndTime:   getTimestamp(t),
+					},
+					Value: &monitoring_pb.TypedValue{
+						Value: &monitoring_pb.TypedValue_DoubleValue{DoubleValue: v},
+					},
+				}},
+			},
+		}}, time.UnixMilli(t))
+	}
+	add(1, 10000, 5)
+	add(2, 10000, 0)
+
+	// Member 1 goes stale and is removed when the aggregate is exported.
+	later := 10000 + aggregationStaleness.Milliseconds() + 1000
+	add(2, later, 1)
+
+	agg := a.aggregates[1]
+	if _, ok := agg.point(); !ok {
+		t.Fatal("expected point")
+	}
+	if _, ok := agg.members[1]; ok {
+		t.Fatal("expected member 1 to be removed")
+	}
+	// Member 1 returns with the same start time. Only its increase since it was last
+	// seen is added.
+	add(1, later+1000, 7)
+
+	if agg.total != 8 {
+		t.Fatalf("expected total 8, got %v", agg.total)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command replay sends CreateTimeSeries requests recorded by the exporter to a GCM API endpoint.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"github.com/GoogleCloudPlatform/prometheus-engine/pkg/export"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+func main() {
+	var (
+		file     = flag.String("file", "", "File with recorded requests.")
+		format   = flag.String("format", export.RecordFormatJSON, "Format of the recorded requests (\"jsonl\" or \"proto\").")
+		endpoint = flag.String("endpoint", "localhost:10001", "GCM API endpoint to send the requests to.")
+		insecure = flag.Bool("insecure", true, "Connect without TLS and authentication, e.g. to the fake server in pkg/export/bench.")
+		speed    = flag.Float64("speed", 1, "Factor by which the original pacing of requests is accelerated. If 0, requests are sent as fast as possible.")
+		workers  = flag.Int("concurrency", 10, "Maximum number of concurrent requests.")
+	)
+	flag.Parse()
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Fatalln("failed to open file:", err)
+	}
+	defer f.Close()
+
+	r, err := export.NewRequestReader(f, *format)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	ctx := context.Background()
+
+	opts := []option.ClientOption{option.WithEndpoint(*endpoint)}
+	if *insecure {
+		opts = append(opts,
+			option.WithoutAuthentication(),
+			option.WithGRPCDialOption(grpc.WithInsecure()),
+		)
+	}
+	client, err := monitoring.NewMetricClient(ctx, opts...)
+	if err != nil {
+		log.Fatalln("failed to create metric client:", err)
+	}
+	defer client.Close()
+
+	var (
+		wg                 sync.WaitGroup
+		sem                = make(chan struct{}, *workers)
+		start              = time.Now()
+		first              time.Time
+		mtx                sync.Mutex
+		requests, failures int
+	)
+	for {
+		rec, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			log.Fatalln("failed to read request:", err)
+		}
+		// Wait until the offset from the first request, scaled by the speed, has passed.
+		if first.IsZero() {
+			first = rec.Time
+		}
+		if *speed > 0 {
+			offset := time.Duration(float64(rec.Time.Sub(first)) / *speed)
+			time.Sleep(time.Until(start.Add(offset)))
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(rec export.RecordedRequest) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			err := client.CreateTimeSeries(ctx, rec.Request)
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			requests++
+			if err != nil {
+				failures++
+				log.Println("request failed:", err)
+			}
+		}(rec)
+	}
+	wg.Wait()
+
+	log.Printf("replayed %d requests with %d failures in %s", requests, failures, time.Since(start))
+}
@@ -0,0 +1,181 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+var (
+	cardinalityLimitedSeries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcm_export_cardinality_limited_series",
+		Help: "Number of active series that are not exported because their metric exceeds the cardinality limit.",
+	})
+	cardinalityLimitedMetrics = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcm_export_cardinality_limited_metrics",
+		Help: "Number of metrics for which series are not exported because they exceed the cardinality limit.",
+	})
+)
+
+// CardinalityLimitOpts configures a limit on the number of active series exported per metric.
+type CardinalityLimitOpts struct {
+	// Maximum number of active series per metric. New series above the limit are dropped.
+	// If 0, the number of series is not limited.
+	SeriesPerMetric uint
+	// Whether the limit applies to the series of a metric in each namespace separately.
+	PerNamespace bool
+}
+
+func (o CardinalityLimitOpts) enabled() bool {
+	return o.SeriesPerMetric > 0
+}
+
+// cardinalityUsage tracks the series of a metric that count against the same limit.
+type cardinalityUsage struct {
+	// Number of exported series by group. All series of one histogram or summary are in
+	// the same group and count against the limit once.
+	active map[uint64]int
+	// Number of series that are dropped for exceeding the limit.
+	rejected int
+}
+
+// cardinalityBudget tracks the active series per metric and rejects series above the limit.
+type cardinalityBudget struct {
+	opts CardinalityLimitOpts
+
+	mtx   sync.Mutex
+	usage map[string]*cardinalityUsage
+}
+
+func newCardinalityBudget(opts CardinalityLimitOpts) *cardinalityBudget {
+	return &cardinalityBudget{
+		opts:  opts,
+		usage: map[string]*cardinalityUsage{},
+	}
+}
+
+// Separator between metric name and namespace in budget keys. It cannot be
+// contained in a valid metric name.
+const cardinalityKeySep = "\xff"
+
+// key returns the budget key under which the series of the given metric family is counted.
+func (b *cardinalityBudget) key(metric string, lset labels.Labels) string {
+	if b.opts.PerNamespace {
+		return metric + cardinalityKeySep + lset.Get(KeyNamespace)
+	}
+	return metric
+}
+
+// cardinalityGroup returns the group of the series within its metric. Series that only
+// differ in their metric name suffix or bucket and quantile labels share a group.
+func cardinalityGroup(lset labels.Labels) uint64 {
+	h, _ := lset.HashWithoutLabels(nil, labels.MetricName, labels.BucketLabel, "quantile")
+	return h
+}
+
+// add counts a series of the given group under the given key. It returns false if
+// the series is rejected as the limit for the key is reached. Series of a group
+// that is already counted are always admitted.
+func (b *cardinalityBudget) add(key string, group uint64) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	u, ok := b.usage[key]
+	if !ok {
+		u = &cardinalityUsage{active: map[uint64]int{}}
+		b.usage[key] = u
+	}
+	if u.active[group] > 0 {
+		u.active[group]++
+		return true
+	}
+	if uint(len(u.active)) >= b.opts.SeriesPerMetric {
+		if u.rejected == 0 {
+			cardinalityLimitedMetrics.Inc()
+		}
+		u.rejected++
+		cardinalityLimitedSeries.Inc()
+		return false
+	}
+	u.active[group] = 1
+	return true
+}
+
+// remove a series previously added under the given key and group.
+func (b *cardinalityBudget) remove(key string, group uint64, rejected bool) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	u, ok := b.usage[key]
+	if !ok {
+		return
+	}
+	if rejected {
+		u.rejected--
+		cardinalityLimitedSeries.Dec()
+		if u.rejected == 0 {
+			cardinalityLimitedMetrics.Dec()
+		}
+	} else {
+		u.active[group]--
+		if u.active[group] <= 0 {
+			delete(u.active, group)
+		}
+	}
+	if len(u.active) == 0 && u.rejected == 0 {
+		delete(b.usage, key)
+	}
+}
+
+type cardinalityOffender struct {
+	Metric    string `json:"metric"`
+	Namespace string `json:"namespace,omitempty"`
+	// Number of exported series. All series of one histogram or summary count once.
+	Active int `json:"active"`
+	// Number of series dropped for exceeding the limit.
+	Rejected int `json:"rejected"`
+}
+
+// topOffenders returns up to n metrics with the most series, ordered by the number of
+// rejected and then active series.
+func (b *cardinalityBudget) topOffenders(n int) []cardinalityOffender {
+	b.mtx.Lock()
+	res := make([]cardinalityOffender, 0, len(b.usage))
+	for key, u := range b.usage {
+		o := cardinalityOffender{Active: len(u.active), Rejected: u.rejected}
+		o.Metric, o.Namespace, _ = strings.Cut(key, cardinalityKeySep)
+		res = append(res, o)
+	}
+	b.mtx.Unlock()
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Rejected != res[j].Rejected {
+			return res[i].Rejected > res[j].Rejected
+		}
+		if res[i].Active != res[j].Active {
+			return res[i].Active > res[j].Active
+		}
+		return res[i].Metric+res[i].Namespace < res[j].Metric+res[j].Namespace
+	})
+	if len(res) > n {
+		res = res[:n]
+	}
+	return res
+}
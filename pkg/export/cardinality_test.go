@@ -0,0 +1,213 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/record"
+)
+
+func TestSeriesCache_cardinalityLimit(t *testing.T) {
+	for _, perNamespace := range []bool{false, true} {
+		t.Run(fmt.Sprintf("perNamespace=%v", perNamespace), func(t *testing.T) {
+			cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+			cache.budget = newCardinalityBudget(CardinalityLimitOpts{SeriesPerMetric: 2, PerNamespace: perNamespace})
+
+			// Series 1-3 are in namespace n1, series 4 in n2, and series 5 belongs to another metric.
+			cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+				switch ref {
+				case 4:
+					return labels.FromStrings("__name__", "metric1", "namespace", "n2", "pod", "4")
+				case 5:
+					return labels.FromStrings("__name__", "metric2", "namespace", "n1", "pod", "5")
+				}
+				return labels.FromStrings("__name__", "metric1", "namespace", "n1", "pod", fmt.Sprint(ref))
+			}
+			externalLabels := labels.FromStrings("project_id", "p1", "location", "l1")
+
+			now := time.Unix(1000, 0)
+			cache.now = func() time.Time { return now }
+
+			limitDropped := func(ref chunks.HeadSeriesRef) bool {
+				entry, ok := cache.get(record.RefSample{Ref: ref, T: now.UnixMilli()}, externalLabels, gaugeMetadata)
+				if !ok {
+					t.Fatalf("series %d not found", ref)
+				}
+				return entry.limitDropped
+			}
+			// Populate in order so that series 3 and 4 exceed the limit.
+			for _, c := range []struct {
+				ref  chunks.HeadSeriesRef
+				want bool
+			}{
+				{1, false}, {2, false}, {3, true}, {4, !perNamespace}, {5, false},
+			} {
+				if got := limitDropped(c.ref); got != c.want {
+					t.Fatalf("series %d: expected limitDropped=%v, got %v", c.ref, c.want, got)
+				}
+			}
+			want := []cardinalityOffender{
+				{Metric: "metric1", Active: 2, Rejected: 2},
+				{Metric: "metric2", Active: 1},
+			}
+			if perNamespace {
+				want = []cardinalityOffender{
+					{Metric: "metric1", Namespace: "n1", Active: 2, Rejected: 1},
+					{Metric: "metric1", Namespace: "n2", Active: 1},
+					{Metric: "metric2", Namespace: "n1", Active: 1},
+				}
+			}
+			if diff := cmp.Diff(want, cache.cardinalityOffenders(10)); diff != "" {
+				t.Fatalf("unexpected offenders (-want, +got): %s", diff)
+			}
+
+			// Once series 1 is garbage collected, series 3 is admitted on its next refresh.
+			e, _ := cache.lookup(1)
+			e.lastUsed = 0
+			if err := cache.garbageCollect(time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			e, _ = cache.lookup(3)
+			e.nextRefresh = 0
+
+			if limitDropped(3) {
+				t.Fatal("expected series 3 to be admitted")
+			}
+		})
+	}
+}
+
+func TestSeriesCache_cardinalityLimitHistogram(t *testing.T) {
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.budget = newCardinalityBudget(CardinalityLimitOpts{SeriesPerMetric: 1})
+
+	// Series 1-4 belong to the histogram of pod 1 and series 5-6 to the one of pod 2.
+	series := seriesMap{
+		1: labels.FromStrings("__name__", "metric1_bucket", "pod", "1", "le", "1"),
+		2: labels.FromStrings("__name__", "metric1_bucket", "pod", "1", "le", "+Inf"),
+		3: labels.FromStrings("__name__", "metric1_sum", "pod", "1"),
+		4: labels.FromStrings("__name__", "metric1_count", "pod", "1"),
+		5: labels.FromStrings("__name__", "metric1_bucket", "pod", "2", "le", "+Inf"),
+		6: labels.FromStrings("__name__", "metric1_count", "pod", "2"),
+	}
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return series[ref]
+	}
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1")
+	metadata := testMetadataFunc(metricMetadataMap{
+		"metric1": {Type: textparse.MetricTypeHistogram},
+	})
+
+	for ref := chunks.HeadSeriesRef(1); ref <= 6; ref++ {
+		entry, ok := cache.get(record.RefSample{Ref: ref, T: 1000}, externalLabels, metadata)
+		if !ok {
+			t.Fatalf("series %d not found", ref)
+		}
+		if want := ref > 4; entry.limitDropped != want {
+			t.Fatalf("series %d: expected limitDropped=%v, got %v", ref, want, entry.limitDropped)
+		}
+	}
+	want := []cardinalityOffender{
+		{Metric: "metric1", Active: 1, Rejected: 2},
+	}
+	if diff := cmp.Diff(want, cache.cardinalityOffenders(10)); diff != "" {
+		t.Fatalf("unexpected offenders (-want, +got): %s", diff)
+	}
+}
+
+func TestSeriesCache_cardinalityLimitMatchers(t *testing.T) {
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.budget = newCardinalityBudget(CardinalityLimitOpts{SeriesPerMetric: 1})
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("__name__", "metric1", "pod", fmt.Sprint(ref))
+	}
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1")
+
+	now := time.Unix(1000, 0)
+	cache.now = func() time.Time { return now }
+
+	build := func(ref chunks.HeadSeriesRef) int {
+		b := newSampleBuilder(cache)
+		defer b.close()
+
+		out, _, err := b.next(gaugeMetadata, externalLabels, []record.RefSample{{Ref: ref, T: now.UnixMilli(), V: 1}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(out)
+	}
+	if n := build(1); n != 1 {
+		t.Fatalf("expected series 1 to be exported, got %d samples", n)
+	}
+	if n := build(2); n != 0 {
+		t.Fatalf("expected series 2 to exceed the limit, got %d samples", n)
+	}
+	// Series 2 is excluded by the new matchers while it is dropped for the limit.
+	var matchers Matchers
+	if err := matchers.Set(`{pod="1"}`); err != nil {
+		t.Fatal(err)
+	}
+	cache.setMatchers(matchers)
+
+	// Free up the limit and refresh series 2. It must remain dropped.
+	e, _ := cache.lookup(1)
+	e.lastUsed = 0
+	if err := cache.garbageCollect(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	e, _ = cache.lookup(2)
+	e.nextRefresh = 0
+
+	if n := build(2); n != 0 {
+		t.Fatalf("expected series 2 excluded by matchers to not be exported, got %d samples", n)
+	}
+}
+
+func TestSeriesCache_cardinalityLimitReleaseProtos(t *testing.T) {
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("__name__", "metric1", "pod", fmt.Sprint(ref))
+	}
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1")
+
+	get := func(ref chunks.HeadSeriesRef) *seriesCacheEntry {
+		entry, ok := cache.get(record.RefSample{Ref: ref, T: 1000}, externalLabels, gaugeMetadata)
+		if !ok {
+			t.Fatalf("series %d not found", ref)
+		}
+		return entry
+	}
+	// Series 1 is exported before the limit applies.
+	if e := get(1); e.protos.empty() {
+		t.Fatal("expected series 1 to be populated")
+	}
+	cache.budget = newCardinalityBudget(CardinalityLimitOpts{SeriesPerMetric: 1})
+	get(2)
+
+	e, _ := cache.lookup(1)
+	e.nextRefresh = 0
+
+	if e := get(1); !e.limitDropped || !e.protos.empty() {
+		t.Fatalf("expected series 1 to be dropped without protos, got limitDropped=%v", e.limitDropped)
+	}
+}
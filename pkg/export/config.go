@@ -0,0 +1,409 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/promql/parser"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config is the exporter configuration that can be changed at runtime. It is loaded
+// from the configured file whenever ApplyConfig is called.
+type Config struct {
+	// Prometheus series selectors. Only series matching at least one of them or of
+	// the matchers set through ExporterOpts are exported.
+	Match []string `yaml:"match,omitempty"`
+
+	// Relabeling rules applied to series before they are exported. They are applied
+	// after the rules set through ExporterOpts.
+	RelabelConfigs []*relabel.Config `yaml:"relabel_configs,omitempty"`
+
+	// Mappings of series to monitored resources other than the default prometheus_target.
+	// The first mapping whose matcher selects a series is used.
+	ResourceMappings []ResourceMapping `yaml:"resource_mappings,omitempty"`
+
+	// Metadata of metrics by name. The first override matching a metric name is used
+	// instead of the metadata found for the metric, if any.
+	MetadataOverrides []MetadataOverride `yaml:"metadata_overrides,omitempty"`
+
+	// Minimum intervals between exported points of series. The first interval whose
+	// matcher selects a series is used. Series without one are exported at full resolution.
+	ExportIntervals []ExportInterval `yaml:"export_intervals,omitempty"`
+
+	// Rules that merge series into aggregates, which are exported instead of them. The
+	// first rule whose matcher selects a series is used.
+	AggregationRules []AggregationRule `yaml:"aggregation_rules,omitempty"`
+
+	// Export priority classes of series. The first class whose matcher selects a series
+	// is used. Series without one have normal priority.
+	PriorityClasses []PriorityClass `yaml:"priority_classes,omitempty"`
+
+	// Handling of series that exceed the label and size limits of GCM.
+	Limits LimitsConfig `yaml:"limits,omitempty"`
+}
+
+// LimitsConfig configures how series that exceed the limits of GCM are handled. Every
+// violation is counted by metric name.
+type LimitsConfig struct {
+	// The strategy applied to series exceeding the limits: drop, truncate, or drop_labels.
+	// With truncate, over-long label names, label values, and metric names are truncated
+	// and end in a hash of their full value. With drop_labels, the labels in the drop order
+	// are removed one by one until the series is within the limits. Series that remain
+	// beyond the limits are dropped. Defaults to drop.
+	Strategy string `yaml:"strategy,omitempty"`
+	// The order in which labels are removed by the drop_labels strategy.
+	LabelDropOrder []string `yaml:"label_drop_order,omitempty"`
+}
+
+// PriorityClass sets the export priority of series. When the export queues are full,
+// samples of higher priority series are kept over those of lower priority series and
+// are sent first.
+type PriorityClass struct {
+	// A Prometheus series selector. The selector is applied to the series labels after
+	// relabeling.
+	Match string `yaml:"match"`
+	// The priority of the series: high, normal, or low.
+	Priority string `yaml:"priority"`
+}
+
+// ExportInterval sets the minimum interval between exported points of series.
+type ExportInterval struct {
+	// A Prometheus series selector. The selector is applied to the series labels after
+	// relabeling.
+	Match string `yaml:"match"`
+	// The minimum interval between two exported points of a series. Samples within the
+	// interval of the last exported point are skipped.
+	Interval model.Duration `yaml:"interval"`
+}
+
+// AggregationRule merges series that only differ in the given labels into a single series.
+type AggregationRule struct {
+	// A Prometheus series selector. The selector is applied to the series labels after
+	// relabeling.
+	Match string `yaml:"match"`
+	// The labels that are aggregated away.
+	Without []string `yaml:"without"`
+	// The function applied to gauges: sum, min, max, avg, or count. Defaults to sum.
+	// Counters are always summed so that they remain monotonic. Histograms are not
+	// aggregated.
+	Function string `yaml:"function,omitempty"`
+	// The interval at which aggregated points are exported. Gauges are aggregated
+	// over the most recent point of each series within the window. Defaults to 1m.
+	Window model.Duration `yaml:"window,omitempty"`
+}
+
+// MetadataOverride sets the metadata of metrics whose name matches a pattern.
+type MetadataOverride struct {
+	// An RE2 regular expression that must match the full metric name. Histograms,
+	// summaries, and counters are matched by their name without the _bucket, _sum,
+	// _count, and _total suffixes.
+	Match string `yaml:"match"`
+	// The metric type, e.g. counter or gauge.
+	Type string `yaml:"type"`
+	// The unit of the metric. It is not changed if empty.
+	Unit string `yaml:"unit,omitempty"`
+	// The help text of the metric. It is not changed if empty.
+	Help string `yaml:"help,omitempty"`
+}
+
+// ResourceMapping maps series to a monitored resource type.
+type ResourceMapping struct {
+	// A Prometheus series selector. The selector is applied to the series labels
+	// merged with the external labels.
+	Match string `yaml:"match"`
+	// The monitored resource type, e.g. k8s_container.
+	Type string `yaml:"type"`
+	// Map from series label names to the resource fields they populate. Resource
+	// fields that are not mapped are populated from the label of the same name.
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// LoadConfigFile loads and validates the exporter configuration from the given file.
+func LoadConfigFile(filename string) (*Config, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cfg Config
+	if err := yaml.UnmarshalStrict(b, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing file %q: %w", filename, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks whether the configuration is valid.
+func (c *Config) Validate() error {
+	if _, err := c.matchers(); err != nil {
+		return err
+	}
+	if _, err := c.resourceMappings(); err != nil {
+		return err
+	}
+	if _, err := c.metadataOverrides(); err != nil {
+		return err
+	}
+	if _, err := c.exportIntervals(); err != nil {
+		return err
+	}
+	if _, err := c.aggregationRules(); err != nil {
+		return err
+	}
+	if _, err := c.priorityClasses(); err != nil {
+		return err
+	}
+	if _, err := c.limits(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// matchers returns the parsed series selectors of the configuration.
+func (c *Config) matchers() (Matchers, error) {
+	var ms Matchers
+	for _, m := range c.Match {
+		if err := ms.Set(m); err != nil {
+			return nil, err
+		}
+	}
+	return ms, nil
+}
+
+// The fields of supported monitored resource types.
+var resourceTypeFields = map[string][]string{
+	"prometheus_target": {KeyProjectID, KeyLocation, KeyCluster, KeyNamespace, KeyJob, KeyInstance},
+	"k8s_container":     {KeyProjectID, KeyLocation, "cluster_name", "namespace_name", "pod_name", "container_name"},
+	"k8s_pod":           {KeyProjectID, KeyLocation, "cluster_name", "namespace_name", "pod_name"},
+	"k8s_node":          {KeyProjectID, KeyLocation, "cluster_name", "node_name"},
+	"generic_task":      {KeyProjectID, KeyLocation, KeyNamespace, KeyJob, "task_id"},
+	"generic_node":      {KeyProjectID, KeyLocation, KeyNamespace, "node_id"},
+}
+
+// resourceMapping is the validated form of a ResourceMapping.
+type resourceMapping struct {
+	selector labels.Selector
+	typ      string
+	// Map from resource fields to the series labels they are populated from.
+	fields map[string]string
+}
+
+// defaultResourceMapping maps all series to the prometheus_target resource.
+var defaultResourceMapping = newIdentityResourceMapping(nil, "prometheus_target")
+
+func newIdentityResourceMapping(sel labels.Selector, typ string) *resourceMapping {
+	m := &resourceMapping{selector: sel, typ: typ, fields: map[string]string{}}
+	for _, f := range resourceTypeFields[typ] {
+		m.fields[f] = f
+	}
+	return m
+}
+
+// resourceMappings validates the configured resource mappings and returns them in
+// their compiled form.
+func (c *Config) resourceMappings() ([]*resourceMapping, error) {
+	var res []*resourceMapping
+
+	for i, rm := range c.ResourceMappings {
+		sel, err := parser.ParseMetricSelector(rm.Match)
+		if err != nil {
+			return nil, fmt.Errorf("resource mapping %d: invalid matcher %q: %w", i, rm.Match, err)
+		}
+		if _, ok := resourceTypeFields[rm.Type]; !ok {
+			return nil, fmt.Errorf("resource mapping %d: unsupported resource type %q", i, rm.Type)
+		}
+		m := newIdentityResourceMapping(sel, rm.Type)
+		mapped := map[string]string{}
+
+		for label, field := range rm.Labels {
+			if !model.LabelName(label).IsValid() {
+				return nil, fmt.Errorf("resource mapping %d: invalid label name %q", i, label)
+			}
+			if _, ok := m.fields[field]; !ok {
+				return nil, fmt.Errorf("resource mapping %d: resource type %q has no field %q", i, rm.Type, field)
+			}
+			if other, ok := mapped[field]; ok {
+				return nil, fmt.Errorf("resource mapping %d: field %q mapped from both labels %q and %q", i, field, other, label)
+			}
+			mapped[field] = label
+			m.fields[field] = label
+		}
+		res = append(res, m)
+	}
+	return res, nil
+}
+
+// The metric types that metadata can be overridden with.
+var overrideMetricTypes = map[textparse.MetricType]struct{}{
+	textparse.MetricTypeCounter:        {},
+	textparse.MetricTypeGauge:          {},
+	textparse.MetricTypeHistogram:      {},
+	textparse.MetricTypeGaugeHistogram: {},
+	textparse.MetricTypeSummary:        {},
+	textparse.MetricTypeInfo:           {},
+	textparse.MetricTypeStateset:       {},
+	textparse.MetricTypeUnknown:        {},
+}
+
+// metadataOverride is the validated form of a MetadataOverride.
+type metadataOverride struct {
+	regexp *regexp.Regexp
+	typ    textparse.MetricType
+	unit   string
+	help   string
+}
+
+// metadataOverrides validates the configured metadata overrides and returns them in
+// their compiled form.
+func (c *Config) metadataOverrides() ([]*metadataOverride, error) {
+	var res []*metadataOverride
+
+	for i, o := range c.MetadataOverrides {
+		re, err := regexp.Compile("^(?:" + o.Match + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("metadata override %d: invalid pattern %q: %w", i, o.Match, err)
+		}
+		typ := textparse.MetricType(o.Type)
+		if _, ok := overrideMetricTypes[typ]; !ok {
+			return nil, fmt.Errorf("metadata override %d: unsupported metric type %q", i, o.Type)
+		}
+		res = append(res, &metadataOverride{regexp: re, typ: typ, unit: o.Unit, help: o.Help})
+	}
+	return res, nil
+}
+
+// exportInterval is the validated form of an ExportInterval.
+type exportInterval struct {
+	selector labels.Selector
+	// The interval in milliseconds.
+	interval int64
+}
+
+// exportIntervals validates the configured export intervals and returns them in
+// their compiled form.
+func (c *Config) exportIntervals() ([]*exportInterval, error) {
+	var res []*exportInterval
+
+	for i, ei := range c.ExportIntervals {
+		sel, err := parser.ParseMetricSelector(ei.Match)
+		if err != nil {
+			return nil, fmt.Errorf("export interval %d: invalid matcher %q: %w", i, ei.Match, err)
+		}
+		if ei.Interval <= 0 {
+			return nil, fmt.Errorf("export interval %d: interval must be positive", i)
+		}
+		res = append(res, &exportInterval{selector: sel, interval: time.Duration(ei.Interval).Milliseconds()})
+	}
+	return res, nil
+}
+
+// Default window of aggregation rules.
+const defaultAggregationWindow = time.Minute
+
+// aggregationRules validates the configured aggregation rules and returns them in
+// their compiled form.
+func (c *Config) aggregationRules() ([]*aggregationRule, error) {
+	var res []*aggregationRule
+
+	for i, ar := range c.AggregationRules {
+		sel, err := parser.ParseMetricSelector(ar.Match)
+		if err != nil {
+			return nil, fmt.Errorf("aggregation rule %d: invalid matcher %q: %w", i, ar.Match, err)
+		}
+		if len(ar.Without) == 0 {
+			return nil, fmt.Errorf("aggregation rule %d: no labels to aggregate away", i)
+		}
+		for _, l := range ar.Without {
+			if !model.LabelName(l).IsValid() || l == labels.MetricName {
+				return nil, fmt.Errorf("aggregation rule %d: invalid label name %q", i, l)
+			}
+		}
+		r := &aggregationRule{
+			selector: sel,
+			without:  ar.Without,
+			function: ar.Function,
+			window:   time.Duration(ar.Window).Milliseconds(),
+		}
+		switch r.function {
+		case "":
+			r.function = aggregationSum
+		case aggregationSum, aggregationMin, aggregationMax, aggregationAvg, aggregationCount:
+		default:
+			return nil, fmt.Errorf("aggregation rule %d: unsupported function %q", i, ar.Function)
+		}
+		if ar.Window < 0 {
+			return nil, fmt.Errorf("aggregation rule %d: negative window", i)
+		}
+		if ar.Window == 0 {
+			r.window = defaultAggregationWindow.Milliseconds()
+		}
+		res = append(res, r)
+	}
+	return res, nil
+}
+
+// priorityClasses validates the configured priority classes and returns them in their
+// compiled form.
+func (c *Config) priorityClasses() ([]*priorityClass, error) {
+	var res []*priorityClass
+
+	for i, pc := range c.PriorityClasses {
+		sel, err := parser.ParseMetricSelector(pc.Match)
+		if err != nil {
+			return nil, fmt.Errorf("priority class %d: invalid matcher %q: %w", i, pc.Match, err)
+		}
+		p, err := parsePriority(pc.Priority)
+		if err != nil {
+			return nil, fmt.Errorf("priority class %d: %w", i, err)
+		}
+		res = append(res, &priorityClass{selector: sel, priority: p})
+	}
+	return res, nil
+}
+
+// limits validates the configured limits handling and returns it in its compiled form.
+func (c *Config) limits() (*gcmLimits, error) {
+	l := &gcmLimits{strategy: c.Limits.Strategy, dropOrder: c.Limits.LabelDropOrder}
+
+	switch l.strategy {
+	case "":
+		l.strategy = limitsStrategyDrop
+	case limitsStrategyDrop, limitsStrategyTruncate, limitsStrategyDropLabels:
+	default:
+		return nil, fmt.Errorf("limits: unsupported strategy %q", c.Limits.Strategy)
+	}
+	if l.strategy == limitsStrategyDropLabels && len(l.dropOrder) == 0 {
+		return nil, fmt.Errorf("limits: strategy %q requires a label drop order", l.strategy)
+	}
+	if l.strategy != limitsStrategyDropLabels && len(l.dropOrder) > 0 {
+		return nil, fmt.Errorf("limits: label drop order requires strategy %q", limitsStrategyDropLabels)
+	}
+	for _, name := range l.dropOrder {
+		if !model.LabelName(name).IsValid() || name == labels.MetricName {
+			return nil, fmt.Errorf("limits: invalid label name %q", name)
+		}
+	}
+	return l, nil
+}
@@ -0,0 +1,434 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/record"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	cases := []struct {
+		doc     string
+		content string
+		wantErr bool
+	}{
+		{
+			doc: "valid",
+			content: `
+resource_mappings:
+- match: '{job="j1"}'
+  type: k8s_container
+  labels:
+    cluster: cluster_name
+    pod: pod_name
+`,
+		}, {
+			doc:     "unknown field",
+			content: `foo: bar`,
+			wantErr: true,
+		}, {
+			doc: "invalid matcher",
+			content: `
+resource_mappings:
+- match: '{job=}'
+  type: k8s_container
+`,
+			wantErr: true,
+		}, {
+			doc: "unsupported resource type",
+			content: `
+resource_mappings:
+- match: '{job="j1"}'
+  type: gce_instance
+`,
+			wantErr: true,
+		}, {
+			doc: "unknown resource field",
+			content: `
+resource_mappings:
+- match: '{job="j1"}'
+  type: k8s_container
+  labels:
+    pod: pod
+`,
+			wantErr: true,
+		}, {
+			doc: "field mapped twice",
+			content: `
+resource_mappings:
+- match: '{job="j1"}'
+  type: k8s_container
+  labels:
+    pod: pod_name
+    pod_id: pod_name
+`,
+			wantErr: true,
+		}, {
+			doc: "valid metadata override",
+			content: `
+metadata_overrides:
+- match: 'foo_.*'
+  type: counter
+  unit: seconds
+  help: Some help.
+`,
+		}, {
+			doc: "invalid metadata override pattern",
+			content: `
+metadata_overrides:
+- match: 'foo_('
+  type: counter
+`,
+			wantErr: true,
+		}, {
+			doc: "valid export interval",
+			content: `
+export_intervals:
+- match: '{job="j1"}'
+  interval: 1m
+`,
+		}, {
+			doc: "non-positive export interval",
+			content: `
+export_intervals:
+- match: '{job="j1"}'
+  interval: 0s
+`,
+			wantErr: true,
+		}, {
+			doc: "valid aggregation rule",
+			content: `
+aggregation_rules:
+- match: '{__name__="requests_total"}'
+  without: [pod, instance]
+  function: sum
+  window: 1m
+`,
+		}, {
+			doc: "aggregation rule without labels",
+			content: `
+aggregation_rules:
+- match: '{__name__="requests_total"}'
+`,
+			wantErr: true,
+		}, {
+			doc: "aggregation rule removing the metric name",
+			content: `
+aggregation_rules:
+- match: '{__name__="requests_total"}'
+  without: [__name__]
+`,
+			wantErr: true,
+		}, {
+			doc: "unsupported aggregation function",
+			content: `
+aggregation_rules:
+- match: '{__name__="requests_total"}'
+  without: [pod]
+  function: rate
+`,
+			wantErr: true,
+		}, {
+			doc: "valid priority classes",
+			content: `
+priority_classes:
+- match: '{__name__=~"up|slo_.+"}'
+  priority: high
+- match: '{job="batch"}'
+  priority: low
+`,
+		}, {
+			doc: "unknown priority",
+			content: `
+priority_classes:
+- match: '{job="j1"}'
+  priority: urgent
+`,
+			wantErr: true,
+		}, {
+			doc: "valid limits",
+			content: `
+limits:
+  strategy: drop_labels
+  label_drop_order: [pod, instance]
+`,
+		}, {
+			doc: "unsupported limits strategy",
+			content: `
+limits:
+  strategy: ignore
+`,
+			wantErr: true,
+		}, {
+			doc: "label drop order without drop_labels strategy",
+			content: `
+limits:
+  strategy: truncate
+  label_drop_order: [pod]
+`,
+			wantErr: true,
+		}, {
+			doc: "unsupported metadata override type",
+			content: `
+metadata_overrides:
+- match: 'foo'
+  type: bar
+`,
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.doc, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(c.content), 0666); err != nil {
+				t.Fatal(err)
+			}
+			_, err := LoadConfigFile(path)
+			if err != nil && !c.wantErr {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if err == nil && c.wantErr {
+				t.Fatal("expected error but got none")
+			}
+		})
+	}
+}
+
+func TestExporter_ApplyConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	e, err := New(nil, nil, ExporterOpts{
+		Sink:       NewMemorySink(),
+		ProjectID:  "p1",
+		Location:   "l1",
+		ConfigFile: path,
+	})
+	if err != nil {
+		t.Fatalf("Creating Exporter failed: %s", err)
+	}
+	e.SetLabelsByIDFunc(func(ref storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("__name__", "metric1", "job", "j1", "pod", "pod1")
+	})
+	apply := func(content string) error {
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return e.ApplyConfig(&config.DefaultConfig)
+	}
+	resourceType := func() string {
+		entry, ok := e.seriesCache.get(record.RefSample{Ref: 1, T: 1000}, e.externalLabels, gaugeMetadata)
+		if !ok {
+			t.Fatal("series not found")
+		}
+		return entry.protos.gauge.proto.Resource.Type
+	}
+	if err := apply(""); err != nil {
+		t.Fatal(err)
+	}
+	if got := resourceType(); got != "prometheus_target" {
+		t.Fatalf("expected resource type prometheus_target, got %q", got)
+	}
+	// Changed mappings apply to already cached series.
+	if err := apply("resource_mappings: [{match: '{job=\"j1\"}', type: k8s_pod, labels: {pod: pod_name}}]"); err != nil {
+		t.Fatal(err)
+	}
+	if got := resourceType(); got != "k8s_pod" {
+		t.Fatalf("expected resource type k8s_pod, got %q", got)
+	}
+	// An invalid configuration is rejected and the previous one remains in effect.
+	if err := apply("resource_mappings: [{match: '{job=\"j1\"}', type: unknown}]"); err == nil {
+		t.Fatal("expected error but got none")
+	}
+	if got := resourceType(); got != "k8s_pod" {
+		t.Fatalf("expected resource type k8s_pod, got %q", got)
+	}
+	// Priority classes are assigned to cached series.
+	if err := apply("priority_classes: [{match: '{job=\"j1\"}', priority: high}]"); err != nil {
+		t.Fatal(err)
+	}
+	entry, ok := e.seriesCache.get(record.RefSample{Ref: 1, T: 1000}, e.externalLabels, gaugeMetadata)
+	if !ok {
+		t.Fatal("series not found")
+	}
+	if entry.priority != priorityHigh {
+		t.Fatalf("expected priority high, got %s", entry.priority)
+	}
+}
+
+func TestExporter_ApplyConfigFileDuringExport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	e, err := New(nil, nil, ExporterOpts{
+		Sink:       NewMemorySink(),
+		ProjectID:  "p1",
+		Location:   "l1",
+		ConfigFile: path,
+	})
+	if err != nil {
+		t.Fatalf("Creating Exporter failed: %s", err)
+	}
+	e.SetLabelsByIDFunc(func(ref storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("__name__", "metric1", "job", "j1")
+	})
+	if err := os.WriteFile(path, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.ApplyConfig(&config.DefaultConfig); err != nil {
+		t.Fatal(err)
+	}
+	// The metadata function is called while the series is populated and blocks until
+	// the config file is being applied. The series has no metadata, which makes the
+	// exporter fall back to its defaults under its own lock.
+	populating, release := make(chan struct{}), make(chan struct{})
+	metadata := func(metric string) (MetricMetadata, bool) {
+		if metric == "metric1" {
+			close(populating)
+			<-release
+		}
+		return MetricMetadata{}, false
+	}
+	exported := make(chan struct{})
+	go func() {
+		e.Export(metadata, []record.RefSample{{Ref: 1, T: 1000, V: 1}}, nil)
+		close(exported)
+	}()
+	<-populating
+
+	if err := os.WriteFile(path, []byte("match: ['{job=\"j1\"}']"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	applied := make(chan error)
+	go func() {
+		applied <- e.ApplyConfig(&config.DefaultConfig)
+	}()
+	// Give applying the config file time to block on the series cache.
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	timeout := time.After(10 * time.Second)
+	select {
+	case <-exported:
+	case <-timeout:
+		t.Fatal("exporting samples did not complete")
+	}
+	select {
+	case err := <-applied:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-timeout:
+		t.Fatal("applying config file did not complete")
+	}
+}
+
+func TestExporter_metadataOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+
+	e, err := New(nil, nil, ExporterOpts{
+		Sink:       NewMemorySink(),
+		ProjectID:  "p1",
+		Location:   "l1",
+		ConfigFile: path,
+	})
+	if err != nil {
+		t.Fatalf("Creating Exporter failed: %s", err)
+	}
+	lsets := map[storage.SeriesRef]labels.Labels{
+		1: labels.FromStrings("__name__", "requests_total", "job", "j1"),
+		2: labels.FromStrings("__name__", "latency_seconds_bucket", "job", "j1", "le", "1"),
+		3: labels.FromStrings("__name__", "temperature", "job", "j1"),
+	}
+	e.SetLabelsByIDFunc(func(ref storage.SeriesRef) labels.Labels { return lsets[ref] })
+
+	apply := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.ApplyConfig(&config.DefaultConfig); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The scraped metadata only knows about the temperature metric.
+	scraped := func(metric string) (MetricMetadata, bool) {
+		if metric == "temperature" {
+			return MetricMetadata{Metric: metric, Type: textparse.MetricTypeGauge, Help: "scraped help"}, true
+		}
+		return MetricMetadata{}, false
+	}
+	metricTypes := func() []string {
+		var res []string
+		for ref := storage.SeriesRef(1); ref <= 3; ref++ {
+			entry, ok := e.seriesCache.get(record.RefSample{Ref: chunks.HeadSeriesRef(ref), T: 1000}, e.externalLabels, e.wrapMetadata(scraped))
+			if !ok {
+				t.Fatalf("series %d not found", ref)
+			}
+			if entry.protos.gauge.proto != nil {
+				res = append(res, entry.protos.gauge.proto.Metric.Type)
+			}
+			if entry.protos.cumulative.proto != nil {
+				res = append(res, entry.protos.cumulative.proto.Metric.Type)
+			}
+		}
+		return res
+	}
+	apply("")
+
+	want := []string{
+		"prometheus.googleapis.com/requests_total/unknown",
+		"prometheus.googleapis.com/requests_total/unknown:counter",
+		"prometheus.googleapis.com/latency_seconds_bucket/unknown",
+		"prometheus.googleapis.com/latency_seconds_bucket/unknown:counter",
+		"prometheus.googleapis.com/temperature/gauge",
+	}
+	if diff := cmp.Diff(want, metricTypes()); diff != "" {
+		t.Fatalf("unexpected metric types (-want, +got): %s", diff)
+	}
+	// Overrides apply to already cached series and take precedence over scraped metadata.
+	apply(`
+metadata_overrides:
+- match: requests
+  type: counter
+- match: latency_.*
+  type: histogram
+  unit: seconds
+- match: temperature
+  type: counter
+  unit: celsius
+`)
+	want = []string{
+		"prometheus.googleapis.com/requests_total/counter",
+		"prometheus.googleapis.com/latency_seconds/histogram",
+		"prometheus.googleapis.com/temperature/counter",
+	}
+	if diff := cmp.Diff(want, metricTypes()); diff != "" {
+		t.Fatalf("unexpected metric types (-want, +got): %s", diff)
+	}
+	md, _ := e.wrapMetadata(scraped)("temperature")
+	wantMetadata := MetricMetadata{Metric: "temperature", Type: textparse.MetricTypeCounter, Help: "scraped help", Unit: "celsius"}
+	if diff := cmp.Diff(wantMetadata, md); diff != "" {
+		t.Fatalf("unexpected metadata (-want, +got): %s", diff)
+	}
+}
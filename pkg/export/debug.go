@@ -0,0 +1,220 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/storage"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// Number of most recent send errors retained for debugging.
+	sendErrorLogSize = 100
+	// Default maximum number of series cache entries returned by the debug handler.
+	debugSeriesLimit = 100
+	// Number of metrics with the most series returned by the debug handler.
+	debugCardinalityOffenders = 20
+)
+
+type sendError struct {
+	Time      time.Time `json:"time"`
+	ProjectID string    `json:"projectId"`
+	Code      string    `json:"code"`
+	Samples   int       `json:"samples"`
+	Message   string    `json:"message"`
+}
+
+// sendErrorLog retains the most recent send errors.
+type sendErrorLog struct {
+	mtx  sync.Mutex
+	buf  []sendError
+	next int
+}
+
+func newSendErrorLog(size int) *sendErrorLog {
+	return &sendErrorLog{buf: make([]sendError, 0, size)}
+}
+
+func (l *sendErrorLog) add(projectID string, code codes.Code, samples int, err error) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	e := sendError{
+		Time:      time.Now(),
+		ProjectID: projectID,
+		Code:      code.String(),
+		Samples:   samples,
+		Message:   err.Error(),
+	}
+	if len(l.buf) < cap(l.buf) {
+		l.buf = append(l.buf, e)
+	} else {
+		l.buf[l.next] = e
+	}
+	l.next = (l.next + 1) % cap(l.buf)
+}
+
+// errors returns the retained errors grouped by project and code, most recent first.
+func (l *sendErrorLog) errors() map[string]map[string][]sendError {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	res := map[string]map[string][]sendError{}
+	for i := 1; i <= len(l.buf); i++ {
+		e := l.buf[(l.next-i+len(l.buf))%len(l.buf)]
+
+		if res[e.ProjectID] == nil {
+			res[e.ProjectID] = map[string][]sendError{}
+		}
+		res[e.ProjectID][e.Code] = append(res[e.ProjectID][e.Code], e)
+	}
+	return res
+}
+
+type debugShard struct {
+	Index   int  `json:"index"`
+	Length  int  `json:"length"`
+	Pending bool `json:"pending"`
+}
+
+type debugSeries struct {
+	Labels  string `json:"labels"`
+	Dropped bool   `json:"dropped"`
+	// Whether the series is dropped for exceeding the cardinality limit.
+	LimitDropped bool `json:"limitDropped,omitempty"`
+	// Whether samples of the series are dropped for exceeding GCM limits.
+	GCMLimitsExceeded bool      `json:"gcmLimitsExceeded,omitempty"`
+	MetricType        string    `json:"metricType"`
+	LastUsed          time.Time `json:"lastUsed"`
+
+	HasReset       bool    `json:"hasReset"`
+	ResetTimestamp int64   `json:"resetTimestamp,omitempty"`
+	ResetValue     float64 `json:"resetValue,omitempty"`
+	LastValue      float64 `json:"lastValue,omitempty"`
+}
+
+type debugState struct {
+	// Only shards with queued samples or pending requests are listed.
+	Shards          []debugShard  `json:"shards"`
+	QueuedSamples   int           `json:"queuedSamples"`
+	SeriesCacheSize int           `json:"seriesCacheSize"`
+	Series          []debugSeries `json:"series,omitempty"`
+	// Metrics with the most series if a cardinality limit is configured.
+	CardinalityTopOffenders []cardinalityOffender             `json:"cardinalityTopOffenders,omitempty"`
+	RecentSendErrors        map[string]map[string][]sendError `json:"recentSendErrors"`
+}
+
+// DebugHandler returns an HTTP handler that shows the internal state of the exporter as JSON.
+// Series cache entries are listed for series matching any of the selectors provided through
+// the match[] URL parameter, up to the number provided through the limit parameter.
+// The handler responds with 404 unless enabled through ExporterOpts.EnableDebugHandler.
+func (e *Exporter) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if e.opts.Disable || !e.opts.EnableDebugHandler {
+			http.NotFound(w, r)
+			return
+		}
+		var matchers Matchers
+		for _, s := range r.URL.Query()["match[]"] {
+			if err := matchers.Set(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		limit := debugSeriesLimit
+		if s := r.URL.Query().Get("limit"); s != "" {
+			var err error
+			if limit, err = strconv.Atoi(s); err != nil {
+				http.Error(w, fmt.Sprintf("invalid limit: %s", err), http.StatusBadRequest)
+				return
+			}
+		}
+		state := debugState{
+			RecentSendErrors: e.sendErrors.errors(),
+		}
+		for i, s := range e.shards {
+			s.mtx.Lock()
+			n, pending := s.queuedLen()+s.delayedLen, s.pending
+			s.mtx.Unlock()
+
+			state.QueuedSamples += n
+			if n > 0 || pending {
+				state.Shards = append(state.Shards, debugShard{Index: i, Length: n, Pending: pending})
+			}
+		}
+		state.SeriesCacheSize, state.Series = e.seriesCache.debugEntries(matchers, limit)
+		state.CardinalityTopOffenders = e.seriesCache.cardinalityOffenders(debugCardinalityOffenders)
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(state); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// debugEntries returns the number of cache entries and up to limit entries that match
+// any of the matchers. No entries are returned if there are no matchers.
+func (c *seriesCache) debugEntries(matchers Matchers, limit int) (int, []debugSeries) {
+	var (
+		res []debugSeries
+		n   int
+	)
+	if len(matchers) == 0 {
+		return c.len(), nil
+	}
+	c.forEach(func(_ storage.SeriesRef, entry *seriesCacheEntry) {
+		n++
+		if len(res) >= limit {
+			return
+		}
+		if entry.lset == nil || !matchers.Matches(entry.lset) {
+			return
+		}
+		res = append(res, debugSeries{
+			Labels:            entry.lset.String(),
+			Dropped:           entry.dropped,
+			LimitDropped:      entry.limitDropped,
+			GCMLimitsExceeded: entry.gcmLimitsExceeded,
+			MetricType:        string(entry.metadata.Type),
+			LastUsed:          time.Unix(entry.lastUsed, 0),
+			HasReset:          entry.hasReset,
+			ResetTimestamp:    entry.resetTimestamp,
+			ResetValue:        entry.resetValue,
+			LastValue:         entry.lastValue,
+		})
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].Labels < res[j].Labels })
+
+	return n, res
+}
+
+// cardinalityOffenders returns up to n metrics with the most series. Returns nil if
+// no cardinality limit is configured.
+func (c *seriesCache) cardinalityOffenders(n int) []cardinalityOffender {
+	if c.budget == nil {
+		return nil
+	}
+	return c.budget.topOffenders(n)
+}
@@ -0,0 +1,106 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"google.golang.org/grpc/codes"
+)
+
+func TestExporter_DebugHandler(t *testing.T) {
+	e, err := New(nil, nil, ExporterOpts{Sink: NewMemorySink(), EnableDebugHandler: true})
+	if err != nil {
+		t.Fatalf("Creating Exporter failed: %s", err)
+	}
+	e.SetLabelsByIDFunc(func(ref storage.SeriesRef) labels.Labels {
+		if ref == 1 {
+			return labels.FromStrings("__name__", "metric_1", "project_id", "p1", "location", "l1")
+		}
+		return labels.FromStrings("__name__", "metric_2", "project_id", "p1", "location", "l1")
+	})
+	e.Export(nil, []record.RefSample{
+		{Ref: 1, T: 1000, V: 1},
+		{Ref: 2, T: 1000, V: 2},
+	}, nil)
+
+	e.sendErrors.add("p1", codes.Unavailable, 10, errors.New("unavailable"))
+	e.sendErrors.add("p1", codes.InvalidArgument, 5, errors.New("invalid"))
+	e.sendErrors.add("p2", codes.Unavailable, 1, errors.New("unavailable"))
+
+	req := httptest.NewRequest("GET", "/debug/export?match[]="+url.QueryEscape(`{__name__="metric_1"}`), nil)
+	w := httptest.NewRecorder()
+	e.DebugHandler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body)
+	}
+	var state debugState
+	if err := json.Unmarshal(w.Body.Bytes(), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state.QueuedSamples != 2 || len(state.Shards) != 2 {
+		t.Fatalf("expected 2 queued samples in 2 shards, got %d in %d", state.QueuedSamples, len(state.Shards))
+	}
+	if state.SeriesCacheSize != 2 {
+		t.Fatalf("expected series cache size 2, got %d", state.SeriesCacheSize)
+	}
+	if len(state.Series) != 1 || state.Series[0].Labels != `{__name__="metric_1", location="l1", project_id="p1"}` {
+		t.Fatalf("unexpected series %v", state.Series)
+	}
+	if state.Series[0].MetricType != "gauge" {
+		t.Fatalf("unexpected metric type %q", state.Series[0].MetricType)
+	}
+	if got := len(state.RecentSendErrors["p1"]["Unavailable"]); got != 1 {
+		t.Fatalf("expected 1 unavailable error for p1, got %d", got)
+	}
+	if got := len(state.RecentSendErrors["p2"]); got != 1 {
+		t.Fatalf("expected 1 error code for p2, got %d", got)
+	}
+
+	// The handler is disabled by default.
+	e.opts.EnableDebugHandler = false
+	w = httptest.NewRecorder()
+	e.DebugHandler().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404 for disabled handler, got %d", w.Code)
+	}
+}
+
+func TestSendErrorLog(t *testing.T) {
+	l := newSendErrorLog(3)
+	for i := 0; i < 5; i++ {
+		l.add("p", codes.Code(i), i, errors.New("err"))
+	}
+	// Only the most recent errors are retained.
+	errs := l.errors()["p"]
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 error codes, got %d", len(errs))
+	}
+	for _, c := range []codes.Code{2, 3, 4} {
+		if len(errs[c.String()]) != 1 {
+			t.Fatalf("expected error for code %s, got %v", c, errs)
+		}
+	}
+}
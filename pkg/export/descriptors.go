@@ -0,0 +1,274 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/textparse"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	label_pb "google.golang.org/genproto/googleapis/api/label"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+var (
+	metricDescriptorsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_metric_descriptors_created_total",
+		Help: "Number of metric descriptors created with Prometheus metadata.",
+	})
+	metricDescriptorFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_metric_descriptor_failures_total",
+		Help: "Number of failed attempts to create a metric descriptor.",
+	})
+)
+
+const (
+	// Number of descriptors that may wait to be created. Further descriptors are
+	// attempted again once their metric is observed again.
+	descriptorQueueSize = 1000
+	// Timeout of a single request to create a descriptor.
+	descriptorRequestTimeout = 30 * time.Second
+	// Bounds of the backoff after a descriptor could not be created.
+	descriptorBackoffBase = 10 * time.Second
+	descriptorBackoffMax  = time.Hour
+)
+
+// DescriptorSink is an optional interface of a Sink that creates metric descriptors.
+type DescriptorSink interface {
+	// CreateMetricDescriptor creates or updates the metric descriptor in the given project.
+	CreateMetricDescriptor(ctx context.Context, projectID string, descriptor *metric_pb.MetricDescriptor) error
+}
+
+func (s *gcmSink) CreateMetricDescriptor(ctx context.Context, projectID string, descriptor *metric_pb.MetricDescriptor) error {
+	_, err := s.client.CreateMetricDescriptor(ctx, &monitoring_pb.CreateMetricDescriptorRequest{
+		Name:             fmt.Sprintf("projects/%s", projectID),
+		MetricDescriptor: descriptor,
+	})
+	return err
+}
+
+type descriptorKey struct {
+	projectID, metricType string
+}
+
+// descriptorState tracks the creation of a single descriptor.
+type descriptorState struct {
+	// Whether the descriptor was created successfully.
+	created bool
+	// Whether the descriptor is queued for creation.
+	pending bool
+	// Number of failed attempts and the time before which no further attempt is made.
+	failures    int
+	nextAttempt time.Time
+	// Last time a series of the descriptor was observed.
+	lastObserved time.Time
+}
+
+type pendingDescriptor struct {
+	projectID  string
+	descriptor *metric_pb.MetricDescriptor
+}
+
+// descriptorManager asynchronously creates metric descriptors with the help text and
+// unit from the Prometheus metadata of the metrics.
+type descriptorManager struct {
+	logger log.Logger
+	sink   DescriptorSink
+	now    func() time.Time
+
+	mtx    sync.Mutex
+	states map[descriptorKey]*descriptorState
+	queue  chan pendingDescriptor
+}
+
+func newDescriptorManager(logger log.Logger, sink DescriptorSink) *descriptorManager {
+	return &descriptorManager{
+		logger: logger,
+		sink:   sink,
+		now:    time.Now,
+		states: map[descriptorKey]*descriptorState{},
+		queue:  make(chan pendingDescriptor, descriptorQueueSize),
+	}
+}
+
+// observe queues the creation of the descriptor for the series if it wasn't created yet.
+// Metrics without help text and unit are skipped as the descriptor created implicitly
+// on write is equivalent. It never blocks.
+func (m *descriptorManager) observe(series *monitoring_pb.TimeSeries, metadata MetricMetadata, suffix metricSuffix) {
+	if series == nil || (metadata.Help == "" && metadata.Unit == "") {
+		return
+	}
+	key := descriptorKey{
+		projectID:  series.Resource.Labels[KeyProjectID],
+		metricType: series.Metric.Type,
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	s, ok := m.states[key]
+	if !ok {
+		s = &descriptorState{}
+		m.states[key] = s
+	}
+	s.lastObserved = m.now()
+
+	if s.created || s.pending || m.now().Before(s.nextAttempt) {
+		return
+	}
+	select {
+	case m.queue <- pendingDescriptor{projectID: key.projectID, descriptor: buildDescriptor(series, metadata, suffix)}:
+		s.pending = true
+	default:
+	}
+}
+
+// garbageCollect removes the state of descriptors that were not observed since the given
+// time. Their series are no longer cached and are observed again when they reappear.
+func (m *descriptorManager) garbageCollect(before time.Time) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	for key, s := range m.states {
+		if !s.pending && s.lastObserved.Before(before) {
+			delete(m.states, key)
+		}
+	}
+}
+
+// run creates queued descriptors until the context is canceled.
+func (m *descriptorManager) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-m.queue:
+			m.create(ctx, p)
+		}
+	}
+}
+
+func (m *descriptorManager) create(ctx context.Context, p pendingDescriptor) {
+	ctx, cancel := context.WithTimeout(ctx, descriptorRequestTimeout)
+	defer cancel()
+
+	err := m.sink.CreateMetricDescriptor(ctx, p.projectID, p.descriptor)
+	if status.Code(err) == codes.AlreadyExists {
+		err = nil
+	}
+	key := descriptorKey{projectID: p.projectID, metricType: p.descriptor.Type}
+
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	s, ok := m.states[key]
+	if !ok {
+		return
+	}
+	s.pending = false
+
+	if err == nil {
+		metricDescriptorsCreated.Inc()
+		s.created = true
+		return
+	}
+	metricDescriptorFailures.Inc()
+	s.failures++
+
+	backoff := descriptorBackoffBase << (s.failures - 1)
+	if backoff > descriptorBackoffMax || backoff <= 0 {
+		backoff = descriptorBackoffMax
+	}
+	s.nextAttempt = m.now().Add(backoff)
+
+	level.Debug(m.logger).Log("msg", "creating metric descriptor failed", "project_id", p.projectID,
+		"metric_type", p.descriptor.Type, "err", err, "backoff", backoff)
+}
+
+// buildDescriptor returns the metric descriptor for the series, which has the given
+// metric name suffix.
+func buildDescriptor(series *monitoring_pb.TimeSeries, metadata MetricMetadata, suffix metricSuffix) *metric_pb.MetricDescriptor {
+	d := &metric_pb.MetricDescriptor{
+		Type:        series.Metric.Type,
+		MetricKind:  series.MetricKind,
+		ValueType:   series.ValueType,
+		Description: metadata.Help,
+		Unit:        descriptorUnit(series, metadata, suffix),
+	}
+	for name := range series.Metric.Labels {
+		d.Labels = append(d.Labels, &label_pb.LabelDescriptor{
+			Key:       name,
+			ValueType: label_pb.LabelDescriptor_STRING,
+		})
+	}
+	sort.Slice(d.Labels, func(i, j int) bool { return d.Labels[i].Key < d.Labels[j].Key })
+
+	return d
+}
+
+// descriptorUnit returns the unit of the descriptor for the series. The unit of a metric
+// applies to the observed values but not to the series counting the observations.
+func descriptorUnit(series *monitoring_pb.TimeSeries, metadata MetricMetadata, suffix metricSuffix) string {
+	switch {
+	case series.ValueType == metric_pb.MetricDescriptor_DISTRIBUTION:
+		// The unit applies to the bucket bounds of distributions.
+	case suffix == metricSuffixCount, suffix == metricSuffixGCount:
+		return "1"
+	case metadata.Type == textparse.MetricTypeUnknown && series.MetricKind == metric_pb.MetricDescriptor_CUMULATIVE:
+		// Untyped series are also written as counters, which may count anything.
+		return "1"
+	}
+	return prometheusUnitToUCUM(metadata.Unit)
+}
+
+// Prometheus base units and their UCUM equivalent as used by GCM.
+var ucumUnits = map[string]string{
+	"seconds":      "s",
+	"milliseconds": "ms",
+	"microseconds": "us",
+	"nanoseconds":  "ns",
+	"bytes":        "By",
+	"bits":         "bit",
+	"ratio":        "1",
+	"percent":      "%",
+	"meters":       "m",
+	"grams":        "g",
+	"celsius":      "Cel",
+	"volts":        "V",
+	"amperes":      "A",
+	"joules":       "J",
+	"hertz":        "Hz",
+}
+
+// prometheusUnitToUCUM converts a Prometheus unit to its UCUM equivalent. Units without
+// a known equivalent are set as annotations of a dimensionless unit.
+func prometheusUnitToUCUM(unit string) string {
+	if unit == "" {
+		return ""
+	}
+	if u, ok := ucumUnits[unit]; ok {
+		return u
+	}
+	return "{" + unit + "}"
+}
@@ -0,0 +1,203 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/prometheus/model/textparse"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	label_pb "google.golang.org/genproto/googleapis/api/label"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+type testDescriptorSink struct {
+	requests []string
+	err      error
+}
+
+func (s *testDescriptorSink) CreateMetricDescriptor(_ context.Context, projectID string, d *metric_pb.MetricDescriptor) error {
+	s.requests = append(s.requests, projectID+"/"+d.Type)
+	return s.err
+}
+
+func TestDescriptorManager(t *testing.T) {
+	sink := &testDescriptorSink{}
+	now := time.Unix(1000, 0)
+
+	m := newDescriptorManager(log.NewNopLogger(), sink)
+	m.now = func() time.Time { return now }
+
+	series := func(project, metricType string) *monitoring_pb.TimeSeries {
+		return &monitoring_pb.TimeSeries{
+			Resource: &monitoredres_pb.MonitoredResource{Labels: map[string]string{KeyProjectID: project}},
+			Metric:   &metric_pb.Metric{Type: metricType},
+		}
+	}
+	// Process all queued descriptors synchronously.
+	drain := func() {
+		for {
+			select {
+			case p := <-m.queue:
+				m.create(context.Background(), p)
+			default:
+				return
+			}
+		}
+	}
+	md := MetricMetadata{Help: "help"}
+
+	// Descriptors are created once per project and metric type.
+	m.observe(series("p1", "m1"), md, metricSuffixNone)
+	m.observe(series("p1", "m1"), md, metricSuffixNone)
+	m.observe(series("p2", "m1"), md, metricSuffixNone)
+	// Metrics without help text and unit are skipped.
+	m.observe(series("p1", "m3"), MetricMetadata{}, metricSuffixNone)
+	drain()
+	m.observe(series("p1", "m1"), md, metricSuffixNone)
+	drain()
+
+	if diff := cmp.Diff([]string{"p1/m1", "p2/m1"}, sink.requests); diff != "" {
+		t.Fatalf("unexpected requests (-want, +got): %s", diff)
+	}
+	// Failed descriptors are retried after a backoff.
+	sink.requests = nil
+	sink.err = errors.New("failure")
+
+	m.observe(series("p1", "m2"), md, metricSuffixNone)
+	drain()
+	m.observe(series("p1", "m2"), md, metricSuffixNone)
+	drain()
+
+	if len(sink.requests) != 1 {
+		t.Fatalf("expected 1 request during backoff, got %d", len(sink.requests))
+	}
+	sink.err = status.Error(codes.AlreadyExists, "exists")
+	now = now.Add(descriptorBackoffBase)
+
+	m.observe(series("p1", "m2"), md, metricSuffixNone)
+	drain()
+	m.observe(series("p1", "m2"), md, metricSuffixNone)
+	drain()
+
+	if len(sink.requests) != 2 {
+		t.Fatalf("expected 2 requests after backoff, got %d", len(sink.requests))
+	}
+	// States of descriptors that are no longer observed are removed.
+	now = now.Add(time.Hour)
+	m.observe(series("p1", "m1"), md, metricSuffixNone)
+	m.garbageCollect(now.Add(-time.Minute))
+
+	if len(m.states) != 1 {
+		t.Fatalf("expected 1 descriptor state after garbage collection, got %d", len(m.states))
+	}
+}
+
+func TestBuildDescriptor(t *testing.T) {
+	series := &monitoring_pb.TimeSeries{
+		Resource: &monitoredres_pb.MonitoredResource{Labels: map[string]string{KeyProjectID: "p1"}},
+		Metric: &metric_pb.Metric{
+			Type:   "prometheus.googleapis.com/http_request_duration_seconds/histogram",
+			Labels: map[string]string{"path": "/", "code": "200"},
+		},
+		MetricKind: metric_pb.MetricDescriptor_CUMULATIVE,
+		ValueType:  metric_pb.MetricDescriptor_DISTRIBUTION,
+	}
+	metadata := MetricMetadata{
+		Metric: "http_request_duration_seconds",
+		Type:   textparse.MetricTypeHistogram,
+		Help:   "Duration of HTTP requests.",
+		Unit:   "seconds",
+	}
+	want := &metric_pb.MetricDescriptor{
+		Type:        "prometheus.googleapis.com/http_request_duration_seconds/histogram",
+		MetricKind:  metric_pb.MetricDescriptor_CUMULATIVE,
+		ValueType:   metric_pb.MetricDescriptor_DISTRIBUTION,
+		Description: "Duration of HTTP requests.",
+		Unit:        "s",
+		Labels: []*label_pb.LabelDescriptor{
+			{Key: "code", ValueType: label_pb.LabelDescriptor_STRING},
+			{Key: "path", ValueType: label_pb.LabelDescriptor_STRING},
+		},
+	}
+	if diff := cmp.Diff(want, buildDescriptor(series, metadata, metricSuffixCount), protocmp.Transform()); diff != "" {
+		t.Fatalf("unexpected descriptor (-want, +got): %s", diff)
+	}
+	for unit, want := range map[string]string{"": "", "bytes": "By", "requests": "{requests}"} {
+		if got := prometheusUnitToUCUM(unit); got != want {
+			t.Errorf("unit %q: expected %q, got %q", unit, want, got)
+		}
+	}
+}
+
+func TestDescriptorUnit(t *testing.T) {
+	series := func(kind metric_pb.MetricDescriptor_MetricKind, vtype metric_pb.MetricDescriptor_ValueType) *monitoring_pb.TimeSeries {
+		return &monitoring_pb.TimeSeries{MetricKind: kind, ValueType: vtype}
+	}
+	cases := []struct {
+		doc      string
+		series   *monitoring_pb.TimeSeries
+		metadata MetricMetadata
+		suffix   metricSuffix
+		want     string
+	}{
+		{
+			doc:      "histogram",
+			series:   series(metric_pb.MetricDescriptor_CUMULATIVE, metric_pb.MetricDescriptor_DISTRIBUTION),
+			metadata: MetricMetadata{Type: textparse.MetricTypeHistogram, Unit: "seconds"},
+			suffix:   metricSuffixCount,
+			want:     "s",
+		}, {
+			doc:      "summary sum",
+			series:   series(metric_pb.MetricDescriptor_CUMULATIVE, metric_pb.MetricDescriptor_DOUBLE),
+			metadata: MetricMetadata{Type: textparse.MetricTypeSummary, Unit: "seconds"},
+			suffix:   metricSuffixSum,
+			want:     "s",
+		}, {
+			doc:      "summary count",
+			series:   series(metric_pb.MetricDescriptor_CUMULATIVE, metric_pb.MetricDescriptor_DOUBLE),
+			metadata: MetricMetadata{Type: textparse.MetricTypeSummary, Unit: "seconds"},
+			suffix:   metricSuffixCount,
+			want:     "1",
+		}, {
+			doc:      "unknown gauge",
+			series:   series(metric_pb.MetricDescriptor_GAUGE, metric_pb.MetricDescriptor_DOUBLE),
+			metadata: MetricMetadata{Type: textparse.MetricTypeUnknown, Unit: "bytes"},
+			want:     "By",
+		}, {
+			doc:      "unknown counter",
+			series:   series(metric_pb.MetricDescriptor_CUMULATIVE, metric_pb.MetricDescriptor_DOUBLE),
+			metadata: MetricMetadata{Type: textparse.MetricTypeUnknown, Unit: "bytes"},
+			want:     "1",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.doc, func(t *testing.T) {
+			if got := descriptorUnit(c.series, c.metadata, c.suffix); got != c.want {
+				t.Fatalf("expected unit %q, got %q", c.want, got)
+			}
+		})
+	}
+}
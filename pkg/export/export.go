@@ -23,6 +23,7 @@ import (
 	"math"
 	"os"
 	"os/exec"
+	"reflect"
 	"runtime/debug"
 	"strings"
 	"sync"
@@ -36,6 +37,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/prometheus/config"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/model/textparse"
 	"github.com/prometheus/prometheus/promql/parser"
 	"github.com/prometheus/prometheus/storage"
@@ -43,7 +45,9 @@ import (
 	"google.golang.org/api/option"
 	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/status"
 )
 
 var (
@@ -59,6 +63,10 @@ var (
 		Name: "gcm_export_samples_dropped_total",
 		Help: "Number of exported samples that were intentionally dropped.",
 	}, []string{"reason"})
+	samplesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_samples_skipped_total",
+		Help: "Number of points that were not exported as they were within the minimum export interval of their series.",
+	})
 	exemplarsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "gcm_export_exemplars_dropped_total",
 		Help: "Number of exported exemplars that were intentionally dropped.",
@@ -111,9 +119,23 @@ type Exporter struct {
 	logger log.Logger
 	opts   ExporterOpts
 
-	metricClient *monitoring.MetricClient
-	seriesCache  *seriesCache
-	shards       []*shard
+	sink        Sink
+	seriesCache *seriesCache
+	shards      []*shard
+	// Optional on-disk buffer between Export() and the shards.
+	wal *wal
+	// Decides which samples of failed requests are retried. Nil if retries are disabled.
+	retrier *retrier
+	// Adaptively limits concurrent requests. Nil if limiting is disabled.
+	limiter *concurrencyLimiter
+	// Limits the write rate per project. Nil if no limits are configured.
+	projectLimiter *projectLimiter
+	// Most recent send errors for debugging.
+	sendErrors *sendErrorLog
+	// Optional secondary destination for samples. Nil if remote write is disabled.
+	remoteWriter *remoteWriter
+	// Creates metric descriptors from metadata. Nil if disabled.
+	descriptors *descriptorManager
 
 	// Channel for signaling that there may be more work items to
 	// be processed.
@@ -123,9 +145,20 @@ type Exporter struct {
 	// and must be locked with mtx.
 	mtx            sync.Mutex
 	externalLabels labels.Labels
+	// Set once the exporter is shutting down and no longer accepts new samples.
+	draining bool
 	// A set of metrics for which we defaulted the metadata to untyped and have
 	// issued a warning about that.
 	warnedUntypedMetrics map[string]struct{}
+
+	// The most recently applied configuration from the config file.
+	config *Config
+	// The compiled metadata overrides of the config file.
+	metadataOverrides []*metadataOverride
+	// Start of the lease range last passed to the series cache.
+	leaseStart time.Time
+	// Serializes writes of the counter reset state checkpoint.
+	resetStateMtx sync.Mutex
 }
 
 const (
@@ -140,6 +173,9 @@ const (
 	// Time after an accumulating batch is flushed to GCM. This avoids data being
 	// held indefinititely if not enough new data flows in to fill up the batch.
 	batchDelayMax = 50 * time.Millisecond
+	// Duration after which series that stopped receiving points are removed from the
+	// out-of-order guard of the shards. It matches the garbage collection of the series cache.
+	orderGuardStaleness = 10 * time.Minute
 
 	// Prefix for GCM metric.
 	MetricTypePrefix = "prometheus.googleapis.com"
@@ -182,6 +218,18 @@ type ExporterOpts struct {
 	// parameter.
 	Matchers Matchers
 
+	// Relabeling rules applied to series before they are exported. They are applied
+	// to the series labels without external labels. Series dropped by the rules are
+	// not exported.
+	RelabelConfigs []*relabel.Config
+
+	// CardinalityLimit configures a limit on the number of series exported per metric.
+	CardinalityLimit CardinalityLimitOpts
+
+	// File with the exporter configuration that can be changed at runtime. It is
+	// loaded on every call to ApplyConfig. Optional.
+	ConfigFile string
+
 	// Prefix under which metrics are written to GCM.
 	MetricTypePrefix string
 
@@ -198,6 +246,53 @@ type ExporterOpts struct {
 	// The project ID of an alternative project for quota attribution.
 	QuotaProject string
 
+	// Directory of an optional on-disk write-ahead buffer for samples that were
+	// not sent yet. If unset, samples are only buffered in memory.
+	WALDir string
+	// Maximum size of the write-ahead buffer in bytes. Defaults to DefaultWALMaxSize
+	// when 0.
+	WALMaxSize int64
+
+	// Whether to create metric descriptors with the help text and unit from the Prometheus
+	// metadata of exported metrics. Descriptors are created asynchronously once per metric
+	// type and project. Requires a sink that implements DescriptorSink.
+	CreateMetricDescriptors bool
+
+	// File to which the counter reset state of series is periodically checkpointed.
+	// After a restart, counters continue from the checkpointed state rather than
+	// dropping their first sample and starting a new cumulative range. Optional.
+	ResetStateFile string
+
+	// Retry configures retries of samples for which sending failed.
+	Retry RetryOpts
+
+	// Concurrency configures the adaptive limit of concurrent requests.
+	Concurrency ConcurrencyOpts
+
+	// ProjectRateLimits configures limits on the rate of samples written to each project.
+	ProjectRateLimits ProjectRateLimitOpts
+
+	// Destination of exported samples. If unset, samples are written to the GCM API
+	// configured through the above options.
+	Sink Sink
+
+	// Maximum duration for which buffered samples are still sent after Run's context
+	// was cancelled. If 0, buffered samples and in-flight requests are discarded immediately.
+	DrainTimeout time.Duration
+
+	// RemoteWrite configures an optional Prometheus remote write endpoint to which
+	// samples are written in addition to the primary destination.
+	RemoteWrite RemoteWriteOpts
+
+	// File to which all outgoing requests are recorded in RecordFormat. The recorded
+	// requests can be replayed with the tool in pkg/export/bench/replay. Disabled if empty.
+	RecordFile string
+	// Format of recorded requests. Defaults to RecordFormatJSON if empty.
+	RecordFormat string
+
+	// Whether the handler returned by DebugHandler serves the exporter state.
+	EnableDebugHandler bool
+
 	// Efficiency represents exporter options that allows fine-tuning of
 	// internal data structure sizes. Only for advance users. No compatibility
 	// guarantee (might change in future).
@@ -316,6 +411,9 @@ func New(logger log.Logger, reg prometheus.Registerer, opts ExporterOpts) (*Expo
 			prometheusSamplesDiscarded,
 			samplesExported,
 			samplesDropped,
+			samplesDroppedByPriority,
+			gcmLimitViolations,
+			samplesSkipped,
 			samplesSent,
 			sendIterations,
 			shardProcess,
@@ -324,6 +422,29 @@ func New(logger log.Logger, reg prometheus.Registerer, opts ExporterOpts) (*Expo
 			pendingRequests,
 			projectsPerBatch,
 			samplesPerRPCBatch,
+			walSize,
+			walSamplesWritten,
+			walSamplesRead,
+			walCorruptions,
+			samplesRetried,
+			retryBudgetTokens,
+			concurrencyLimit,
+			recordFailures,
+			projectSamplesThrottled,
+			projectSamplesDropped,
+			remoteWriteSamplesSent,
+			remoteWriteSamplesDropped,
+			remoteWriteRetries,
+			remoteWriteQueueLength,
+			remoteWriteRequestDuration,
+			cardinalityLimitedSeries,
+			cardinalityLimitedMetrics,
+			resetStateRestored,
+			resetStateDiscarded,
+			metricDescriptorsCreated,
+			metricDescriptorFailures,
+			samplesAggregated,
+			aggregatedSeries,
 		)
 	}
 
@@ -340,6 +461,33 @@ func New(logger log.Logger, reg prometheus.Registerer, opts ExporterOpts) (*Expo
 		opts.Efficiency.ShardBufferSize = DefaultShardBufferSize
 	}
 
+	if opts.Retry.MaxAttempts == 0 {
+		opts.Retry.MaxAttempts = DefaultRetryMaxAttempts
+	}
+	if opts.Retry.BudgetRatio == 0 {
+		opts.Retry.BudgetRatio = DefaultRetryBudgetRatio
+	}
+
+	if opts.Concurrency.Min == 0 {
+		opts.Concurrency.Min = 1
+	}
+	if opts.Concurrency.Max == 0 {
+		opts.Concurrency.Max = DefaultConcurrencyMax
+	}
+	if opts.Concurrency.Min > opts.Concurrency.Max {
+		return nil, fmt.Errorf("minimum concurrency %d exceeds maximum %d", opts.Concurrency.Min, opts.Concurrency.Max)
+	}
+	if opts.Concurrency.LatencyTarget == 0 {
+		opts.Concurrency.LatencyTarget = DefaultConcurrencyLatencyTarget
+	}
+
+	if opts.ProjectRateLimits.Policy == "" {
+		opts.ProjectRateLimits.Policy = RateLimitPolicyDelay
+	}
+	if err := opts.ProjectRateLimits.validate(); err != nil {
+		return nil, fmt.Errorf("invalid project rate limits: %w", err)
+	}
+
 	if opts.MetricTypePrefix == "" {
 		opts.MetricTypePrefix = MetricTypePrefix
 	}
@@ -347,19 +495,48 @@ func New(logger log.Logger, reg prometheus.Registerer, opts ExporterOpts) (*Expo
 		opts.Lease = alwaysLease{}
 	}
 
-	metricClient, err := newMetricClient(context.Background(), opts)
-	if err != nil {
-		return nil, fmt.Errorf("create metric client: %w", err)
+	sink := opts.Sink
+	if sink == nil {
+		metricClient, err := newMetricClient(context.Background(), opts)
+		if err != nil {
+			return nil, fmt.Errorf("create metric client: %w", err)
+		}
+		sink = NewGCMSink(metricClient)
+	}
+	var descriptors *descriptorManager
+	if opts.CreateMetricDescriptors {
+		ds, ok := sink.(DescriptorSink)
+		if !ok {
+			return nil, errors.New("sink does not support creating metric descriptors")
+		}
+		descriptors = newDescriptorManager(logger, ds)
+	}
+	if opts.RecordFile != "" {
+		if opts.RecordFormat == "" {
+			opts.RecordFormat = RecordFormatJSON
+		}
+		w, err := NewRequestWriter(opts.RecordFile, opts.RecordFormat)
+		if err != nil {
+			return nil, fmt.Errorf("open record file: %w", err)
+		}
+		sink = &recordingSink{Sink: sink, w: w}
 	}
 	e := &Exporter{
 		logger:               logger,
 		opts:                 opts,
-		metricClient:         metricClient,
+		sink:                 sink,
 		nextc:                make(chan struct{}, 1),
 		shards:               make([]*shard, opts.Efficiency.ShardCount),
+		sendErrors:           newSendErrorLog(sendErrorLogSize),
+		descriptors:          descriptors,
 		warnedUntypedMetrics: map[string]struct{}{},
 	}
 	e.seriesCache = newSeriesCache(logger, reg, opts.MetricTypePrefix, opts.Matchers)
+	e.seriesCache.relabelConfigs = opts.RelabelConfigs
+	e.seriesCache.descriptors = descriptors
+	if opts.CardinalityLimit.enabled() {
+		e.seriesCache.budget = newCardinalityBudget(opts.CardinalityLimit)
+	}
 
 	// Whenever the lease is lost, clear the series cache so we don't start off of out-of-range
 	// reset timestamps when we gain the lease again.
@@ -368,6 +545,32 @@ func New(logger log.Logger, reg prometheus.Registerer, opts ExporterOpts) (*Expo
 	for i := range e.shards {
 		e.shards[i] = newShard(opts.Efficiency.ShardBufferSize)
 	}
+	if !opts.Retry.Disable {
+		e.retrier = newRetrier(opts.Retry)
+	}
+	if opts.Concurrency.Enable {
+		e.limiter = newConcurrencyLimiter(opts.Concurrency)
+	}
+	if opts.ProjectRateLimits.enabled() {
+		e.projectLimiter = newProjectLimiter(opts.ProjectRateLimits)
+	}
+	if opts.WALDir != "" {
+		var err error
+		if e.wal, err = openWAL(logger, opts.WALDir, opts.WALMaxSize); err != nil {
+			return nil, fmt.Errorf("open write-ahead buffer: %w", err)
+		}
+	}
+	if opts.ResetStateFile != "" {
+		states, err := readResetStateFile(opts.ResetStateFile)
+		if err != nil {
+			level.Warn(logger).Log("msg", "ignoring invalid counter reset state checkpoint", "err", err)
+		}
+		e.seriesCache.restoreResetStates(states)
+	}
+	if opts.RemoteWrite.URL != "" {
+		userAgent := fmt.Sprintf("%s/%s", ClientName, mainModuleVersion)
+		e.remoteWriter = newRemoteWriter(logger, opts.RemoteWrite, userAgent)
+	}
 
 	return e, nil
 }
@@ -413,15 +616,88 @@ func (e *Exporter) ApplyConfig(cfg *config.Config) (err error) {
 	} else if loc == "global" {
 		return ErrLocationGlobal
 	}
+	if err := e.applyConfigFile(); err != nil {
+		return err
+	}
 	if labels.Equal(e.externalLabels, lset) {
 		return nil
 	}
 	// New external labels possibly invalidate the cached series conversions.
 	e.mtx.Lock()
 	e.externalLabels = lset
+	e.mtx.Unlock()
+
 	e.seriesCache.forceRefresh()
+
+	return nil
+}
+
+// applyConfigFile loads the configuration file if one is set and applies the parts
+// that changed.
+func (e *Exporter) applyConfigFile() error {
+	if e.opts.ConfigFile == "" {
+		return nil
+	}
+	cfg, err := LoadConfigFile(e.opts.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("loading exporter config failed: %w", err)
+	}
+	// The series cache is updated without holding mtx. Populating series acquires it
+	// through the metadata function while holding a stripe lock, which the setters of the
+	// series cache acquire as well.
+	e.mtx.Lock()
+	var prev Config
+	if e.config != nil {
+		prev = *e.config
+	}
+	e.config = cfg
+
+	refreshMetadata := !reflect.DeepEqual(prev.MetadataOverrides, cfg.MetadataOverrides)
+	if refreshMetadata {
+		// The overrides were already validated when loading the file.
+		e.metadataOverrides, _ = cfg.metadataOverrides()
+	}
 	e.mtx.Unlock()
 
+	if !reflect.DeepEqual(prev.Match, cfg.Match) {
+		// The matchers were already validated when loading the file.
+		ms, _ := cfg.matchers()
+		e.seriesCache.setMatchers(append(ms, e.opts.Matchers...))
+	}
+	if !reflect.DeepEqual(prev.RelabelConfigs, cfg.RelabelConfigs) {
+		rcs := make([]*relabel.Config, 0, len(e.opts.RelabelConfigs)+len(cfg.RelabelConfigs))
+		rcs = append(rcs, e.opts.RelabelConfigs...)
+		e.seriesCache.setRelabelConfigs(append(rcs, cfg.RelabelConfigs...))
+	}
+	if !reflect.DeepEqual(prev.ResourceMappings, cfg.ResourceMappings) {
+		// The mappings were already validated when loading the file.
+		mappings, _ := cfg.resourceMappings()
+		e.seriesCache.setResourceMappings(mappings)
+	}
+	if refreshMetadata {
+		// Cached series must be converted again with the new metadata.
+		e.seriesCache.forceRefresh()
+	}
+	if !reflect.DeepEqual(prev.ExportIntervals, cfg.ExportIntervals) {
+		// The intervals were already validated when loading the file.
+		intervals, _ := cfg.exportIntervals()
+		e.seriesCache.setExportIntervals(intervals)
+	}
+	if !reflect.DeepEqual(prev.AggregationRules, cfg.AggregationRules) {
+		// The rules were already validated when loading the file.
+		rules, _ := cfg.aggregationRules()
+		e.seriesCache.setAggregationRules(rules)
+	}
+	if !reflect.DeepEqual(prev.PriorityClasses, cfg.PriorityClasses) {
+		// The classes were already validated when loading the file.
+		classes, _ := cfg.priorityClasses()
+		e.seriesCache.setPriorityClasses(classes)
+	}
+	if !reflect.DeepEqual(prev.Limits, cfg.Limits) {
+		// The limits were already validated when loading the file.
+		limits, _ := cfg.limits()
+		e.seriesCache.setLimits(limits)
+	}
 	return nil
 }
 
@@ -454,9 +730,19 @@ func (e *Exporter) Export(metadata MetadataFunc, batch []record.RefSample, exemp
 
 	e.mtx.Lock()
 	externalLabels := e.externalLabels
+	draining := e.draining
 	start, end, ok := e.opts.Lease.Range()
+	if ok && !start.Equal(e.leaseStart) {
+		e.seriesCache.setLeaseStart(start)
+		e.leaseStart = start
+	}
 	e.mtx.Unlock()
 
+	if draining {
+		exemplarsDropped.WithLabelValues("shutdown").Add(float64(len(exemplarMap)))
+		samplesDropped.WithLabelValues("shutdown").Add(float64(batchSize))
+		return
+	}
 	if !ok {
 		exemplarsDropped.WithLabelValues("no-ha-range").Add(float64(len(exemplarMap)))
 		samplesDropped.WithLabelValues("no-ha-range").Add(float64(batchSize))
@@ -466,6 +752,16 @@ func (e *Exporter) Export(metadata MetadataFunc, batch []record.RefSample, exemp
 	defer builder.close()
 	exemplarsExported.Add(float64(len(exemplarMap)))
 
+	// Building samples populates the series cache, from which the remote writer
+	// resolves labels afterwards.
+	if e.remoteWriter != nil {
+		defer e.remoteWrite(batch, externalLabels, start, end)
+	}
+
+	var built []hashedSeries
+
+	builder.observeCreated(metadata, externalLabels, batch)
+
 	for len(batch) > 0 {
 		var (
 			samples []hashedSeries
@@ -476,24 +772,112 @@ func (e *Exporter) Export(metadata MetadataFunc, batch []record.RefSample, exemp
 			level.Debug(e.logger).Log("msg", "building sample failed", "err", err)
 			continue
 		}
-		for _, s := range samples {
-			// Only enqueue samples for within our HA range.
-			if sampleInRange(s.proto, start, end) {
-				e.enqueue(s.hash, s.proto)
-			} else {
-				// Hashed series protos should only ever have one point. If this is
-				// a distribution increase exemplarsDropped if there are exemplars.
-				if dist := s.proto.Points[0].Value.GetDistributionValue(); dist != nil {
-					exemplarsDropped.WithLabelValues("not-in-ha-range").Add(float64(len(dist.GetExemplars())))
-				}
-				samplesDropped.WithLabelValues("not-in-ha-range").Inc()
+		built = append(built, samples...)
+	}
+	e.enqueueBuilt(built, start, end)
+}
+
+// ExportHistograms exports a batch of native histogram samples. Each sample is converted
+// into a distribution with exponential buckets.
+func (e *Exporter) ExportHistograms(metadata MetadataFunc, batch []record.RefHistogramSample) {
+	samplesExported.Add(float64(len(batch)))
+
+	if e.opts.Disable {
+		return
+	}
+
+	metadata = e.wrapMetadata(metadata)
+
+	e.mtx.Lock()
+	externalLabels := e.externalLabels
+	draining := e.draining
+	start, end, ok := e.opts.Lease.Range()
+	if ok && !start.Equal(e.leaseStart) {
+		e.seriesCache.setLeaseStart(start)
+		e.leaseStart = start
+	}
+	e.mtx.Unlock()
+
+	if draining {
+		samplesDropped.WithLabelValues("shutdown").Add(float64(len(batch)))
+		return
+	}
+	if !ok {
+		samplesDropped.WithLabelValues("no-ha-range").Add(float64(len(batch)))
+		return
+	}
+	builder := newSampleBuilder(e.seriesCache)
+	defer builder.close()
+
+	var built []hashedSeries
+	for _, s := range batch {
+		built = append(built, builder.nextHistogram(metadata, externalLabels, s)...)
+	}
+	e.enqueueBuilt(built, start, end)
+}
+
+// enqueueBuilt enqueues built samples within the HA range, either through the
+// write-ahead buffer or directly into the shards.
+func (e *Exporter) enqueueBuilt(samples []hashedSeries, start, end time.Time) {
+	// Samples to write to the write-ahead buffer if it is enabled.
+	var buffered []hashedSeries
+
+	for _, s := range samples {
+		// Only enqueue samples for within our HA range.
+		if !sampleInRange(s.proto, start, end) {
+			// Hashed series protos should only ever have one point. If this is
+			// a distribution increase exemplarsDropped if there are exemplars.
+			if dist := s.proto.Points[0].Value.GetDistributionValue(); dist != nil {
+				exemplarsDropped.WithLabelValues("not-in-ha-range").Add(float64(len(dist.GetExemplars())))
 			}
+			samplesDropped.WithLabelValues("not-in-ha-range").Inc()
+		} else if !e.shard(s.hash).advance(s.hash, s.proto.Points[0].Interval.EndTime.AsTime().UnixMilli()) {
+			// The series already has a point at or after this one on its way to GCM.
+			if dist := s.proto.Points[0].Value.GetDistributionValue(); dist != nil {
+				exemplarsDropped.WithLabelValues("out-of-order").Add(float64(len(dist.GetExemplars())))
+			}
+			prometheusSamplesDiscarded.WithLabelValues("out-of-order").Inc()
+		} else if e.wal != nil {
+			buffered = append(buffered, s)
+		} else {
+			e.enqueue(s)
 		}
 	}
+	if e.wal != nil {
+		dropped, err := e.wal.write(buffered)
+		if err != nil {
+			level.Error(e.logger).Log("msg", "writing to write-ahead buffer failed", "err", err)
+			samplesDropped.WithLabelValues("wal-write-failed").Add(float64(len(buffered)))
+		}
+		samplesDropped.WithLabelValues("wal-full").Add(float64(dropped))
+		// The buffer reader signals new data once it was handed to the shards.
+		return
+	}
 	// Signal that new data is available.
 	e.triggerNext()
 }
 
+// remoteWrite enqueues the samples of cached series within the time range for the remote
+// write endpoint.
+func (e *Exporter) remoteWrite(batch []record.RefSample, externalLabels labels.Labels, start, end time.Time) {
+	var (
+		startMs = start.UnixMilli()
+		endMs   = end.UnixMilli()
+	)
+	for _, s := range batch {
+		if s.T < startMs || s.T > endMs {
+			remoteWriteSamplesDropped.WithLabelValues("not-in-ha-range").Inc()
+			continue
+		}
+		lset, ok := e.seriesCache.getLabels(storage.SeriesRef(s.Ref), externalLabels)
+		if !ok {
+			remoteWriteSamplesDropped.WithLabelValues("series-not-exported").Inc()
+			continue
+		}
+		e.remoteWriter.enqueue(lset, s.T, s.V)
+	}
+}
+
 func sampleInRange(sample *monitoring_pb.TimeSeries, start, end time.Time) bool {
 	// A sample has exactly one point in the time series. The start timestamp may be unset for gauges.
 	if s := sample.Points[0].Interval.StartTime; s != nil && s.AsTime().Before(start) {
@@ -505,9 +889,58 @@ func sampleInRange(sample *monitoring_pb.TimeSeries, start, end time.Time) bool
 	return true
 }
 
-func (e *Exporter) enqueue(hash uint64, sample *monitoring_pb.TimeSeries) {
-	idx := hash % uint64(len(e.shards))
-	e.shards[idx].enqueue(hash, sample)
+// shard returns the shard holding the series with the given hash.
+func (e *Exporter) shard(hash uint64) *shard {
+	return e.shards[hash%uint64(len(e.shards))]
+}
+
+func (e *Exporter) enqueue(s hashedSeries) {
+	e.shard(s.hash).enqueue(s.hash, s.proto, s.priority)
+}
+
+// runOrderGuardGC periodically removes series that stopped receiving points from the
+// out-of-order guard of the shards until the context is canceled.
+func (e *Exporter) runOrderGuardGC(ctx context.Context) {
+	tick := time.NewTicker(orderGuardStaleness)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-tick.C:
+			for _, s := range e.shards {
+				s.pruneLastEnqueued(now.Add(-orderGuardStaleness).UnixMilli())
+			}
+		}
+	}
+}
+
+// readWAL hands records from the write-ahead buffer to the shards until the context is canceled.
+// Unlike samples enqueued directly from Export(), records are not dropped if a shard's queue is
+// full. Instead we wait until the shard was processed, which leaves the backlog on disk.
+func (e *Exporter) readWAL(ctx context.Context) {
+	for {
+		records, err := e.wal.read(ctx)
+		if err != nil {
+			return
+		}
+		for _, r := range records {
+			shard := e.shard(r.hash)
+			entry := queueEntry{hash: r.hash, sample: r.sample, walRef: r.ref, priority: r.priority}
+
+			for !shard.tryEnqueue(entry) {
+				e.triggerNext()
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(batchDelayMax):
+				}
+			}
+		}
+		e.triggerNext()
+	}
 }
 
 func (e *Exporter) triggerNext() {
@@ -620,10 +1053,41 @@ func Version() (string, error) {
 // to cover a large range of potential throughput and latency combinations without requiring
 // user configuration or, even worse, runtime changes to the shard number.
 func (e *Exporter) Run(ctx context.Context) error {
-	defer e.metricClient.Close()
+	defer e.sink.Close()
 	go e.seriesCache.run(ctx)
 	go e.opts.Lease.Run(ctx)
 
+	if e.wal != nil {
+		defer func() {
+			if err := e.wal.close(); err != nil {
+				level.Error(e.logger).Log("msg", "closing write-ahead buffer failed", "err", err)
+			}
+		}()
+		go e.wal.run(ctx)
+		go e.readWAL(ctx)
+	}
+	if e.opts.ResetStateFile != "" {
+		// Checkpoint once more on shutdown so that a restart continues from the most
+		// recent state.
+		defer e.checkpointResetState()
+		go e.runResetStateCheckpoint(ctx)
+	}
+	if e.remoteWriter != nil {
+		go e.remoteWriter.run(ctx)
+	}
+	if e.descriptors != nil {
+		go e.descriptors.run(ctx)
+	}
+	go e.runAggregation(ctx)
+	go e.runOrderGuardGC(ctx)
+	// Requests are sent with a separate context so that they can complete while
+	// draining on shutdown.
+	sendCtx, cancelSend := context.WithCancel(context.Background())
+	defer cancelSend()
+
+	// Tracks batches that are currently being sent.
+	var pending sync.WaitGroup
+
 	timer := time.NewTimer(batchDelayMax)
 	stopTimer := func() {
 		if !timer.Stop() {
@@ -635,7 +1099,7 @@ func (e *Exporter) Run(ctx context.Context) error {
 	}
 	defer stopTimer()
 
-	curBatch := newBatch(e.logger, e.opts.Efficiency.ShardCount, e.opts.Efficiency.BatchSize)
+	curBatch := e.newBatch()
 
 	// Send the currently accumulated batch to GCM asynchronously.
 	send := func() {
@@ -643,50 +1107,74 @@ func (e *Exporter) Run(ctx context.Context) error {
 		// shards that were part of the batch. This ensures that if we didn't take all samples
 		// from a shard when filling the batch, we'll come back for them and any queue built-up
 		// gets sent eventually.
+		pending.Add(1)
+
 		go func(ctx context.Context, b *batch) {
-			b.send(ctx, e.metricClient.CreateTimeSeries)
+			defer pending.Done()
+
+			b.send(ctx, e.sink)
 			// We could only trigger if we didn't fully empty shards in this batch.
 			// Benchmarking showed no beneficial impact of this optimization.
 			e.triggerNext()
-		}(ctx, curBatch)
+		}(sendCtx, curBatch)
 
 		// Reset state for new batch.
 		stopTimer()
 		timer.Reset(batchDelayMax)
 
-		curBatch = newBatch(e.logger, e.opts.Efficiency.ShardCount, e.opts.Efficiency.BatchSize)
+		curBatch = e.newBatch()
+	}
+
+	// Drain shards to fill up the batch.
+	//
+	// If the shard count is high given the overall throughput, a lot of shards may
+	// be packed into the same batch. A slow request will then block all those shards
+	// from further parallel sends.
+	// If this becomes a problem (especially when we grow maximum batch size), consider
+	// adding a heuristic to send partial batches in favor of limiting the number of
+	// shards they span.
+	fill := func() {
+		for _, shard := range e.shards {
+			shard.fill(curBatch)
+			if curBatch.full() {
+				send()
+			}
+		}
 	}
 
 	for {
 		select {
-		// NOTE(freinartz): we will terminate once context is cancelled and not flush remaining
-		// buffered data. In-flight requests will be aborted as well.
-		// This is fine once we persist data submitted via Export() but for now there may be some
-		// data loss on shutdown.
+		// Once the context is cancelled, we keep sending buffered data until the drain timeout.
+		// After that, remaining data is discarded and in-flight requests are aborted.
+		// If the write-ahead buffer is enabled, all unacknowledged data is sent again after
+		// a restart. Otherwise there may be some data loss on shutdown.
 		case <-ctx.Done():
+			if e.opts.DrainTimeout > 0 {
+				e.drain(fill, func() {
+					if !curBatch.empty() {
+						send()
+					}
+				}, &pending)
+			}
 			return nil
 		// This is activated for each new sample that arrives
 		case <-e.nextc:
-			sendIterations.Inc()
-
-			// Drain shards to fill up the batch.
-			//
-			// If the shard count is high given the overall throughput, a lot of shards may
-			// be packed into the same batch. A slow request will then block all those shards
-			// from further parallel sends.
-			// If this becomes a problem (especially when we grow maximum batch size), consider
-			// adding a heuristic to send partial batches in favor of limiting the number of
-			// shards they span.
-			for _, shard := range e.shards {
-				shard.fill(curBatch)
-				if curBatch.full() {
-					send()
-				}
+			// If the concurrency limit is reached, leave samples in the shards until
+			// a request completes rather than accumulating further requests.
+			if !e.sendAvailable() {
+				continue
 			}
+			sendIterations.Inc()
+			fill()
 
 		case <-timer.C:
+			// Samples delayed by project rate limits must be picked up again even
+			// if no new samples arrive.
+			if e.projectLimiter != nil && e.projectLimiter.hasDelayed() && e.sendAvailable() {
+				fill()
+			}
 			// Flush batch that has been pending for too long.
-			if !curBatch.empty() {
+			if !curBatch.empty() && e.sendAvailable() {
 				send()
 			} else {
 				timer.Reset(batchDelayMax)
@@ -695,6 +1183,76 @@ func (e *Exporter) Run(ctx context.Context) error {
 	}
 }
 
+// sendAvailable returns true if the concurrency limit permits sending another request.
+func (e *Exporter) sendAvailable() bool {
+	return e.limiter == nil || e.limiter.available()
+}
+
+// drain stops accepting new samples and sends all buffered samples until the shards are empty
+// and no requests are pending, or the drain timeout is reached. The fill function fills and sends
+// batches from the shards and flush sends the current batch even if it is not full.
+func (e *Exporter) drain(fill, flush func(), pending *sync.WaitGroup) {
+	e.mtx.Lock()
+	e.draining = true
+	e.mtx.Unlock()
+
+	start := time.Now()
+	level.Info(e.logger).Log("msg", "draining buffered samples", "samples", e.queuedSamples(), "timeout", e.opts.DrainTimeout)
+
+	deadline := time.NewTimer(e.opts.DrainTimeout)
+	defer deadline.Stop()
+
+	for {
+		fill()
+		flush()
+
+		if e.queuedSamples() == 0 {
+			// Pending requests may put failed samples back into the shards for retry. Thus we
+			// only conclude once no samples are left after all of them completed.
+			done := make(chan struct{})
+			go func() {
+				pending.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-deadline.C:
+				level.Warn(e.logger).Log("msg", "drain timeout reached, aborting pending requests", "timeout", e.opts.DrainTimeout)
+				return
+			}
+			if e.queuedSamples() == 0 {
+				level.Info(e.logger).Log("msg", "draining buffered samples completed", "took", time.Since(start))
+				return
+			}
+			continue
+		}
+		select {
+		case <-e.nextc:
+		case <-deadline.C:
+			remaining := 0
+			for _, s := range e.shards {
+				dropped := s.dropAll()
+				remaining += len(dropped)
+
+				if e.wal != nil {
+					e.wal.ackEntries(dropped)
+				}
+			}
+			samplesDropped.WithLabelValues("drain-timeout").Add(float64(remaining))
+			level.Warn(e.logger).Log("msg", "drain timeout reached, discarding remaining samples", "timeout", e.opts.DrainTimeout, "samples", remaining)
+			return
+		}
+	}
+}
+
+// queuedSamples returns the number of samples queued across all shards.
+func (e *Exporter) queuedSamples() (n int) {
+	for _, s := range e.shards {
+		n += s.length()
+	}
+	return n
+}
+
 // CtxKey is a dedicated type for keys of context-embedded values propagated
 // with the scrape context.
 type ctxKey int
@@ -741,6 +1299,14 @@ func (e *Exporter) wrapMetadata(f MetadataFunc) MetadataFunc {
 	// Ensure that we always cover synthetic scrape metrics and in doubt fallback
 	// to untyped metrics. The wrapping order is important!
 	f = withScrapeMetricMetadata(f)
+
+	e.mtx.Lock()
+	overrides := e.metadataOverrides
+	e.mtx.Unlock()
+
+	if len(overrides) > 0 {
+		f = withMetadataOverrides(f, overrides)
+	}
 	f = e.withUntypedDefaultMetadata(f)
 
 	return f
@@ -805,6 +1371,42 @@ func withScrapeMetricMetadata(f MetadataFunc) MetadataFunc {
 	}
 }
 
+// withMetadataOverrides wraps a MetadataFunc and returns the metadata of the first
+// override matching a metric name instead of the one found through f.
+func withMetadataOverrides(f MetadataFunc, overrides []*metadataOverride) MetadataFunc {
+	match := func(metric string) *metadataOverride {
+		for _, o := range overrides {
+			if o.regexp.MatchString(metric) {
+				return o
+			}
+		}
+		return nil
+	}
+	return func(metric string) (MetricMetadata, bool) {
+		// Overrides for the base name of a suffixed series must be resolved by the
+		// conversion logic through the base name, just like regular metadata.
+		if baseName, suffix, ok := splitMetricSuffix(metric); ok {
+			if o := match(baseName); o != nil && (suffix != metricSuffixInfo || o.typ == textparse.MetricTypeInfo) {
+				return MetricMetadata{}, false
+			}
+		}
+		o := match(metric)
+		if o == nil {
+			return f(metric)
+		}
+		md, _ := f(metric)
+		md.Metric = metric
+		md.Type = o.typ
+		if o.unit != "" {
+			md.Unit = o.unit
+		}
+		if o.help != "" {
+			md.Help = o.help
+		}
+		return md, true
+	}
+}
+
 // withUntypedDefaultMetadata returns a MetadataFunc that returns the untyped
 // type, if no metadata is found through f.
 // It logs a warning once per metric name where a default to untyped happened
@@ -824,12 +1426,10 @@ func (e *Exporter) withUntypedDefaultMetadata(f MetadataFunc) MetadataFunc {
 		// to verify that the base name is not found either.
 		// Our transformation logic applies the same lookup sequence. Without this step
 		// we'd incorrectly return the untyped metadata for all those sub-series.
-		if baseName, _, ok := splitMetricSuffix(metric); ok {
-			if _, ok := f(baseName); ok {
-				// There is metadata for the underlying metric, return false and let the
-				// conversion logic do its thing.
-				return MetricMetadata{}, false
-			}
+		if _, _, _, ok := getSuffixedMetadata(f, metric); ok {
+			// There is metadata for the underlying metric, return false and let the
+			// conversion logic do its thing.
+			return MetricMetadata{}, false
 		}
 		// We only log a message the first time for each metric. We check this against a global cache
 		// as the total number of unique observed names is generally negligible.
@@ -854,6 +1454,31 @@ type batch struct {
 	shards  []*shard
 	oneFull bool
 	total   int
+
+	// The queue entries of the samples per project along with the shard they were taken
+	// from. They are used to acknowledge or retry samples after sending.
+	entries map[string][]batchEntry
+	wal     *wal
+	retrier *retrier
+	limiter *concurrencyLimiter
+
+	projectLimiter *projectLimiter
+	sendErrors     *sendErrorLog
+}
+
+type batchEntry struct {
+	queueEntry
+	shard *shard
+}
+
+func (e *Exporter) newBatch() *batch {
+	b := newBatch(e.logger, e.opts.Efficiency.ShardCount, e.opts.Efficiency.BatchSize)
+	b.wal = e.wal
+	b.retrier = e.retrier
+	b.limiter = e.limiter
+	b.projectLimiter = e.projectLimiter
+	b.sendErrors = e.sendErrors
+	return b
 }
 
 func newBatch(logger log.Logger, shardsCount uint, maxSize uint) *batch {
@@ -889,6 +1514,33 @@ func (b *batch) add(s *monitoring_pb.TimeSeries) {
 	b.total++
 }
 
+// addEntry adds the sample of a queue entry taken from the shard to the batch.
+// Must only be called after full() returned false.
+func (b *batch) addEntry(s *shard, e queueEntry) {
+	b.add(e.sample)
+
+	if b.entries == nil {
+		b.entries = map[string][]batchEntry{}
+	}
+	pid := e.sample.Resource.Labels[KeyProjectID]
+	b.entries[pid] = append(b.entries[pid], batchEntry{queueEntry: e, shard: s})
+}
+
+// allowProject returns true if the write rate limit permits adding a sample for the project.
+func (b *batch) allowProject(pid string) bool {
+	return b.projectLimiter == nil || b.projectLimiter.allow(pid)
+}
+
+// dropRateLimited drops a queue entry of a project that exceeded its write rate limit.
+func (b *batch) dropRateLimited(pid string, e queueEntry) {
+	samplesDropped.WithLabelValues("project-rate-limit").Inc()
+	projectSamplesDropped.WithLabelValues(pid).Inc()
+
+	if b.wal != nil && e.walRef != 0 {
+		b.wal.ack([]uint64{e.walRef})
+	}
+}
+
 // full returns whether the batch is full. Being full means that add() must not be called again
 // and it guarantees that at most one request per project with at most maxSize samples is made.
 func (b *batch) full() bool {
@@ -908,47 +1560,171 @@ func (b *batch) empty() bool {
 
 // send the accumulated samples to their respective projects. It returns once all
 // requests have completed and notifies the pending shards.
-func (b batch) send(
-	ctx context.Context,
-	sendOne func(context.Context, *monitoring_pb.CreateTimeSeriesRequest, ...gax.CallOption) error,
-) {
-	// Set timeout so slow requests in the batch do not block overall progress indefinitely.
-	sendCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
-
+func (b batch) send(ctx context.Context, sink Sink) {
 	projectsPerBatch.Observe(float64(len(b.m)))
-	var wg sync.WaitGroup
-
+	var (
+		wg    sync.WaitGroup
+		mtx   sync.Mutex
+		retry []batchEntry
+	)
 	for pid, l := range b.m {
 		wg.Add(1)
 
 		go func(pid string, l []*monitoring_pb.TimeSeries) {
 			defer wg.Done()
 
-			pendingRequests.Inc()
-			defer pendingRequests.Dec()
-
-			samplesPerRPCBatch.Observe(float64(len(l)))
+			err := b.sendProject(ctx, sink, pid, l)
 
-			// We do not retry any requests due to the risk of producing a backlog
-			// that cannot be worked down, especially if large amounts of clients try to do so.
-			err := sendOne(sendCtx, &monitoring_pb.CreateTimeSeriesRequest{
-				Name:       fmt.Sprintf("projects/%s", pid),
-				TimeSeries: l,
-			})
-			if err != nil {
-				level.Error(b.logger).Log("msg", "send batch", "size", len(l), "err", err)
+			if r := b.handleResult(pid, l, err); len(r) > 0 {
+				mtx.Lock()
+				retry = append(retry, r...)
+				mtx.Unlock()
 			}
-			samplesSent.Add(float64(len(l)))
 		}(pid, l)
 	}
 	wg.Wait()
 
+	if len(retry) > 0 {
+		b.requeue(ctx, retry)
+	}
 	for _, s := range b.shards {
 		s.notifyDone()
 	}
 }
 
+// sendProject sends the samples of a single project once the concurrency limit permits it.
+func (b *batch) sendProject(ctx context.Context, sink Sink, pid string, l []*monitoring_pb.TimeSeries) error {
+	if b.limiter != nil {
+		if err := b.limiter.acquire(ctx); err != nil {
+			return status.FromContextError(err).Err()
+		}
+	}
+	pendingRequests.Inc()
+	defer pendingRequests.Dec()
+
+	samplesPerRPCBatch.Observe(float64(len(l)))
+
+	// Set timeout so slow requests in the batch do not block overall progress indefinitely.
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := sink.Send(ctx, pid, l)
+	samplesSent.Add(float64(len(l)))
+
+	if b.limiter != nil {
+		code, _ := parseSendError(err)
+		b.limiter.release(start, code)
+	}
+	return err
+}
+
+// handleResult processes the result of sending the samples for a project and returns
+// the entries that should be sent again.
+func (b *batch) handleResult(pid string, l []*monitoring_pb.TimeSeries, err error) []batchEntry {
+	entries := b.entries[pid]
+
+	if err == nil {
+		if b.wal != nil {
+			b.ack(entries)
+		}
+		if b.retrier != nil {
+			b.retrier.deposit(len(l))
+		}
+		return nil
+	}
+	code, summary := parseSendError(err)
+	if b.sendErrors != nil {
+		b.sendErrors.add(pid, code, len(l), err)
+	}
+
+	// The API does not tell us which points of a partially successful request failed.
+	// Retrying the entire request would only fail again for the successful points, so
+	// we only account for the rejected ones.
+	if summary != nil && summary.SuccessPointCount > 0 {
+		level.Error(b.logger).Log("msg", "send batch partially failed", "size", len(l),
+			"succeeded", summary.SuccessPointCount, "err", err)
+
+		for _, e := range summary.Errors {
+			samplesDropped.WithLabelValues(sendErrorReason(codes.Code(e.GetStatus().GetCode()))).Add(float64(e.PointCount))
+		}
+		if b.wal != nil {
+			b.ack(entries)
+		}
+		return nil
+	}
+	level.Error(b.logger).Log("msg", "send batch", "size", len(l), "err", err)
+
+	// Entries that are dropped for good must be acknowledged. Otherwise they hold back
+	// the checkpoint of the write-ahead buffer indefinitely.
+	if b.retrier == nil || !isRetriable(code) || len(entries) == 0 {
+		samplesDropped.WithLabelValues(sendErrorReason(code)).Add(float64(len(l)))
+		if b.wal != nil {
+			b.ack(entries)
+		}
+		return nil
+	}
+	var retry, dropped []batchEntry
+	for _, e := range entries {
+		if e.attempts < b.retrier.maxAttempts {
+			retry = append(retry, e)
+		} else {
+			dropped = append(dropped, e)
+		}
+	}
+	if n := len(dropped); n > 0 {
+		samplesDropped.WithLabelValues("retries-exhausted").Add(float64(n))
+	}
+	granted := b.retrier.withdraw(len(retry))
+	if n := len(retry) - granted; n > 0 {
+		samplesDropped.WithLabelValues("retry-budget-exhausted").Add(float64(n))
+		dropped = append(dropped, retry[granted:]...)
+	}
+	if b.wal != nil {
+		b.ack(dropped)
+	}
+	return retry[:granted]
+}
+
+// ack acknowledges entries in the write-ahead buffer.
+func (b *batch) ack(entries []batchEntry) {
+	refs := make([]uint64, 0, len(entries))
+	for _, e := range entries {
+		if e.walRef != 0 {
+			refs = append(refs, e.walRef)
+		}
+	}
+	b.wal.ack(refs)
+}
+
+// requeue adds the entries back to their shards after waiting for the backoff. The
+// shards remain pending meanwhile so that no newer samples are sent before the retried ones.
+func (b *batch) requeue(ctx context.Context, entries []batchEntry) {
+	var attempts uint
+	for _, e := range entries {
+		if e.attempts > attempts {
+			attempts = e.attempts
+		}
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(b.retrier.backoff(attempts + 1)):
+	}
+	byShard := map[*shard][]queueEntry{}
+	for _, e := range entries {
+		e.attempts++
+		byShard[e.shard] = append(byShard[e.shard], e.queueEntry)
+	}
+	for s, l := range byShard {
+		retried, dropped := s.requeue(l)
+		samplesRetried.Add(float64(retried))
+
+		if b.wal != nil {
+			b.wal.ackEntries(dropped)
+		}
+	}
+}
+
 // Matchers holds a list of metric selectors that can be set as a flag.
 type Matchers []labels.Selector
 
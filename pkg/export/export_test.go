@@ -27,7 +27,7 @@ import (
 	"github.com/go-kit/log"
 	timestamp_pb "github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/google/go-cmp/cmp"
-	gax "github.com/googleapis/gax-go/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/model/textparse"
 	"github.com/prometheus/prometheus/storage"
@@ -35,7 +35,10 @@ import (
 	"google.golang.org/api/option"
 	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
 	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	status_pb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/grpc/test/bufconn"
 	empty_pb "google.golang.org/protobuf/types/known/emptypb"
 )
@@ -95,7 +98,7 @@ func TestBatchFillFromShardsAndSend(t *testing.T) {
 					KeyProjectID: fmt.Sprintf("project-%d", i%100),
 				},
 			},
-		})
+		}, priorityNormal)
 	}
 
 	b := newBatch(nil, DefaultShardCount, 101)
@@ -113,13 +116,13 @@ func TestBatchFillFromShardsAndSend(t *testing.T) {
 
 	// When sending the batch we should see the right number of samples and all shards we pass should
 	// be notified at the end.
-	sendOne := func(ctx context.Context, req *monitoring_pb.CreateTimeSeriesRequest, opts ...gax.CallOption) error {
+	sink := sinkFunc(func(ctx context.Context, projectID string, series []*monitoring_pb.TimeSeries) error {
 		mtx.Lock()
-		receivedSamples += len(req.TimeSeries)
+		receivedSamples += len(series)
 		mtx.Unlock()
 		return nil
-	}
-	b.send(context.Background(), sendOne)
+	})
+	b.send(context.Background(), sink)
 
 	if want := 10000; receivedSamples != want {
 		t.Fatalf("unexpected number of received samples (want=%d, got=%d)", want, receivedSamples)
@@ -131,6 +134,128 @@ func TestBatchFillFromShardsAndSend(t *testing.T) {
 	}
 }
 
+func TestBatchSendRetry(t *testing.T) {
+	s := newShard(100)
+	for i := 0; i < 10; i++ {
+		s.enqueue(uint64(i), &monitoring_pb.TimeSeries{
+			Resource: &monitoredres_pb.MonitoredResource{
+				Labels: map[string]string{KeyProjectID: "project"},
+			},
+		}, priorityNormal)
+	}
+	retrier := newRetrier(RetryOpts{MaxAttempts: 1, BudgetRatio: DefaultRetryBudgetRatio})
+
+	sink := sinkFunc(func(ctx context.Context, projectID string, series []*monitoring_pb.TimeSeries) error {
+		return status.Error(codes.Unavailable, "unavailable")
+	})
+	b := newBatch(nil, DefaultShardCount, 5)
+	b.retrier = retrier
+	s.fill(b)
+
+	// Samples are added back to the front of the queue.
+	s.enqueue(100, &monitoring_pb.TimeSeries{
+		Resource: &monitoredres_pb.MonitoredResource{
+			Labels: map[string]string{KeyProjectID: "project"},
+		},
+	}, priorityNormal)
+	b.send(context.Background(), sink)
+
+	if s.pending {
+		t.Fatalf("shard unexpectedly pending after send")
+	}
+	if got, want := s.length(), 11; got != want {
+		t.Fatalf("unexpected queue length (want=%d, got=%d)", want, got)
+	}
+	for i := 0; i < 5; i++ {
+		e, _ := s.queues[priorityNormal.index()].peek()
+		if e.hash != uint64(i) || e.attempts != 1 {
+			t.Fatalf("unexpected queue entry at %d: hash=%d, attempts=%d", i, e.hash, e.attempts)
+		}
+		s.queues[priorityNormal.index()].remove()
+	}
+
+	// Retrying the same samples again exceeds the maximum attempts and drops them.
+	s = newShard(100)
+	for i := 0; i < 5; i++ {
+		s.tryEnqueue(queueEntry{
+			hash:     uint64(i),
+			attempts: 1,
+			sample: &monitoring_pb.TimeSeries{
+				Resource: &monitoredres_pb.MonitoredResource{
+					Labels: map[string]string{KeyProjectID: "project"},
+				},
+			},
+		})
+	}
+	b = newBatch(nil, DefaultShardCount, 5)
+	b.retrier = retrier
+	s.fill(b)
+
+	dropped := testutil.ToFloat64(samplesDropped.WithLabelValues("retries-exhausted"))
+	b.send(context.Background(), sink)
+
+	if got := testutil.ToFloat64(samplesDropped.WithLabelValues("retries-exhausted")) - dropped; got != 5 {
+		t.Fatalf("expected 5 samples dropped after exhausting retries, got %v", got)
+	}
+	if got := s.length(); got != 0 {
+		t.Fatalf("expected empty queue, got length %d", got)
+	}
+}
+
+func TestBatchSendPartialFailure(t *testing.T) {
+	s := newShard(100)
+	for i := 0; i < 10; i++ {
+		s.enqueue(uint64(i), &monitoring_pb.TimeSeries{
+			Resource: &monitoredres_pb.MonitoredResource{
+				Labels: map[string]string{KeyProjectID: "project"},
+			},
+		}, priorityNormal)
+	}
+	sink := sinkFunc(func(ctx context.Context, projectID string, series []*monitoring_pb.TimeSeries) error {
+		st, err := status.New(codes.InvalidArgument, "some points failed").WithDetails(&monitoring_pb.CreateTimeSeriesSummary{
+			TotalPointCount:   10,
+			SuccessPointCount: 7,
+			Errors: []*monitoring_pb.CreateTimeSeriesSummary_Error{
+				{Status: &status_pb.Status{Code: int32(codes.InvalidArgument)}, PointCount: 2},
+				{Status: &status_pb.Status{Code: int32(codes.Unavailable)}, PointCount: 1},
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return st.Err()
+	})
+	b := newBatch(nil, DefaultShardCount, 10)
+	b.retrier = newRetrier(RetryOpts{MaxAttempts: DefaultRetryMaxAttempts, BudgetRatio: DefaultRetryBudgetRatio})
+	s.fill(b)
+
+	var (
+		invalid     = samplesDropped.WithLabelValues(sendErrorReason(codes.InvalidArgument))
+		unavailable = samplesDropped.WithLabelValues(sendErrorReason(codes.Unavailable))
+		before      = testutil.ToFloat64(invalid) + testutil.ToFloat64(unavailable)
+	)
+	b.send(context.Background(), sink)
+
+	// Only the rejected points are dropped and nothing is retried.
+	if got := testutil.ToFloat64(invalid) + testutil.ToFloat64(unavailable) - before; got != 3 {
+		t.Fatalf("expected 3 dropped samples, got %v", got)
+	}
+	if got := s.length(); got != 0 {
+		t.Fatalf("expected empty queue, got length %d", got)
+	}
+}
+
+// sinkFunc is a Sink that calls itself on Send.
+type sinkFunc func(ctx context.Context, projectID string, series []*monitoring_pb.TimeSeries) error
+
+func (f sinkFunc) Send(ctx context.Context, projectID string, series []*monitoring_pb.TimeSeries) error {
+	return f(ctx, projectID, series)
+}
+
+func (f sinkFunc) Close() error {
+	return nil
+}
+
 func TestSampleInRange(t *testing.T) {
 	cases := []struct {
 		interval   monitoring_pb.TimeInterval
@@ -326,14 +451,26 @@ func TestExporter_wrapMetadata(t *testing.T) {
 
 type testMetricService struct {
 	monitoring_pb.MetricServiceServer // Inherit all interface methods
-	samples                           []*monitoring_pb.TimeSeries
+
+	mtx     sync.Mutex
+	samples []*monitoring_pb.TimeSeries
 }
 
 func (srv *testMetricService) CreateTimeSeries(ctx context.Context, req *monitoring_pb.CreateTimeSeriesRequest) (*empty_pb.Empty, error) {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
 	srv.samples = append(srv.samples, req.TimeSeries...)
 	return &empty_pb.Empty{}, nil
 }
 
+func (srv *testMetricService) sampleCount() int {
+	srv.mtx.Lock()
+	defer srv.mtx.Unlock()
+
+	return len(srv.samples)
+}
+
 func TestExporter_drainBacklog(t *testing.T) {
 	var (
 		srv          = grpc.NewServer()
@@ -364,7 +501,7 @@ func TestExporter_drainBacklog(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Creating Exporter failed: %s", err)
 	}
-	e.metricClient = metricClient
+	e.sink = NewGCMSink(metricClient)
 
 	e.SetLabelsByIDFunc(func(i storage.SeriesRef) labels.Labels {
 		return labels.FromStrings("project_id", "test", "location", "test")
@@ -384,7 +521,176 @@ func TestExporter_drainBacklog(t *testing.T) {
 	time.Sleep(55 * batchDelayMax)
 
 	// Check that we received all samples that went in.
-	if got, want := len(metricServer.samples), 50; got != want {
+	if got, want := metricServer.sampleCount(), 50; got != want {
 		t.Fatalf("got %d, want %d", got, want)
 	}
 }
+
+func TestExporter_drainBacklogWAL(t *testing.T) {
+	var (
+		srv          = grpc.NewServer()
+		listener     = bufconn.Listen(1e6)
+		metricServer = &testMetricService{}
+	)
+	monitoring_pb.RegisterMetricServiceServer(srv, metricServer)
+
+	go srv.Serve(listener)
+	defer srv.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bufDialer := func(context.Context, string) (net.Conn, error) {
+		return listener.Dial()
+	}
+	metricClient, err := monitoring.NewMetricClient(ctx,
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()),
+		option.WithGRPCDialOption(grpc.WithContextDialer(bufDialer)),
+	)
+	if err != nil {
+		t.Fatalf("Creating metric client failed: %s", err)
+	}
+
+	e, err := New(log.NewJSONLogger(log.NewSyncWriter(os.Stderr)), nil, ExporterOpts{
+		DisableAuth: true,
+		WALDir:      t.TempDir(),
+		Efficiency: EfficiencyOpts{
+			// Use a shard buffer smaller than the number of samples. With the write-ahead
+			// buffer nothing must be dropped regardless.
+			ShardBufferSize: 10,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Creating Exporter failed: %s", err)
+	}
+	e.sink = NewGCMSink(metricClient)
+
+	e.SetLabelsByIDFunc(func(i storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("project_id", "test", "location", "test")
+	})
+
+	// Fill a single shard with samples.
+	for i := 0; i < 50; i++ {
+		e.Export(nil, []record.RefSample{
+			{Ref: 1, T: int64(i), V: float64(i)},
+		}, nil)
+	}
+
+	go e.Run(ctx)
+	time.Sleep(55 * batchDelayMax)
+
+	if got, want := metricServer.sampleCount(), 50; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	// All samples were acknowledged and thus the checkpoint caught up with the reader.
+	e.wal.mtx.Lock()
+	defer e.wal.mtx.Unlock()
+
+	if len(e.wal.pending) > 0 {
+		t.Fatalf("expected no pending samples in write-ahead buffer, got %d", len(e.wal.pending))
+	}
+}
+
+func TestExporter_drainOnShutdown(t *testing.T) {
+	sink := NewMemorySink()
+
+	e, err := New(log.NewJSONLogger(log.NewSyncWriter(os.Stderr)), nil, ExporterOpts{
+		Sink:         sink,
+		DrainTimeout: 10 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Creating Exporter failed: %s", err)
+	}
+
+	e.SetLabelsByIDFunc(func(i storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("project_id", "test", "location", "test")
+	})
+
+	// Fill a single shard with samples. Each batch can only contain one of them.
+	for i := 0; i < 50; i++ {
+		e.Export(nil, []record.RefSample{
+			{Ref: 1, T: int64(i), V: float64(i)},
+		}, nil)
+	}
+
+	// Run with an already cancelled context. All samples must be sent before Run returns.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := e.Run(ctx); err != nil {
+		t.Fatalf("Run failed: %s", err)
+	}
+	if got, want := len(sink.Series("test")), 50; got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+	// New samples are no longer accepted.
+	e.Export(nil, []record.RefSample{{Ref: 1, T: 100, V: 100}}, nil)
+
+	if got := e.queuedSamples(); got != 0 {
+		t.Fatalf("expected no queued samples after shutdown, got %d", got)
+	}
+}
+
+func TestExporter_outOfOrder(t *testing.T) {
+	e, err := New(nil, nil, ExporterOpts{Sink: NewMemorySink()})
+	if err != nil {
+		t.Fatalf("Creating Exporter failed: %s", err)
+	}
+	e.SetLabelsByIDFunc(func(i storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("__name__", "metric1", "project_id", "p1", "location", "l1")
+	})
+	discarded := testutil.ToFloat64(prometheusSamplesDiscarded.WithLabelValues("out-of-order"))
+
+	// Duplicate and older points are discarded before they are enqueued.
+	for _, ts := range []int64{1000, 1000, 500, 2000} {
+		e.Export(gaugeMetadata, []record.RefSample{{Ref: 1, T: ts, V: 1}}, nil)
+	}
+	n := 0
+	for _, s := range e.shards {
+		n += s.length()
+	}
+	if n != 2 {
+		t.Fatalf("expected 2 enqueued samples, got %d", n)
+	}
+	if got := testutil.ToFloat64(prometheusSamplesDiscarded.WithLabelValues("out-of-order")) - discarded; got != 2 {
+		t.Fatalf("expected 2 discarded samples, got %v", got)
+	}
+}
+
+func TestBatchSend_ackDropped(t *testing.T) {
+	w, err := openWAL(nil, t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := w.write([]hashedSeries{testWALSeries(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := newShard(100)
+	for _, r := range readWALRecords(t, w, 5) {
+		s.tryEnqueue(queueEntry{hash: r.hash, sample: r.sample, walRef: r.ref})
+	}
+	sink := sinkFunc(func(ctx context.Context, projectID string, series []*monitoring_pb.TimeSeries) error {
+		return status.Error(codes.InvalidArgument, "invalid")
+	})
+	b := newBatch(nil, DefaultShardCount, 5)
+	b.retrier = newRetrier(RetryOpts{MaxAttempts: 3, BudgetRatio: DefaultRetryBudgetRatio})
+	b.wal = w
+	s.fill(b)
+	b.send(context.Background(), sink)
+
+	// Samples that failed non-retriably are acknowledged and the checkpoint advances.
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if len(w.pending) > 0 {
+		t.Fatalf("expected no pending samples in write-ahead buffer, got %d", len(w.pending))
+	}
+	if got, want := w.checkpoint(), w.readPos; got != want {
+		t.Fatalf("expected checkpoint %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc/codes"
+)
+
+var concurrencyLimit = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "gcm_export_concurrency_limit",
+	Help: "Current limit of concurrent requests to the GCM API.",
+})
+
+const (
+	// DefaultConcurrencyMax is the default upper bound of the concurrency limit.
+	DefaultConcurrencyMax = 256
+	// DefaultConcurrencyLatencyTarget is the default request latency above which the
+	// concurrency limit is decreased.
+	DefaultConcurrencyLatencyTarget = 5 * time.Second
+
+	// Limit at which the limiter starts before adapting to observed requests.
+	concurrencyInitial = 32
+	// Factor by which the limit is multiplied when a request indicates overload.
+	concurrencyBackoffRatio = 0.9
+)
+
+// ConcurrencyOpts configures the adaptive limit of concurrent requests to the GCM API.
+type ConcurrencyOpts struct {
+	// Enable limiting concurrent requests. Otherwise the number of concurrent requests
+	// is only bounded by the number of shards.
+	Enable bool
+	// Lower bound of the limit. Defaults to 1 when 0.
+	Min uint
+	// Upper bound of the limit. Defaults to DefaultConcurrencyMax when 0.
+	Max uint
+	// Request latency above which the limit is decreased. Defaults to
+	// DefaultConcurrencyLatencyTarget when 0.
+	LatencyTarget time.Duration
+}
+
+// concurrencyLimiter limits the number of in-flight requests. The limit is adapted through
+// additive increase and multiplicative decrease (AIMD): each successful request increases it
+// by 1/limit, i.e. by about one per round trip, while requests that failed due to overload
+// or exceeded the latency target decrease it by concurrencyBackoffRatio. The limit is decreased
+// at most once per round trip: requests that started before the last decrease observed the
+// same overload and are ignored.
+type concurrencyLimiter struct {
+	min, max      float64
+	latencyTarget time.Duration
+	now           func() time.Time
+
+	mtx      sync.Mutex
+	limit    float64
+	inflight int
+	// Time of the most recent decrease of the limit.
+	lastDecrease time.Time
+	// Closed and replaced whenever a slot becomes available.
+	releasec chan struct{}
+}
+
+func newConcurrencyLimiter(opts ConcurrencyOpts) *concurrencyLimiter {
+	l := &concurrencyLimiter{
+		min:           float64(opts.Min),
+		max:           float64(opts.Max),
+		latencyTarget: opts.LatencyTarget,
+		now:           time.Now,
+		limit:         concurrencyInitial,
+		releasec:      make(chan struct{}),
+	}
+	if l.limit < l.min {
+		l.limit = l.min
+	}
+	if l.limit > l.max {
+		l.limit = l.max
+	}
+	concurrencyLimit.Set(l.limit)
+	return l
+}
+
+// available returns true if a request can be started without waiting.
+func (l *concurrencyLimiter) available() bool {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return float64(l.inflight) < l.limit
+}
+
+// acquire blocks until a request can be started or the context is canceled.
+// A successful call must be followed by a call to release.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mtx.Lock()
+		if float64(l.inflight) < l.limit {
+			l.inflight++
+			l.mtx.Unlock()
+			return nil
+		}
+		releasec := l.releasec
+		l.mtx.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-releasec:
+		}
+	}
+}
+
+// release completes a request that started at the given time and returned with the given code.
+func (l *concurrencyLimiter) release(start time.Time, code codes.Code) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.inflight--
+	now := l.now()
+
+	switch {
+	case isOverload(code) || now.Sub(start) > l.latencyTarget:
+		if !start.Before(l.lastDecrease) {
+			l.limit *= concurrencyBackoffRatio
+			l.lastDecrease = now
+		}
+	case code == codes.OK:
+		l.limit += 1 / l.limit
+	}
+	if l.limit < l.min {
+		l.limit = l.min
+	}
+	if l.limit > l.max {
+		l.limit = l.max
+	}
+	concurrencyLimit.Set(l.limit)
+
+	close(l.releasec)
+	l.releasec = make(chan struct{})
+}
+
+// isOverload returns true if the code indicates that the API is overloaded or we
+// exceeded our quota.
+func isOverload(code codes.Code) bool {
+	switch code {
+	case codes.ResourceExhausted, codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,118 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+)
+
+func TestConcurrencyLimiter_adapt(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyOpts{Min: 2, Max: 40, LatencyTarget: time.Second})
+
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	// Runs a request that took the given duration.
+	request := func(took time.Duration, code codes.Code) {
+		if err := l.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(took)
+		l.release(now.Add(-took), code)
+	}
+	// Successful requests increase the limit by about one per full round of requests.
+	for i := 0; i < 32; i++ {
+		request(time.Millisecond, codes.OK)
+	}
+	if l.limit < 32.9 || l.limit > 33.1 {
+		t.Fatalf("expected limit of about 33, got %v", l.limit)
+	}
+	// Non-overload errors do not change the limit.
+	limit := l.limit
+	request(time.Millisecond, codes.InvalidArgument)
+	if l.limit != limit {
+		t.Fatalf("expected limit %v, got %v", limit, l.limit)
+	}
+	// Overload errors and slow requests decrease it multiplicatively.
+	request(time.Millisecond, codes.ResourceExhausted)
+	request(2*time.Second, codes.OK)
+
+	if want := limit * concurrencyBackoffRatio * concurrencyBackoffRatio; l.limit != want {
+		t.Fatalf("expected limit %v, got %v", want, l.limit)
+	}
+	// Concurrent requests that fail from the same overload decrease the limit only once.
+	limit = l.limit
+	start := now
+	for i := 0; i < 10; i++ {
+		l.acquire(ctx)
+	}
+	now = now.Add(time.Millisecond)
+	for i := 0; i < 10; i++ {
+		l.release(start, codes.Unavailable)
+	}
+	if want := limit * concurrencyBackoffRatio; l.limit != want {
+		t.Fatalf("expected limit %v, got %v", want, l.limit)
+	}
+	// The limit is bounded.
+	for i := 0; i < 100; i++ {
+		request(time.Millisecond, codes.Unavailable)
+	}
+	if l.limit != 2 {
+		t.Fatalf("expected limit to be bounded at 2, got %v", l.limit)
+	}
+	for i := 0; i < 10000; i++ {
+		request(time.Millisecond, codes.OK)
+	}
+	if l.limit != 40 {
+		t.Fatalf("expected limit to be bounded at 40, got %v", l.limit)
+	}
+}
+
+func TestConcurrencyLimiter_acquire(t *testing.T) {
+	l := newConcurrencyLimiter(ConcurrencyOpts{Min: 1, Max: 1, LatencyTarget: time.Second})
+
+	ctx := context.Background()
+	if err := l.acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if l.available() {
+		t.Fatalf("limiter unexpectedly available")
+	}
+	// Waiting for a slot is aborted with the context.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	if err := l.acquire(timeoutCtx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded error, got %v", err)
+	}
+	// Waiters proceed once a request completes.
+	acquired := make(chan struct{})
+	go func() {
+		l.acquire(ctx)
+		close(acquired)
+	}()
+	l.release(time.Now(), codes.OK)
+
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("waiting request was not started after release")
+	}
+}
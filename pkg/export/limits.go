@@ -0,0 +1,210 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+var gcmLimitViolations = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcm_export_limit_violations_total",
+	Help: "Number of series found to exceed a GCM limit when being converted, by metric name and limit. A series is counted once per violated limit. Metrics beyond the first 100 are counted as \"other\".",
+}, []string{"metric", "limit"})
+
+// Maximum number of distinct metric names for which limit violations are counted. Further
+// metrics are counted under the name "other".
+const maxViolationMetrics = 100
+
+var (
+	violationMetricsMtx sync.Mutex
+	violationMetrics    = map[string]struct{}{}
+)
+
+// countViolation counts a violation of the limit by a series of the given metric. Series of
+// one histogram or summary are counted under their base name.
+func countViolation(metric, limit string) {
+	metric, _, _ = splitMetricSuffix(metric)
+
+	violationMetricsMtx.Lock()
+	if _, ok := violationMetrics[metric]; !ok {
+		if len(violationMetrics) < maxViolationMetrics {
+			violationMetrics[metric] = struct{}{}
+		} else {
+			metric = "other"
+		}
+	}
+	violationMetricsMtx.Unlock()
+
+	gcmLimitViolations.WithLabelValues(metric, limit).Inc()
+}
+
+// Limits of GCM series.
+const (
+	// Maximum number of metric labels.
+	// TODO: remove once field limit is lifted in the GCM API.
+	maxLabelCount = 100
+	// Maximum length of metric label names and values in bytes.
+	maxLabelNameLength  = 100
+	maxLabelValueLength = 1024
+	// Maximum length of metric types in bytes.
+	maxMetricTypeLength = 200
+)
+
+// The limits that series may violate.
+const (
+	limitLabelCount       = "label-count"
+	limitLabelNameLength  = "label-name-length"
+	limitLabelValueLength = "label-value-length"
+	limitMetricTypeLength = "metric-type-length"
+)
+
+// The strategies for series exceeding GCM limits.
+const (
+	// Drop the series.
+	limitsStrategyDrop = "drop"
+	// Truncate label names, label values, and metric names to the limit, ending them in
+	// a hash of the full string. Series with too many labels are dropped.
+	limitsStrategyTruncate = "truncate"
+	// Remove labels in the configured order until the series is within the limits. Series
+	// that still exceed them are dropped.
+	limitsStrategyDropLabels = "drop_labels"
+)
+
+// Length of the hash suffix of truncated strings including the separator.
+const truncateHashLength = 9
+
+// gcmLimits is the validated form of a LimitsConfig.
+type gcmLimits struct {
+	strategy  string
+	dropOrder []string
+}
+
+// defaultLimits drops series exceeding GCM limits.
+var defaultLimits = &gcmLimits{strategy: limitsStrategyDrop}
+
+// labelViolations returns the limits the metric labels exceed.
+func labelViolations(lset labels.Labels) []string {
+	var res []string
+	if len(lset) > maxLabelCount {
+		res = append(res, limitLabelCount)
+	}
+	var names, values bool
+	for _, l := range lset {
+		names = names || len(l.Name) > maxLabelNameLength
+		values = values || len(l.Value) > maxLabelValueLength
+	}
+	if names {
+		res = append(res, limitLabelNameLength)
+	}
+	if values {
+		res = append(res, limitLabelValueLength)
+	}
+	return res
+}
+
+// enforceLabels applies the limits to the metric labels of a series. It returns the labels
+// within the limits, the violated limits, and false if the series must be dropped instead.
+func (l *gcmLimits) enforceLabels(lset labels.Labels) (labels.Labels, []string, bool) {
+	violations := labelViolations(lset)
+	if len(violations) == 0 {
+		return lset, nil, true
+	}
+	res, ok := l.fitLabels(lset)
+	return res, violations, ok
+}
+
+// fitLabels adjusts metric labels exceeding the limits according to the strategy.
+func (l *gcmLimits) fitLabels(lset labels.Labels) (labels.Labels, bool) {
+	switch l.strategy {
+	case limitsStrategyTruncate:
+		if len(lset) > maxLabelCount {
+			return nil, false
+		}
+		res := make(labels.Labels, 0, len(lset))
+		for _, lbl := range lset {
+			res = append(res, labels.Label{
+				Name:  truncateWithHash(lbl.Name, maxLabelNameLength),
+				Value: truncateWithHash(lbl.Value, maxLabelValueLength),
+			})
+		}
+		return labels.New(res...), true
+
+	case limitsStrategyDropLabels:
+		for _, name := range l.dropOrder {
+			if len(labelViolations(lset)) == 0 {
+				break
+			}
+			if lset.Has(name) {
+				lset = labels.NewBuilder(lset).Del(name).Labels(labels.EmptyLabels())
+			}
+		}
+		return lset, len(labelViolations(lset)) == 0
+
+	default:
+		return nil, false
+	}
+}
+
+// enforceMetricType applies the limits to the GCM metric type of a series. It returns the
+// metric type within the limits, whether the type exceeded the limit, and false if the
+// series must be dropped instead.
+func (l *gcmLimits) enforceMetricType(mtype string) (string, bool, bool) {
+	if len(mtype) <= maxMetricTypeLength {
+		return mtype, false, true
+	}
+	res, ok := l.fitMetricType(mtype)
+	return res, true, ok
+}
+
+// fitMetricType truncates a metric type exceeding the limit if the strategy permits it.
+func (l *gcmLimits) fitMetricType(mtype string) (string, bool) {
+	if l.strategy != limitsStrategyTruncate {
+		return "", false
+	}
+	// Metric types have the form <prefix>/<name>/<suffix>. Only the name is truncated.
+	end := strings.LastIndex(mtype, "/")
+	start := strings.LastIndex(mtype[:end], "/") + 1
+	excess := len(mtype) - maxMetricTypeLength
+
+	name := mtype[start:end]
+	if len(name)-excess < truncateHashLength {
+		return "", false
+	}
+	return mtype[:start] + truncateWithHash(name, len(name)-excess) + mtype[end:], true
+}
+
+// truncateWithHash truncates the string to at most max bytes. Truncated strings end in
+// a hash of the full string so that distinct strings remain distinct.
+func truncateWithHash(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	h := fnv.New32a()
+	h.Write([]byte(s))
+
+	// Do not cut multi-byte characters in half.
+	i := max - truncateHashLength
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	return fmt.Sprintf("%s_%08x", s[:i], h.Sum32())
+}
@@ -0,0 +1,207 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/record"
+)
+
+func TestGCMLimits_enforceLabels(t *testing.T) {
+	long := strings.Repeat("a", maxLabelValueLength+10)
+
+	manyLabels := labels.NewBuilder(labels.FromStrings("keep", "1"))
+	for i := 0; i < maxLabelCount; i++ {
+		manyLabels.Set(fmt.Sprintf("l%03d", i), "v")
+	}
+	cases := []struct {
+		doc    string
+		limits *gcmLimits
+		lset   labels.Labels
+		want   labels.Labels
+		wantOK bool
+	}{
+		{
+			doc:    "within limits",
+			limits: defaultLimits,
+			lset:   labels.FromStrings("a", "b"),
+			want:   labels.FromStrings("a", "b"),
+			wantOK: true,
+		}, {
+			doc:    "drop",
+			limits: defaultLimits,
+			lset:   labels.FromStrings("a", long),
+		}, {
+			doc:    "truncate",
+			limits: &gcmLimits{strategy: limitsStrategyTruncate},
+			lset:   labels.FromStrings("a", long, "b", "c"),
+			want:   labels.FromStrings("a", truncateWithHash(long, maxLabelValueLength), "b", "c"),
+			wantOK: true,
+		}, {
+			doc:    "truncate too many labels",
+			limits: &gcmLimits{strategy: limitsStrategyTruncate},
+			lset:   manyLabels.Labels(labels.EmptyLabels()),
+		}, {
+			doc:    "drop labels in order",
+			limits: &gcmLimits{strategy: limitsStrategyDropLabels, dropOrder: []string{"b", "a", "c"}},
+			lset:   labels.FromStrings("a", long, "b", "x", "c", "y"),
+			want:   labels.FromStrings("c", "y"),
+			wantOK: true,
+		}, {
+			doc:    "drop labels not sufficient",
+			limits: &gcmLimits{strategy: limitsStrategyDropLabels, dropOrder: []string{"b"}},
+			lset:   labels.FromStrings("a", long, "b", "x"),
+		}, {
+			doc:    "drop labels for label count",
+			limits: &gcmLimits{strategy: limitsStrategyDropLabels, dropOrder: []string{"l000", "keep"}},
+			lset:   manyLabels.Labels(labels.EmptyLabels()),
+			want:   manyLabels.Del("l000").Labels(labels.EmptyLabels()),
+			wantOK: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.doc, func(t *testing.T) {
+			got, _, ok := c.limits.enforceLabels(c.lset)
+			if ok != c.wantOK {
+				t.Fatalf("expected ok=%v, got %v", c.wantOK, ok)
+			}
+			if ok && !labels.Equal(got, c.want) {
+				t.Fatalf("expected labels %s, got %s", c.want, got)
+			}
+		})
+	}
+}
+
+func TestGCMLimits_enforceMetricType(t *testing.T) {
+	name := strings.Repeat("a", maxMetricTypeLength)
+	mtype := "prometheus.googleapis.com/" + name + "/gauge"
+
+	if _, exceeded, ok := defaultLimits.enforceMetricType(mtype); ok || !exceeded {
+		t.Fatal("expected metric type to be dropped")
+	}
+	got, _, ok := (&gcmLimits{strategy: limitsStrategyTruncate}).enforceMetricType(mtype)
+	if !ok {
+		t.Fatal("expected truncated metric type")
+	}
+	if len(got) != maxMetricTypeLength {
+		t.Fatalf("expected metric type of length %d, got %d", maxMetricTypeLength, len(got))
+	}
+	if !strings.HasPrefix(got, "prometheus.googleapis.com/aaa") || !strings.HasSuffix(got, "/gauge") {
+		t.Fatalf("unexpected metric type %q", got)
+	}
+}
+
+func TestTruncateWithHash(t *testing.T) {
+	if got := truncateWithHash("short", 10); got != "short" {
+		t.Fatalf("expected unchanged string, got %q", got)
+	}
+	a := truncateWithHash(strings.Repeat("x", 30)+"a", 20)
+	b := truncateWithHash(strings.Repeat("x", 30)+"b", 20)
+	if len(a) != 20 || a == b {
+		t.Fatalf("expected distinct truncated strings of length 20, got %q and %q", a, b)
+	}
+	// Multi-byte characters are not cut.
+	if got := truncateWithHash(strings.Repeat("ä", 20), 20); len(got) != 19 || !strings.HasPrefix(got, "äääää_") {
+		t.Fatalf("unexpected truncated string %q", got)
+	}
+}
+
+func TestSampleBuilder_limits(t *testing.T) {
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1")
+	series := seriesMap{
+		1: labels.FromStrings("__name__", "metric1", "job", "j1", "instance", "i1", "path", strings.Repeat("p", maxLabelValueLength+1)),
+	}
+	metadata := testMetadataFunc(metricMetadataMap{
+		"metric1": {Type: textparse.MetricTypeGauge},
+	})
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return series[ref]
+	}
+	build := func() int {
+		b := newSampleBuilder(cache)
+		defer b.close()
+
+		out, _, err := b.next(metadata, externalLabels, []record.RefSample{{Ref: 1, T: 1000, V: 1}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(out)
+	}
+	violations := testutil.ToFloat64(gcmLimitViolations.WithLabelValues("metric1", limitLabelValueLength))
+	dropped := testutil.ToFloat64(samplesDropped.WithLabelValues("gcm-limits-exceeded"))
+
+	// The series is dropped by default.
+	if n := build(); n != 0 {
+		t.Fatalf("expected no samples, got %d", n)
+	}
+	if got := testutil.ToFloat64(samplesDropped.WithLabelValues("gcm-limits-exceeded")) - dropped; got != 1 {
+		t.Fatalf("expected 1 dropped sample, got %v", got)
+	}
+	// Changed limits apply to cached series.
+	cache.setLimits(&gcmLimits{strategy: limitsStrategyDropLabels, dropOrder: []string{"path"}})
+
+	if n := build(); n != 1 {
+		t.Fatalf("expected 1 sample, got %d", n)
+	}
+	// The violation is counted once for the series no matter how often it is populated.
+	if got := testutil.ToFloat64(gcmLimitViolations.WithLabelValues("metric1", limitLabelValueLength)) - violations; got != 1 {
+		t.Fatalf("expected 1 violation, got %v", got)
+	}
+}
+
+func TestCountViolation(t *testing.T) {
+	violationMetricsMtx.Lock()
+	saved := violationMetrics
+	violationMetrics = map[string]struct{}{}
+	violationMetricsMtx.Unlock()
+
+	defer func() {
+		violationMetricsMtx.Lock()
+		violationMetrics = saved
+		violationMetricsMtx.Unlock()
+	}()
+	get := func(metric string) float64 {
+		return testutil.ToFloat64(gcmLimitViolations.WithLabelValues(metric, limitLabelCount))
+	}
+	base, other := get("violation_base"), get("other")
+
+	// Series of a histogram are counted under their base name.
+	countViolation("violation_base_bucket", limitLabelCount)
+	countViolation("violation_base_count", limitLabelCount)
+
+	if got := get("violation_base") - base; got != 2 {
+		t.Fatalf("expected 2 violations for base name, got %v", got)
+	}
+	for i := 0; i < maxViolationMetrics; i++ {
+		countViolation(fmt.Sprintf("violation_metric_%d", i), limitLabelCount)
+	}
+	if got := get("other") - other; got != 1 {
+		t.Fatalf("expected 1 violation counted as other, got %v", got)
+	}
+	// Metrics that were counted before keep their name.
+	countViolation("violation_base", limitLabelCount)
+
+	if got := get("violation_base") - base; got != 3 {
+		t.Fatalf("expected 3 violations for base name, got %v", got)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"math"
+
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/model/value"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/record"
+
+	distribution_pb "google.golang.org/genproto/googleapis/api/distribution"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+)
+
+const (
+	// Range of valid native histogram schemas.
+	nativeHistogramSchemaMin = -4
+	nativeHistogramSchemaMax = 8
+
+	// Maximum number of buckets in a distribution accepted by the GCM API. Native histograms
+	// with more buckets are converted at a lower resolution.
+	maxDistributionBuckets = 200
+)
+
+// nextHistogram converts a native histogram sample into a cumulative distribution sample.
+// Returns no time series for samples that couldn't be converted.
+func (b *sampleBuilder) nextHistogram(metadata MetadataFunc, externalLabels labels.Labels, sample record.RefHistogramSample) []hashedSeries {
+	// Staleness markers are currently not supported by Cloud Monitoring.
+	if value.IsStaleNaN(sample.H.Sum) {
+		prometheusSamplesDiscarded.WithLabelValues("staleness-marker").Inc()
+		return nil
+	}
+	entry, ok := b.series.get(record.RefSample{Ref: sample.Ref, T: sample.T}, externalLabels, metadata)
+	if !ok {
+		prometheusSamplesDiscarded.WithLabelValues("no-cache-series-found").Inc()
+		return nil
+	}
+	if entry.dropped {
+		if entry.relabelDropped {
+			prometheusSamplesDiscarded.WithLabelValues("relabel-dropped").Inc()
+		} else if entry.limitDropped {
+			samplesDropped.WithLabelValues("cardinality-limit").Inc()
+		}
+		return nil
+	}
+	if entry.gcmLimitsExceeded {
+		samplesDropped.WithLabelValues("gcm-limits-exceeded").Inc()
+		return nil
+	}
+	c := entry.protos.cumulative
+	if entry.metadata.Type != textparse.MetricTypeHistogram || entry.suffix != metricSuffixNone || c.proto == nil {
+		prometheusSamplesDiscarded.WithLabelValues("native-histogram-unsupported-type").Inc()
+		return nil
+	}
+	// Check the schema early as handling resets relies on its validity.
+	if s := sample.H.Schema; s < nativeHistogramSchemaMin || s > nativeHistogramSchemaMax {
+		prometheusSamplesDiscarded.WithLabelValues("native-histogram-invalid-schema").Inc()
+		return nil
+	}
+	resetTimestamp, h, ok := b.series.getHistogramResetAdjusted(storage.SeriesRef(sample.Ref), sample.T, sample.H)
+	if !ok {
+		return nil
+	}
+	if entry.exportInterval > 0 && b.series.skipExport(storage.SeriesRef(sample.Ref), sample.T) {
+		samplesSkipped.Inc()
+		return nil
+	}
+	dist, reason := buildNativeDistribution(h)
+	if reason != "" {
+		prometheusSamplesDiscarded.WithLabelValues(reason).Inc()
+		return nil
+	}
+	ts := seriesWithoutPoints(c.proto)
+	ts.Points = []*monitoring_pb.Point{{
+		Interval: &monitoring_pb.TimeInterval{
+			StartTime: getTimestamp(resetTimestamp),
+			EndTime:   getTimestamp(sample.T),
+		},
+		Value: &monitoring_pb.TypedValue{
+			Value: &monitoring_pb.TypedValue_DistributionValue{dist},
+		},
+	}}
+	return []hashedSeries{{hash: c.hash, proto: ts, priority: entry.priority}}
+}
+
+// buildNativeDistribution converts a native histogram into a distribution with exponential
+// bucket options. If the histogram cannot be converted, the discard reason is returned.
+//
+// The lowest populated positive bucket determines the scale of the exponential buckets. The
+// zero bucket and all negative buckets are folded into the underflow bucket, which covers
+// all observations below the scale.
+func buildNativeDistribution(h *histogram.FloatHistogram) (*distribution_pb.Distribution, string) {
+	if h.Schema < nativeHistogramSchemaMin || h.Schema > nativeHistogramSchemaMax {
+		return nil, "native-histogram-invalid-schema"
+	}
+	if math.IsNaN(h.Count) || math.IsInf(h.Count, 0) || h.Count < 0 {
+		return nil, "native-histogram-invalid-count"
+	}
+	if h.ZeroCount < 0 {
+		return nil, "native-histogram-negative-bucket-count"
+	}
+	// Reduce the resolution until all positive buckets fit into the distribution along
+	// with the underflow bucket.
+	var (
+		minIdx, maxIdx int32
+		found          bool
+	)
+	for {
+		found = false
+		for it := h.PositiveBucketIterator(); it.Next(); {
+			b := it.At()
+			if b.Count < 0 {
+				return nil, "native-histogram-negative-bucket-count"
+			}
+			if b.Count == 0 {
+				continue
+			}
+			if !found || b.Index < minIdx {
+				minIdx = b.Index
+			}
+			if !found || b.Index > maxIdx {
+				maxIdx = b.Index
+			}
+			found = true
+		}
+		if !found || maxIdx-minIdx+2 <= maxDistributionBuckets {
+			break
+		}
+		if h.Schema == nativeHistogramSchemaMin {
+			return nil, "native-histogram-too-many-buckets"
+		}
+		h = h.CopyToSchema(h.Schema - 1)
+	}
+	var (
+		growthFactor = math.Pow(2, math.Pow(2, -float64(h.Schema)))
+		// Without positive buckets, all observations are in the underflow bucket and
+		// the single finite bucket remains empty.
+		numFinite = int32(1)
+		scale     = math.Max(1, h.ZeroThreshold)
+		mean, dev float64
+	)
+	if found {
+		numFinite = maxIdx - minIdx + 1
+		// Bucket i covers (growthFactor^(i-1), growthFactor^i].
+		scale = math.Pow(growthFactor, float64(minIdx-1))
+	}
+	if h.Count > 0 && !math.IsNaN(h.Sum) {
+		mean = h.Sum / h.Count
+	}
+	counts := make([]int64, numFinite+1)
+	counts[0] = int64(h.ZeroCount)
+	dev += h.ZeroCount * mean * mean
+
+	for it := h.NegativeBucketIterator(); it.Next(); {
+		b := it.At()
+		if b.Count < 0 {
+			return nil, "native-histogram-negative-bucket-count"
+		}
+		counts[0] += int64(b.Count)
+
+		x := (b.Lower + b.Upper) / 2
+		dev += b.Count * (x - mean) * (x - mean)
+	}
+	for it := h.PositiveBucketIterator(); it.Next(); {
+		b := it.At()
+		if b.Count == 0 {
+			continue
+		}
+		counts[b.Index-minIdx+1] += int64(b.Count)
+
+		x := (b.Lower + b.Upper) / 2
+		dev += b.Count * (x - mean) * (x - mean)
+	}
+	return &distribution_pb.Distribution{
+		Count:                 int64(h.Count),
+		Mean:                  mean,
+		SumOfSquaredDeviation: dev,
+		BucketOptions: &distribution_pb.Distribution_BucketOptions{
+			Options: &distribution_pb.Distribution_BucketOptions_ExponentialBuckets{
+				ExponentialBuckets: &distribution_pb.Distribution_BucketOptions_Exponential{
+					NumFiniteBuckets: numFinite,
+					GrowthFactor:     growthFactor,
+					Scale:            scale,
+				},
+			},
+		},
+		BucketCounts: counts,
+	}, ""
+}
+
+// nativeHistogramReset returns true if the histogram was reset since the previous one.
+// A higher resolution of the current histogram alone is not considered a reset.
+func nativeHistogramReset(cur, prev *histogram.FloatHistogram) bool {
+	if cur.Schema > prev.Schema {
+		cur = cur.CopyToSchema(prev.Schema)
+	}
+	return cur.DetectReset(prev)
+}
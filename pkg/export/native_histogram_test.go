@@ -0,0 +1,257 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/record"
+	"google.golang.org/protobuf/testing/protocmp"
+
+	distribution_pb "google.golang.org/genproto/googleapis/api/distribution"
+)
+
+func TestBuildNativeDistribution(t *testing.T) {
+	manyBuckets := make([]float64, 300)
+	for i := range manyBuckets {
+		manyBuckets[i] = 1
+	}
+	cases := []struct {
+		doc        string
+		h          *histogram.FloatHistogram
+		want       *distribution_pb.Distribution
+		wantReason string
+	}{
+		{
+			doc: "zero and negative buckets folded into underflow",
+			h: &histogram.FloatHistogram{
+				Schema:          0,
+				ZeroThreshold:   0.001,
+				ZeroCount:       2,
+				Count:           10,
+				Sum:             10,
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 2}},
+				PositiveBuckets: []float64{3, 4},
+				NegativeSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+				NegativeBuckets: []float64{1},
+			},
+			want: &distribution_pb.Distribution{
+				Count: 10,
+				Mean:  1,
+				// Deviations of bucket midpoints (0, 0.75, 1.5, -0.75) from the mean.
+				SumOfSquaredDeviation: 2*1 + 3*0.0625 + 4*0.25 + 1*3.0625,
+				BucketOptions: &distribution_pb.Distribution_BucketOptions{
+					Options: &distribution_pb.Distribution_BucketOptions_ExponentialBuckets{
+						ExponentialBuckets: &distribution_pb.Distribution_BucketOptions_Exponential{
+							NumFiniteBuckets: 2,
+							GrowthFactor:     2,
+							Scale:            0.5,
+						},
+					},
+				},
+				BucketCounts: []int64{3, 3, 4},
+			},
+		}, {
+			doc: "offset positive buckets with higher schema",
+			h: &histogram.FloatHistogram{
+				Schema:          1,
+				Count:           3,
+				Sum:             6,
+				PositiveSpans:   []histogram.Span{{Offset: 3, Length: 1}, {Offset: 1, Length: 1}},
+				PositiveBuckets: []float64{1, 2},
+			},
+			want: &distribution_pb.Distribution{
+				Count:                 3,
+				Mean:                  2,
+				SumOfSquaredDeviation: sq((math.Pow(math.Sqrt2, 2)+math.Pow(math.Sqrt2, 3))/2-2) + 2*sq((math.Pow(math.Sqrt2, 4)+math.Pow(math.Sqrt2, 5))/2-2),
+				BucketOptions: &distribution_pb.Distribution_BucketOptions{
+					Options: &distribution_pb.Distribution_BucketOptions_ExponentialBuckets{
+						ExponentialBuckets: &distribution_pb.Distribution_BucketOptions_Exponential{
+							NumFiniteBuckets: 3,
+							GrowthFactor:     math.Sqrt2,
+							Scale:            math.Pow(math.Sqrt2, 2),
+						},
+					},
+				},
+				BucketCounts: []int64{0, 1, 0, 2},
+			},
+		}, {
+			doc: "only zero bucket",
+			h: &histogram.FloatHistogram{
+				Schema:        3,
+				ZeroThreshold: 0.001,
+				ZeroCount:     5,
+				Count:         5,
+			},
+			want: &distribution_pb.Distribution{
+				Count: 5,
+				BucketOptions: &distribution_pb.Distribution_BucketOptions{
+					Options: &distribution_pb.Distribution_BucketOptions_ExponentialBuckets{
+						ExponentialBuckets: &distribution_pb.Distribution_BucketOptions_Exponential{
+							NumFiniteBuckets: 1,
+							GrowthFactor:     math.Pow(2, 0.125),
+							Scale:            1,
+						},
+					},
+				},
+				BucketCounts: []int64{5, 0},
+			},
+		}, {
+			doc: "invalid schema",
+			h: &histogram.FloatHistogram{
+				Schema: 9,
+			},
+			wantReason: "native-histogram-invalid-schema",
+		}, {
+			doc: "invalid count",
+			h: &histogram.FloatHistogram{
+				Count: math.NaN(),
+			},
+			wantReason: "native-histogram-invalid-count",
+		}, {
+			doc: "negative bucket count",
+			h: &histogram.FloatHistogram{
+				Count:           1,
+				NegativeSpans:   []histogram.Span{{Offset: 0, Length: 1}},
+				NegativeBuckets: []float64{-1},
+			},
+			wantReason: "native-histogram-negative-bucket-count",
+		}, {
+			doc: "too many buckets at lowest schema",
+			h: &histogram.FloatHistogram{
+				Schema:          -4,
+				Count:           2,
+				PositiveSpans:   []histogram.Span{{Offset: 0, Length: 1}, {Offset: 250, Length: 1}},
+				PositiveBuckets: []float64{1, 1},
+			},
+			wantReason: "native-histogram-too-many-buckets",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.doc, func(t *testing.T) {
+			got, reason := buildNativeDistribution(c.h)
+			if reason != c.wantReason {
+				t.Fatalf("expected discard reason %q, got %q", c.wantReason, reason)
+			}
+			if diff := cmp.Diff(c.want, got, protocmp.Transform(), cmpFloatApprox); diff != "" {
+				t.Fatalf("unexpected distribution (-want, +got): %s", diff)
+			}
+		})
+	}
+
+	t.Run("reduce schema", func(t *testing.T) {
+		h := &histogram.FloatHistogram{
+			Schema:          3,
+			Count:           300,
+			PositiveSpans:   []histogram.Span{{Offset: 1, Length: 300}},
+			PositiveBuckets: manyBuckets,
+		}
+		got, reason := buildNativeDistribution(h)
+		if reason != "" {
+			t.Fatalf("unexpected discard reason %q", reason)
+		}
+		if got.BucketOptions.GetExponentialBuckets().GrowthFactor != math.Pow(2, 0.25) {
+			t.Fatalf("expected schema 2, got growth factor %v", got.BucketOptions.GetExponentialBuckets().GrowthFactor)
+		}
+		if n := len(got.BucketCounts); n > maxDistributionBuckets {
+			t.Fatalf("expected at most %d buckets, got %d", maxDistributionBuckets, n)
+		}
+		var sum int64
+		for _, c := range got.BucketCounts {
+			sum += c
+		}
+		if sum != 300 {
+			t.Fatalf("expected 300 observations in buckets, got %d", sum)
+		}
+	})
+}
+
+func sq(x float64) float64 { return x * x }
+
+var cmpFloatApprox = cmp.Comparer(func(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(a))
+})
+
+func TestSampleBuilder_nextHistogram(t *testing.T) {
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("__name__", "metric1", "job", "job1", "instance", "instance1")
+	}
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1", "cluster", "c1")
+	metadata := testMetadataFunc(metricMetadataMap{
+		"metric1": {Type: textparse.MetricTypeHistogram},
+	})
+	// Integer histograms with a single bucket.
+	hist := func(schema int32, count uint64) *histogram.Histogram {
+		return &histogram.Histogram{
+			Schema:          schema,
+			Count:           count,
+			Sum:             float64(count),
+			PositiveSpans:   []histogram.Span{{Offset: 1, Length: 1}},
+			PositiveBuckets: []int64{int64(count)},
+		}
+	}
+	type result struct {
+		Start, End   int64
+		Count        int64
+		GrowthFactor float64
+	}
+	var got []result
+
+	for _, s := range []record.RefHistogramSample{
+		// The first sample only initializes the reset state.
+		{Ref: 1, T: 1000, H: hist(1, 2)},
+		// Lower resolution is no reset and the previous value is subtracted.
+		{Ref: 1, T: 2000, H: hist(0, 5)},
+		// Higher resolution is no reset either.
+		{Ref: 1, T: 3000, H: hist(1, 6)},
+		// The count decreased, which is a reset.
+		{Ref: 1, T: 4000, H: hist(1, 1)},
+		{Ref: 1, T: 5000, H: hist(2, 3)},
+		// Invalid schemas are discarded.
+		{Ref: 1, T: 6000, H: hist(10, 4)},
+	} {
+		b := newSampleBuilder(cache)
+		for _, hs := range b.nextHistogram(metadata, externalLabels, s) {
+			p := hs.proto.Points[0]
+			d := p.Value.GetDistributionValue()
+			got = append(got, result{
+				Start:        p.Interval.StartTime.AsTime().UnixMilli(),
+				End:          p.Interval.EndTime.AsTime().UnixMilli(),
+				Count:        d.Count,
+				GrowthFactor: d.BucketOptions.GetExponentialBuckets().GrowthFactor,
+			})
+			if want := "prometheus.googleapis.com/metric1/histogram"; hs.proto.Metric.Type != want {
+				t.Fatalf("expected metric type %q, got %q", want, hs.proto.Metric.Type)
+			}
+		}
+		b.close()
+	}
+	want := []result{
+		{Start: 1000, End: 2000, Count: 3, GrowthFactor: 2},
+		{Start: 1000, End: 3000, Count: 4, GrowthFactor: math.Sqrt2},
+		{Start: 3999, End: 4000, Count: 1, GrowthFactor: math.Sqrt2},
+		{Start: 3999, End: 5000, Count: 3, GrowthFactor: math.Pow(2, 0.25)},
+	}
+	if diff := cmp.Diff(want, got, cmpFloatApprox); diff != "" {
+		t.Fatalf("unexpected results (-want, +got): %s", diff)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+var samplesDroppedByPriority = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gcm_export_samples_dropped_by_priority_total",
+	Help: "Number of exported samples that were dropped from full shard queues by priority class of their series.",
+}, []string{"reason", "priority"})
+
+// priority is the export priority class of a series. When shard queues are full, samples
+// of higher priority series evict those of lower priority ones and are sent first.
+type priority int8
+
+// The priority classes. Series without a configured class have normal priority.
+const (
+	priorityLow    priority = -1
+	priorityNormal priority = 0
+	priorityHigh   priority = 1
+
+	// The number of priority classes.
+	priorityCount = int(priorityHigh-priorityLow) + 1
+)
+
+// index returns the position of the priority class in per-class arrays.
+func (p priority) index() int {
+	return int(p - priorityLow)
+}
+
+func (p priority) String() string {
+	switch p {
+	case priorityLow:
+		return "low"
+	case priorityHigh:
+		return "high"
+	default:
+		return "normal"
+	}
+}
+
+// parsePriority returns the priority class of the given name.
+func parsePriority(s string) (priority, error) {
+	for _, p := range []priority{priorityLow, priorityNormal, priorityHigh} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return priorityNormal, fmt.Errorf("unknown priority %q", s)
+}
+
+// priorityClass is the validated form of a PriorityClass.
+type priorityClass struct {
+	selector labels.Selector
+	priority priority
+}
+
+// dropQueued records n samples of the given priority that were dropped from shard queues.
+func dropQueued(reason string, p priority, n int) {
+	samplesDropped.WithLabelValues(reason).Add(float64(n))
+	samplesDroppedByPriority.WithLabelValues(reason, p.String()).Add(float64(n))
+}
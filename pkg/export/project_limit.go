@@ -0,0 +1,129 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+var (
+	projectSamplesThrottled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcm_export_project_samples_throttled_total",
+		Help: "Number of samples that were delayed because their project exceeded its write rate limit.",
+	}, []string{"project_id"})
+	projectSamplesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcm_export_project_samples_dropped_total",
+		Help: "Number of samples that were dropped because their project exceeded its write rate limit.",
+	}, []string{"project_id"})
+)
+
+// Policies for samples of projects that exceed their write rate limit.
+const (
+	// Keep samples buffered until the rate limit permits sending them.
+	RateLimitPolicyDelay = "delay"
+	// Drop the oldest buffered samples of the project.
+	RateLimitPolicyDropOldest = "drop-oldest"
+)
+
+// ProjectRateLimitOpts configures limits on the rate of samples written to each project.
+type ProjectRateLimitOpts struct {
+	// Samples per second permitted for projects without an explicit limit.
+	// If 0, such projects are not limited.
+	Default float64
+	// Samples per second permitted for specific projects. Overrides the default.
+	Limits map[string]float64
+	// Policy for samples of projects that exceed their limit. Defaults to
+	// RateLimitPolicyDelay if empty.
+	Policy string
+}
+
+func (o ProjectRateLimitOpts) enabled() bool {
+	return o.Default > 0 || len(o.Limits) > 0
+}
+
+func (o ProjectRateLimitOpts) validate() error {
+	switch o.Policy {
+	case RateLimitPolicyDelay, RateLimitPolicyDropOldest:
+	default:
+		return fmt.Errorf("unknown rate limit policy %q", o.Policy)
+	}
+	if o.Default < 0 {
+		return fmt.Errorf("negative default rate limit %v", o.Default)
+	}
+	for p, l := range o.Limits {
+		if l <= 0 {
+			return fmt.Errorf("rate limit for project %q must be positive, got %v", p, l)
+		}
+	}
+	return nil
+}
+
+// projectLimiter tracks the write rate of samples per project.
+type projectLimiter struct {
+	opts ProjectRateLimitOpts
+
+	mtx      sync.Mutex
+	limiters map[string]*rate.Limiter
+
+	// Number of samples that are currently delayed across all shards.
+	delayed int64
+}
+
+func newProjectLimiter(opts ProjectRateLimitOpts) *projectLimiter {
+	return &projectLimiter{
+		opts:     opts,
+		limiters: map[string]*rate.Limiter{},
+	}
+}
+
+// allow returns true if a sample can be written to the project now.
+func (l *projectLimiter) allow(projectID string) bool {
+	l.mtx.Lock()
+	lim, ok := l.limiters[projectID]
+	if !ok {
+		r, ok := l.opts.Limits[projectID]
+		if !ok {
+			r = l.opts.Default
+		}
+		if r > 0 {
+			// Permit bursts of up to one second worth of samples.
+			lim = rate.NewLimiter(rate.Limit(r), int(math.Max(r, 1)))
+		}
+		l.limiters[projectID] = lim
+	}
+	l.mtx.Unlock()
+
+	return lim == nil || lim.Allow()
+}
+
+// delay returns whether samples over the limit are delayed instead of dropped.
+func (l *projectLimiter) delay() bool {
+	return l.opts.Policy == RateLimitPolicyDelay
+}
+
+func (l *projectLimiter) addDelayed(n int) {
+	atomic.AddInt64(&l.delayed, int64(n))
+}
+
+// hasDelayed returns true if any shard holds delayed samples.
+func (l *projectLimiter) hasDelayed() bool {
+	return atomic.LoadInt64(&l.delayed) > 0
+}
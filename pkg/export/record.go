@@ -0,0 +1,244 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	timestamp_pb "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var recordFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "gcm_export_record_failures_total",
+	Help: "Number of outgoing requests that could not be recorded.",
+})
+
+// Supported formats of recorded requests.
+const (
+	// One JSON object per line with the fields "time" and "request".
+	RecordFormatJSON = "jsonl"
+	// Records prefixed with their size as a varint. Each record is a protobuf message
+	// with the send time as a google.protobuf.Timestamp in field 1 and the
+	// CreateTimeSeriesRequest in field 2.
+	RecordFormatProto = "proto"
+)
+
+// RecordedRequest is a CreateTimeSeriesRequest along with the time it was sent.
+type RecordedRequest struct {
+	Time    time.Time
+	Request *monitoring_pb.CreateTimeSeriesRequest
+}
+
+// RequestWriter writes requests to a file in one of the record formats.
+type RequestWriter struct {
+	format string
+
+	mtx sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+}
+
+// NewRequestWriter returns a writer that appends requests in the given format to the
+// file at the given path.
+func NewRequestWriter(path, format string) (*RequestWriter, error) {
+	if format != RecordFormatJSON && format != RecordFormatProto {
+		return nil, fmt.Errorf("unknown record format %q", format)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &RequestWriter{format: format, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+type jsonRecord struct {
+	Time    time.Time       `json:"time"`
+	Request json.RawMessage `json:"request"`
+}
+
+// Write a request that was sent at the given time.
+func (w *RequestWriter) Write(t time.Time, req *monitoring_pb.CreateTimeSeriesRequest) error {
+	var b []byte
+
+	switch w.format {
+	case RecordFormatJSON:
+		r, err := protojson.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		if b, err = json.Marshal(jsonRecord{Time: t, Request: r}); err != nil {
+			return fmt.Errorf("encode record: %w", err)
+		}
+		b = append(b, '\n')
+
+	case RecordFormatProto:
+		ts, err := proto.Marshal(timestamp_pb.New(t))
+		if err != nil {
+			return fmt.Errorf("encode time: %w", err)
+		}
+		r, err := proto.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("encode request: %w", err)
+		}
+		var msg []byte
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, ts)
+		msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+		msg = protowire.AppendBytes(msg, r)
+
+		b = protowire.AppendBytes(nil, msg)
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	_, err := w.w.Write(b)
+	return err
+}
+
+// Close flushes buffered records and closes the file.
+func (w *RequestWriter) Close() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if err := w.w.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+	return w.f.Close()
+}
+
+// RequestReader reads requests written by a RequestWriter.
+type RequestReader struct {
+	format string
+	r      *bufio.Reader
+}
+
+// NewRequestReader returns a reader for requests in the given format.
+func NewRequestReader(r io.Reader, format string) (*RequestReader, error) {
+	if format != RecordFormatJSON && format != RecordFormatProto {
+		return nil, fmt.Errorf("unknown record format %q", format)
+	}
+	return &RequestReader{format: format, r: bufio.NewReaderSize(r, 1<<20)}, nil
+}
+
+// Next returns the next request. It returns io.EOF once all requests were read.
+func (r *RequestReader) Next() (RecordedRequest, error) {
+	if r.format == RecordFormatJSON {
+		return r.nextJSON()
+	}
+	return r.nextProto()
+}
+
+func (r *RequestReader) nextJSON() (RecordedRequest, error) {
+	line, err := r.r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		return RecordedRequest{}, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return RecordedRequest{}, err
+	}
+	var rec jsonRecord
+	if err := json.Unmarshal(line, &rec); err != nil {
+		return RecordedRequest{}, fmt.Errorf("decode record: %w", err)
+	}
+	req := &monitoring_pb.CreateTimeSeriesRequest{}
+	if err := protojson.Unmarshal(rec.Request, req); err != nil {
+		return RecordedRequest{}, fmt.Errorf("decode request: %w", err)
+	}
+	return RecordedRequest{Time: rec.Time, Request: req}, nil
+}
+
+func (r *RequestReader) nextProto() (RecordedRequest, error) {
+	size, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return RecordedRequest{}, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r.r, msg); err != nil {
+		return RecordedRequest{}, io.ErrUnexpectedEOF
+	}
+	var rec RecordedRequest
+
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return RecordedRequest{}, protowire.ParseError(n)
+		}
+		if typ != protowire.BytesType {
+			return RecordedRequest{}, fmt.Errorf("unexpected wire type %d for field %d", typ, num)
+		}
+		b, m := protowire.ConsumeBytes(msg[n:])
+		if m < 0 {
+			return RecordedRequest{}, protowire.ParseError(m)
+		}
+		msg = msg[n+m:]
+
+		switch num {
+		case 1:
+			var ts timestamp_pb.Timestamp
+			if err := proto.Unmarshal(b, &ts); err != nil {
+				return RecordedRequest{}, fmt.Errorf("decode time: %w", err)
+			}
+			rec.Time = ts.AsTime()
+		case 2:
+			rec.Request = &monitoring_pb.CreateTimeSeriesRequest{}
+			if err := proto.Unmarshal(b, rec.Request); err != nil {
+				return RecordedRequest{}, fmt.Errorf("decode request: %w", err)
+			}
+		}
+	}
+	if rec.Request == nil {
+		return RecordedRequest{}, errors.New("record without request")
+	}
+	return rec, nil
+}
+
+// recordingSink records all requests before passing them on to the underlying sink.
+type recordingSink struct {
+	Sink
+	w *RequestWriter
+}
+
+func (s *recordingSink) Send(ctx context.Context, projectID string, series []*monitoring_pb.TimeSeries) error {
+	err := s.w.Write(time.Now(), &monitoring_pb.CreateTimeSeriesRequest{
+		Name:       fmt.Sprintf("projects/%s", projectID),
+		TimeSeries: series,
+	})
+	if err != nil {
+		recordFailures.Inc()
+	}
+	return s.Sink.Send(ctx, projectID, series)
+}
+
+func (s *recordingSink) Close() error {
+	err := s.Sink.Close()
+	if werr := s.w.Close(); err == nil {
+		err = werr
+	}
+	return err
+}
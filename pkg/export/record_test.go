@@ -0,0 +1,90 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestRecordingSink(t *testing.T) {
+	for _, format := range []string{RecordFormatJSON, RecordFormatProto} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "requests")
+
+			w, err := NewRequestWriter(path, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			memSink := NewMemorySink()
+			sink := &recordingSink{Sink: memSink, w: w}
+
+			var want []*monitoring_pb.CreateTimeSeriesRequest
+			for i := 0; i < 10; i++ {
+				series := []*monitoring_pb.TimeSeries{testWALSeries(i).proto, testWALSeries(i + 100).proto}
+				if err := sink.Send(context.Background(), "p1", series); err != nil {
+					t.Fatal(err)
+				}
+				want = append(want, &monitoring_pb.CreateTimeSeriesRequest{Name: "projects/p1", TimeSeries: series})
+			}
+			if err := sink.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// Requests are still passed on to the underlying sink.
+			if got := len(memSink.Series("p1")); got != 20 {
+				t.Fatalf("expected 20 series in underlying sink, got %d", got)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+
+			r, err := NewRequestReader(f, format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var (
+				got  []*monitoring_pb.CreateTimeSeriesRequest
+				last time.Time
+			)
+			for {
+				rec, err := r.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				if rec.Time.Before(last) {
+					t.Fatalf("record time %s before previous record time %s", rec.Time, last)
+				}
+				last = rec.Time
+				got = append(got, rec.Request)
+			}
+			if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+				t.Fatalf("unexpected requests (-want, +got): %s", diff)
+			}
+		})
+	}
+}
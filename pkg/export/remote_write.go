@@ -0,0 +1,260 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	remoteWriteSamplesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_remote_write_samples_sent_total",
+		Help: "Number of samples successfully sent to the remote write endpoint.",
+	})
+	remoteWriteSamplesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcm_export_remote_write_samples_dropped_total",
+		Help: "Number of samples that were not sent to the remote write endpoint.",
+	}, []string{"reason"})
+	remoteWriteRetries = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_remote_write_retries_total",
+		Help: "Number of retried requests to the remote write endpoint.",
+	})
+	remoteWriteQueueLength = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcm_export_remote_write_queue_length",
+		Help: "Number of samples queued for the remote write endpoint.",
+	})
+	remoteWriteRequestDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "gcm_export_remote_write_request_duration_seconds",
+		Help:    "Duration of requests to the remote write endpoint.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+const (
+	// DefaultRemoteWriteQueueSize is the default number of samples buffered for the
+	// remote write endpoint.
+	DefaultRemoteWriteQueueSize = 100000
+	// DefaultRemoteWriteBatchSize is the default maximum number of samples in a remote write request.
+	DefaultRemoteWriteBatchSize = 2000
+
+	// Time after which a partial batch is sent to the remote write endpoint.
+	remoteWriteBatchDelayMax = time.Second
+	// Timeout of a single remote write request.
+	remoteWriteTimeout = 30 * time.Second
+	// Maximum number of attempts for a remote write request.
+	remoteWriteMaxAttempts = 5
+)
+
+// RemoteWriteOpts configures an additional Prometheus remote write destination
+// for exported samples.
+type RemoteWriteOpts struct {
+	// URL of the remote write endpoint. Remote write is disabled if empty.
+	URL string
+	// Number of samples buffered for the endpoint. Once the buffer is full, further
+	// samples are dropped for the endpoint. Defaults to DefaultRemoteWriteQueueSize when 0.
+	QueueSize uint
+	// Maximum number of samples per request. Defaults to DefaultRemoteWriteBatchSize when 0.
+	BatchSize uint
+}
+
+type remoteWriteSample struct {
+	lset labels.Labels
+	t    int64
+	v    float64
+}
+
+// remoteWriter sends samples to a Prometheus remote write endpoint. It has its own queue,
+// which drops data when full, so that a slow endpoint never blocks exporting to GCM.
+type remoteWriter struct {
+	logger    log.Logger
+	client    *http.Client
+	url       string
+	userAgent string
+	batchSize int
+
+	queue chan remoteWriteSample
+}
+
+func newRemoteWriter(logger log.Logger, opts RemoteWriteOpts, userAgent string) *remoteWriter {
+	if opts.QueueSize == 0 {
+		opts.QueueSize = DefaultRemoteWriteQueueSize
+	}
+	if opts.BatchSize == 0 {
+		opts.BatchSize = DefaultRemoteWriteBatchSize
+	}
+	return &remoteWriter{
+		logger:    logger,
+		client:    &http.Client{Timeout: remoteWriteTimeout},
+		url:       opts.URL,
+		userAgent: userAgent,
+		batchSize: int(opts.BatchSize),
+		queue:     make(chan remoteWriteSample, opts.QueueSize),
+	}
+}
+
+// enqueue adds a sample for the series with the given labels without blocking.
+func (w *remoteWriter) enqueue(lset labels.Labels, t int64, v float64) {
+	select {
+	case w.queue <- remoteWriteSample{lset: lset, t: t, v: v}:
+	default:
+		remoteWriteSamplesDropped.WithLabelValues("queue-full").Inc()
+	}
+}
+
+// run sends queued samples until the context is cancelled.
+func (w *remoteWriter) run(ctx context.Context) {
+	timer := time.NewTimer(remoteWriteBatchDelayMax)
+	defer timer.Stop()
+
+	batch := make([]remoteWriteSample, 0, w.batchSize)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case s := <-w.queue:
+			batch = append(batch, s)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-timer.C:
+			timer.Reset(remoteWriteBatchDelayMax)
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		remoteWriteQueueLength.Set(float64(len(w.queue)))
+
+		w.send(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// send the samples to the endpoint and retry with backoff on recoverable errors.
+func (w *remoteWriter) send(ctx context.Context, samples []remoteWriteSample) {
+	b, err := buildWriteRequest(samples).Marshal()
+	if err != nil {
+		level.Error(w.logger).Log("msg", "encoding remote write request failed", "err", err)
+		remoteWriteSamplesDropped.WithLabelValues("encoding-failed").Add(float64(len(samples)))
+		return
+	}
+	body := snappy.Encode(nil, b)
+	backoff := retryBackoffBase
+
+	for attempt := 1; ; attempt++ {
+		recoverable, err := w.sendOnce(ctx, body)
+		if err == nil {
+			remoteWriteSamplesSent.Add(float64(len(samples)))
+			return
+		}
+		if !recoverable || attempt == remoteWriteMaxAttempts {
+			level.Error(w.logger).Log("msg", "remote write failed", "size", len(samples), "attempts", attempt, "err", err)
+			reason := "send-error"
+			if recoverable {
+				reason = "retries-exhausted"
+			}
+			remoteWriteSamplesDropped.WithLabelValues(reason).Add(float64(len(samples)))
+			return
+		}
+		remoteWriteRetries.Inc()
+
+		select {
+		case <-ctx.Done():
+			remoteWriteSamplesDropped.WithLabelValues("shutdown").Add(float64(len(samples)))
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > retryBackoffMax {
+			backoff = retryBackoffMax
+		}
+	}
+}
+
+// sendOnce sends the encoded request. It returns whether a failed request may succeed
+// when sent again.
+func (w *remoteWriter) sendOnce(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", w.userAgent)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	start := time.Now()
+	resp, err := w.client.Do(req)
+	remoteWriteRequestDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body)
+		return false, nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(msg))
+
+	// Server errors and rate limiting are recoverable, other client errors are not.
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// buildWriteRequest builds a Prometheus remote write request from the samples. Samples of
+// the same series are grouped into a single time series in their original order.
+func buildWriteRequest(samples []remoteWriteSample) *prompb.WriteRequest {
+	var (
+		req = &prompb.WriteRequest{}
+		// Indices of the time series in the request by label set hash.
+		index = map[uint64][]int{}
+		lsets []labels.Labels
+	)
+	for _, s := range samples {
+		h := s.lset.Hash()
+		i := -1
+		for _, j := range index[h] {
+			if labels.Equal(lsets[j], s.lset) {
+				i = j
+				break
+			}
+		}
+		if i < 0 {
+			i = len(req.Timeseries)
+			index[h] = append(index[h], i)
+			lsets = append(lsets, s.lset)
+
+			ts := prompb.TimeSeries{Labels: make([]prompb.Label, 0, len(s.lset))}
+			for _, l := range s.lset {
+				ts.Labels = append(ts.Labels, prompb.Label{Name: l.Name, Value: l.Value})
+			}
+			req.Timeseries = append(req.Timeseries, ts)
+		}
+		req.Timeseries[i].Samples = append(req.Timeseries[i].Samples, prompb.Sample{Value: s.v, Timestamp: s.t})
+	}
+	return req
+}
@@ -0,0 +1,183 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/golang/snappy"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/record"
+)
+
+// decodeWriteRequest decodes a remote write request into its samples.
+func decodeWriteRequest(b []byte) ([]remoteWriteSample, error) {
+	var req prompb.WriteRequest
+	if err := req.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	var result []remoteWriteSample
+
+	for _, ts := range req.Timeseries {
+		var lset labels.Labels
+		for _, l := range ts.Labels {
+			lset = append(lset, labels.Label{Name: l.Name, Value: l.Value})
+		}
+		for _, s := range ts.Samples {
+			result = append(result, remoteWriteSample{lset: lset, t: s.Timestamp, v: s.Value})
+		}
+	}
+	return result, nil
+}
+
+type testRemoteWriteServer struct {
+	mtx     sync.Mutex
+	samples []remoteWriteSample
+	// Number of requests to fail with a server error before accepting.
+	failures int
+}
+
+func (s *testRemoteWriteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.failures > 0 {
+		s.failures--
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "snappy" {
+		http.Error(w, "unexpected encoding", http.StatusBadRequest)
+		return
+	}
+	compressed, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	samples, err := decodeWriteRequest(b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.samples = append(s.samples, samples...)
+}
+
+func (s *testRemoteWriteServer) received() []remoteWriteSample {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]remoteWriteSample(nil), s.samples...)
+}
+
+func TestExporter_remoteWrite(t *testing.T) {
+	rwServer := &testRemoteWriteServer{failures: 1}
+	srv := httptest.NewServer(rwServer)
+	defer srv.Close()
+
+	e, err := New(log.NewJSONLogger(log.NewSyncWriter(os.Stderr)), nil, ExporterOpts{
+		Sink:        NewMemorySink(),
+		RemoteWrite: RemoteWriteOpts{URL: srv.URL},
+	})
+	if err != nil {
+		t.Fatalf("Creating Exporter failed: %s", err)
+	}
+	e.externalLabels = labels.FromStrings("cluster", "c1", "location", "l1")
+
+	e.SetLabelsByIDFunc(func(i storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("__name__", "metric", "project_id", "p1", "location", "test")
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go e.Run(ctx)
+
+	for i := 0; i < 10; i++ {
+		e.Export(nil, []record.RefSample{
+			{Ref: 1, T: int64(i), V: float64(i)},
+		}, nil)
+	}
+	// The first request fails and is retried after a backoff.
+	deadline := time.Now().Add(10 * time.Second)
+	for len(rwServer.received()) < 10 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	var want []remoteWriteSample
+	for i := 0; i < 10; i++ {
+		want = append(want, remoteWriteSample{
+			// Series labels take precedence over external labels.
+			lset: labels.FromStrings("__name__", "metric", "cluster", "c1", "location", "test", "project_id", "p1"),
+			t:    int64(i),
+			v:    float64(i),
+		})
+	}
+	if diff := cmp.Diff(want, rwServer.received(), cmp.AllowUnexported(remoteWriteSample{})); diff != "" {
+		t.Fatalf("unexpected samples (-want, +got): %s", diff)
+	}
+}
+
+func TestRemoteWriter_queueFull(t *testing.T) {
+	w := newRemoteWriter(nil, RemoteWriteOpts{URL: "http://localhost", QueueSize: 5}, "test")
+
+	// Without a running sender, enqueueing must not block once the queue is full.
+	for i := 0; i < 10; i++ {
+		w.enqueue(labels.FromStrings("a", "b"), int64(i), float64(i))
+	}
+	if got := len(w.queue); got != 5 {
+		t.Fatalf("expected 5 queued samples, got %d", got)
+	}
+}
+
+func TestBuildWriteRequest(t *testing.T) {
+	a := labels.FromStrings("__name__", "a")
+	b := labels.FromStrings("__name__", "b")
+
+	req := buildWriteRequest([]remoteWriteSample{
+		{lset: a, t: 1, v: 1},
+		{lset: b, t: 1, v: 10},
+		{lset: a, t: 2, v: 2},
+	})
+	want := &prompb.WriteRequest{
+		Timeseries: []prompb.TimeSeries{
+			{
+				Labels:  []prompb.Label{{Name: "__name__", Value: "a"}},
+				Samples: []prompb.Sample{{Value: 1, Timestamp: 1}, {Value: 2, Timestamp: 2}},
+			}, {
+				Labels:  []prompb.Label{{Name: "__name__", Value: "b"}},
+				Samples: []prompb.Sample{{Value: 10, Timestamp: 1}},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, req); diff != "" {
+		t.Fatalf("unexpected request (-want, +got): %s", diff)
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"time"
+
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+var (
+	resetStateRestored = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_reset_state_restored_total",
+		Help: "Number of series whose counter reset state was restored from the checkpoint.",
+	})
+	resetStateDiscarded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "gcm_export_reset_state_discarded_total",
+		Help: "Number of checkpointed counter reset states that were not restored.",
+	}, []string{"reason"})
+)
+
+const (
+	// Interval at which the counter reset state is checkpointed.
+	resetStateCheckpointInterval = time.Minute
+	// Maximum age of the last sample of a checkpointed series for its reset state to be restored.
+	resetStateMaxAge = time.Hour
+	// Size of an encoded reset state record.
+	resetStateRecordSize = 40
+)
+
+// resetState is the counter reset state of a series that is checkpointed to disk.
+type resetState struct {
+	// Hash of the series labels without external labels.
+	hash           uint64
+	resetTimestamp int64
+	resetValue     float64
+	lastTimestamp  int64
+	lastValue      float64
+}
+
+// valid returns false if the state must not be used for a sample with timestamp t.
+// The reset timestamp must be within the time range of the currently held lease as
+// another replica may have written the series in the meantime otherwise.
+func (s resetState) valid(leaseStart, t int64) (string, bool) {
+	if s.resetTimestamp < leaseStart {
+		return "out-of-lease-range", false
+	}
+	if t-s.lastTimestamp > resetStateMaxAge.Milliseconds() {
+		return "stale", false
+	}
+	return "", true
+}
+
+// writeResetStateFile atomically replaces the file with the given states. The records
+// are followed by a CRC32 checksum.
+func writeResetStateFile(filename string, states []resetState) error {
+	buf := make([]byte, len(states)*resetStateRecordSize+4)
+
+	for i, s := range states {
+		b := buf[i*resetStateRecordSize:]
+		binary.LittleEndian.PutUint64(b[0:], s.hash)
+		binary.LittleEndian.PutUint64(b[8:], uint64(s.resetTimestamp))
+		binary.LittleEndian.PutUint64(b[16:], math.Float64bits(s.resetValue))
+		binary.LittleEndian.PutUint64(b[24:], uint64(s.lastTimestamp))
+		binary.LittleEndian.PutUint64(b[32:], math.Float64bits(s.lastValue))
+	}
+	n := len(buf) - 4
+	binary.LittleEndian.PutUint32(buf[n:], crc32.Checksum(buf[:n], walCastagnoli))
+
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// readResetStateFile reads the states written by writeResetStateFile. It returns no
+// states if the file does not exist.
+func readResetStateFile(filename string) (map[uint64]resetState, error) {
+	buf, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 4 || (len(buf)-4)%resetStateRecordSize != 0 {
+		return nil, fmt.Errorf("invalid size %d", len(buf))
+	}
+	data, sum := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	if crc32.Checksum(data, walCastagnoli) != sum {
+		return nil, errors.New("checksum mismatch")
+	}
+	states := make(map[uint64]resetState, len(data)/resetStateRecordSize)
+
+	for ; len(data) > 0; data = data[resetStateRecordSize:] {
+		s := resetState{
+			hash:           binary.LittleEndian.Uint64(data[0:]),
+			resetTimestamp: int64(binary.LittleEndian.Uint64(data[8:])),
+			resetValue:     math.Float64frombits(binary.LittleEndian.Uint64(data[16:])),
+			lastTimestamp:  int64(binary.LittleEndian.Uint64(data[24:])),
+			lastValue:      math.Float64frombits(binary.LittleEndian.Uint64(data[32:])),
+		}
+		states[s.hash] = s
+	}
+	return states, nil
+}
+
+// restoreResetStates makes the given checkpointed states available to series that have
+// no reset state yet.
+func (c *seriesCache) restoreResetStates(states map[uint64]resetState) {
+	c.resetMtx.Lock()
+	defer c.resetMtx.Unlock()
+
+	c.restored = states
+}
+
+// setLeaseStart sets the start of the currently held lease against which restored
+// reset states are validated.
+func (c *seriesCache) setLeaseStart(t time.Time) {
+	c.resetMtx.Lock()
+	defer c.resetMtx.Unlock()
+
+	c.leaseStart = t.UnixMilli()
+}
+
+// takeRestoredResetState removes and returns the restored reset state for the series
+// if there is a valid one for a sample with timestamp t.
+func (c *seriesCache) takeRestoredResetState(lset labels.Labels, t int64) (resetState, bool) {
+	c.resetMtx.Lock()
+	defer c.resetMtx.Unlock()
+
+	if len(c.restored) == 0 || lset == nil {
+		return resetState{}, false
+	}
+	h := lset.Hash()
+	s, ok := c.restored[h]
+	if !ok {
+		return resetState{}, false
+	}
+	delete(c.restored, h)
+
+	if reason, ok := s.valid(c.leaseStart, t); !ok {
+		resetStateDiscarded.WithLabelValues(reason).Inc()
+		return resetState{}, false
+	}
+	resetStateRestored.Inc()
+	return s, true
+}
+
+// resetStates returns the counter reset states of all cached series along with restored
+// states that were not used yet and are not stale.
+func (c *seriesCache) resetStates() []resetState {
+	var res []resetState
+
+	c.forEach(func(_ storage.SeriesRef, e *seriesCacheEntry) {
+		if !e.hasReset || e.dropped || e.lset == nil || e.lastHistogram != nil {
+			return
+		}
+		res = append(res, resetState{
+			hash:           e.lset.Hash(),
+			resetTimestamp: e.resetTimestamp,
+			resetValue:     e.resetValue,
+			lastTimestamp:  e.lastTimestamp,
+			lastValue:      e.lastValue,
+		})
+	})
+	minTimestamp := c.now().Add(-resetStateMaxAge).UnixMilli()
+
+	c.resetMtx.Lock()
+	for h, s := range c.restored {
+		if s.lastTimestamp < minTimestamp {
+			delete(c.restored, h)
+			continue
+		}
+		res = append(res, s)
+	}
+	c.resetMtx.Unlock()
+
+	return res
+}
+
+// runResetStateCheckpoint periodically checkpoints the counter reset state until
+// the context is canceled.
+func (e *Exporter) runResetStateCheckpoint(ctx context.Context) {
+	tick := time.NewTicker(resetStateCheckpointInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			e.checkpointResetState()
+		}
+	}
+}
+
+// checkpointResetState writes the current counter reset state to disk.
+func (e *Exporter) checkpointResetState() {
+	e.resetStateMtx.Lock()
+	defer e.resetStateMtx.Unlock()
+
+	if err := writeResetStateFile(e.opts.ResetStateFile, e.seriesCache.resetStates()); err != nil {
+		level.Error(e.logger).Log("msg", "checkpointing counter reset state failed", "err", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+	"github.com/prometheus/prometheus/tsdb/record"
+)
+
+func TestResetStateFile(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "reset_state")
+
+	// A missing file has no states.
+	if states, err := readResetStateFile(fn); err != nil || states != nil {
+		t.Fatalf("expected no states and no error, got %v, %v", states, err)
+	}
+	in := []resetState{
+		{hash: 1, resetTimestamp: 1000, resetValue: 2.5, lastTimestamp: 3000, lastValue: 10},
+		{hash: 2, resetTimestamp: -1, resetValue: 0, lastTimestamp: 5000, lastValue: 1e9},
+	}
+	if err := writeResetStateFile(fn, in); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readResetStateFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint64]resetState{1: in[0], 2: in[1]}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(resetState{})); diff != "" {
+		t.Fatalf("unexpected states (-want, +got): %s", diff)
+	}
+
+	// Corrupted files are rejected.
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[3] ^= 0xff
+	if err := os.WriteFile(fn, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readResetStateFile(fn); err == nil {
+		t.Fatal("expected error for corrupted file")
+	}
+}
+
+func TestSeriesCache_restoreResetState(t *testing.T) {
+	lsets := map[storage.SeriesRef]labels.Labels{
+		1: labels.FromStrings("__name__", "metric1_total", "job", "j1"),
+		2: labels.FromStrings("__name__", "metric1_total", "job", "j2"),
+		3: labels.FromStrings("__name__", "metric1_total", "job", "j3"),
+		4: labels.FromStrings("__name__", "metric1_total", "job", "j4"),
+	}
+	newCache := func(states map[uint64]resetState) *seriesCache {
+		cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+		cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels { return lsets[ref] }
+		cache.now = func() time.Time { return time.UnixMilli(4000) }
+		cache.restoreResetStates(states)
+		cache.setLeaseStart(time.UnixMilli(1000))
+		return cache
+	}
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1")
+	metadata := testMetadataFunc(metricMetadataMap{
+		"metric1_total": {Type: textparse.MetricTypeCounter},
+	})
+
+	before := newCache(nil)
+	type result struct {
+		Reset int64
+		Value float64
+		Ok    bool
+	}
+	adjust := func(cache *seriesCache, ref storage.SeriesRef, ts int64, v float64) result {
+		if _, ok := cache.get(record.RefSample{Ref: chunks.HeadSeriesRef(ref), T: ts}, externalLabels, metadata); !ok {
+			t.Fatalf("series %d not found", ref)
+		}
+		reset, value, ok := cache.getResetAdjusted(ref, ts, v)
+		return result{reset, value, ok}
+	}
+	for ref := range lsets {
+		adjust(before, ref, 2000, 5)
+		adjust(before, ref, 3000, 8)
+	}
+	states := map[uint64]resetState{}
+	for _, s := range before.resetStates() {
+		states[s.hash] = s
+	}
+	// Series 3 was reset before the currently held lease and series 4 was last seen
+	// too long ago.
+	s3 := lsets[3].Hash()
+	s := states[s3]
+	s.resetTimestamp = 500
+	states[s3] = s
+	s4 := lsets[4].Hash()
+	s = states[s4]
+	s.lastTimestamp = 3000 - resetStateMaxAge.Milliseconds() - 1
+	states[s4] = s
+
+	// States of series that were not seen since the restart are kept until they are stale.
+	states[100] = resetState{hash: 100, resetTimestamp: 2000, lastTimestamp: 3000}
+	states[101] = resetState{hash: 101, resetTimestamp: 2000, lastTimestamp: 4000 - resetStateMaxAge.Milliseconds() - 1}
+
+	after := newCache(states)
+
+	got := []result{
+		// The restored state is continued.
+		adjust(after, 1, 4000, 10),
+		// Samples that were already processed are dropped.
+		adjust(after, 2, 3000, 8),
+		adjust(after, 2, 4000, 9),
+		// Invalid states are not restored and the first sample initializes the state.
+		adjust(after, 3, 4000, 10),
+		adjust(after, 4, 4000, 10),
+	}
+	want := []result{
+		{Reset: 2000, Value: 5, Ok: true},
+		{},
+		{Reset: 2000, Value: 4, Ok: true},
+		{},
+		{},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected results (-want, +got): %s", diff)
+	}
+	if states := after.resetStates(); len(states) != 5 {
+		t.Fatalf("expected 5 states, got %d", len(states))
+	}
+}
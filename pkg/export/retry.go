@@ -0,0 +1,152 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	samplesRetried = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_samples_retried_total",
+		Help: "Number of samples that were enqueued again after a retriable send error.",
+	})
+	retryBudgetTokens = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcm_export_retry_budget_tokens",
+		Help: "Number of samples that can currently be retried.",
+	})
+)
+
+const (
+	// DefaultRetryMaxAttempts is the default number of times a sample is retried.
+	DefaultRetryMaxAttempts = 5
+	// DefaultRetryBudgetRatio is the default number of retries that are permitted per
+	// successfully sent sample.
+	DefaultRetryBudgetRatio = 0.1
+
+	// Number of retries the budget can accumulate. It allows bursts of retries after
+	// a period without errors.
+	retryBudgetBurst = 10 * BatchSizeMax
+	// Bounds of the exponential backoff before a sample is enqueued again.
+	retryBackoffBase = 100 * time.Millisecond
+	retryBackoffMax  = 5 * time.Second
+)
+
+// RetryOpts configures retries of samples for which sending to the GCM API failed.
+type RetryOpts struct {
+	// Disable retries entirely.
+	Disable bool
+	// Maximum number of times a sample is retried. Defaults to DefaultRetryMaxAttempts
+	// when 0.
+	MaxAttempts uint
+	// Number of retries that are permitted per successfully sent sample. This bounds
+	// the backlog retries can produce during prolonged outages. Defaults to
+	// DefaultRetryBudgetRatio when 0.
+	BudgetRatio float64
+}
+
+// retrier decides which samples of a failed request are retried.
+type retrier struct {
+	maxAttempts uint
+	ratio       float64
+
+	mtx    sync.Mutex
+	tokens float64
+}
+
+func newRetrier(opts RetryOpts) *retrier {
+	retryBudgetTokens.Set(retryBudgetBurst)
+	return &retrier{
+		maxAttempts: opts.MaxAttempts,
+		ratio:       opts.BudgetRatio,
+		tokens:      retryBudgetBurst,
+	}
+}
+
+// deposit adds to the budget for n successfully sent samples.
+func (r *retrier) deposit(n int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.tokens += float64(n) * r.ratio
+	if r.tokens > retryBudgetBurst {
+		r.tokens = retryBudgetBurst
+	}
+	retryBudgetTokens.Set(r.tokens)
+}
+
+// withdraw takes up to n retries from the budget and returns how many were granted.
+func (r *retrier) withdraw(n int) int {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if float64(n) > r.tokens {
+		n = int(r.tokens)
+	}
+	r.tokens -= float64(n)
+	retryBudgetTokens.Set(r.tokens)
+
+	return n
+}
+
+// backoff returns how long to wait before enqueueing a sample for the given attempt again.
+func (r *retrier) backoff(attempt uint) time.Duration {
+	d := retryBackoffBase
+	for i := uint(1); i < attempt && d < retryBackoffMax; i++ {
+		d *= 2
+	}
+	if d > retryBackoffMax {
+		d = retryBackoffMax
+	}
+	return d
+}
+
+// isRetriable returns true if a request that failed with the given code may succeed
+// when sent again.
+func isRetriable(code codes.Code) bool {
+	switch code {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// sendErrorReason returns the label value for samples dropped due to a send error with
+// the given code.
+func sendErrorReason(code codes.Code) string {
+	return fmt.Sprintf("send-error-%s", code)
+}
+
+// parseSendError returns the gRPC code of the error and, if the request was
+// partially successful, the summary of which points were written.
+func parseSendError(err error) (codes.Code, *monitoring_pb.CreateTimeSeriesSummary) {
+	st, ok := status.FromError(err)
+	if !ok {
+		return codes.Unknown, nil
+	}
+	for _, d := range st.Details() {
+		if summary, ok := d.(*monitoring_pb.CreateTimeSeriesSummary); ok {
+			return st.Code(), summary
+		}
+	}
+	return st.Code(), nil
+}
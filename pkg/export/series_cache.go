@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"hash"
 	"hash/fnv"
+	"math"
 	"math/rand"
 	"strings"
 	"sync"
@@ -29,7 +30,9 @@ import (
 	"github.com/go-kit/log"
 	"github.com/go-kit/log/level"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/histogram"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/model/textparse"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb/record"
@@ -47,23 +50,100 @@ type seriesCache struct {
 	now    func() time.Time
 	pool   *pool
 
-	// Guards access to the entries and intervals maps and the lastRefresh
-	// field of individual cache entries.
-	mtx sync.Mutex
-	// Map from series reference to various cached information about it.
-	entries map[storage.SeriesRef]*seriesCacheEntry
+	// Cache entries split into independently locked stripes by series reference,
+	// so that concurrent lookups and garbage collection rarely contend.
+	stripes [seriesCacheStripes]seriesCacheStripe
 
 	// Function to retrieve a label set for a series reference number.
 	// Returns nil if the reference is no longer valid.
 	getLabelsByRef func(storage.SeriesRef) labels.Labels
 
+	// Guards the matchers, relabeling rules, and resource mappings. It must not be
+	// acquired before a stripe lock is released.
+	cfgMtx sync.RWMutex
+
 	// A list of metric selectors. Exported Prometheus are discarded if they
 	// don't match at least one of the matchers.
-	// If the matchers are empty, all series pass.
+	// If the matchers are empty, all series pass. They may be changed at
+	// runtime through setMatchers.
 	matchers Matchers
 
 	// Prefix under which metrics are written to GCM.
 	metricTypePrefix string
+
+	// Relabeling rules applied to series labels before they are converted. They
+	// may be changed at runtime through setRelabelConfigs.
+	relabelConfigs []*relabel.Config
+
+	// Limits the number of exported series per metric. Nil if there is no limit.
+	budget *cardinalityBudget
+
+	// Configured mappings to monitored resources. Series without a matching
+	// mapping are written as prometheus_target.
+	resourceMappings []*resourceMapping
+	exportIntervals  []*exportInterval
+	aggregationRules []*aggregationRule
+	priorityClasses  []*priorityClass
+	// Handling of series exceeding GCM limits.
+	limits *gcmLimits
+
+	// Aggregates of series matching an aggregation rule.
+	aggregator *aggregator
+
+	// Creates metric descriptors for populated series. Nil if disabled.
+	descriptors *descriptorManager
+
+	// Guards the restored counter reset states, the creation timestamps, and the lease start.
+	resetMtx sync.Mutex
+	// Counter reset states restored from a checkpoint by series label hash. They are
+	// removed once used by a series.
+	restored map[uint64]resetState
+	// Millisecond creation timestamps exposed through _created series by the key
+	// of the series they apply to. See createdKey.
+	created map[uint64]int64
+	// Start of the currently held lease in milliseconds. Restored states and creation
+	// timestamps before it are invalid.
+	leaseStart int64
+}
+
+// Number of stripes of the series cache. Must be a power of two.
+const seriesCacheStripes = 128
+
+type seriesCacheStripe struct {
+	// Guards access to the entries map and the fields of its entries.
+	mtx sync.Mutex
+	// Map from series reference to various cached information about it.
+	entries map[storage.SeriesRef]*seriesCacheEntry
+}
+
+// stripe returns the stripe holding the entry for the series reference.
+func (c *seriesCache) stripe(ref storage.SeriesRef) *seriesCacheStripe {
+	return &c.stripes[uint64(ref)&(seriesCacheStripes-1)]
+}
+
+// len returns the number of cached entries.
+func (c *seriesCache) len() int {
+	n := 0
+	for i := range c.stripes {
+		s := &c.stripes[i]
+		s.mtx.Lock()
+		n += len(s.entries)
+		s.mtx.Unlock()
+	}
+	return n
+}
+
+// forEach calls f for every cache entry while holding the lock of its stripe.
+// Stripes are locked one at a time.
+func (c *seriesCache) forEach(f func(ref storage.SeriesRef, e *seriesCacheEntry)) {
+	for i := range c.stripes {
+		s := &c.stripes[i]
+		s.mtx.Lock()
+		for ref, e := range s.entries {
+			f(ref, e)
+		}
+		s.mtx.Unlock()
+	}
 }
 
 type seriesCacheEntry struct {
@@ -78,23 +158,73 @@ type seriesCacheEntry struct {
 	protos cachedProtos
 	// The well-known Prometheus metric name suffix if any.
 	suffix metricSuffix
+	// Whether the series holds the creation timestamps of other series of its metric,
+	// in which case it is not exported itself.
+	created bool
+	// Key under which the creation timestamp of the series is tracked. Zero if the
+	// series is not a cumulative of a metric type that may have creation timestamps.
+	createdKey uint64
 	// Timestamp after which to refresh the cached state.
 	nextRefresh int64
 	// Unix timestamp at which the we last used the entry.
 	lastUsed int64
 	// Whether the series is dropped from exporting.
 	dropped bool
+	// Whether the series was dropped by relabeling rules rather than matchers.
+	relabelDropped bool
+	// Whether the series was dropped for exceeding the cardinality limit of its metric.
+	limitDropped bool
+	// Whether the series exceeds GCM limits and its samples are dropped. The series is
+	// not marked as dropped so that it is refreshed as the limits configuration changes.
+	gcmLimitsExceeded bool
+	// The GCM limits the series exceeded when it was last populated. Each violation is
+	// counted once while it persists.
+	limitViolations []string
+	// Key under which the series is counted against the cardinality limit. Empty if
+	// the series is not counted.
+	budgetKey string
+	// Group of the series within its budget key.
+	budgetGroup uint64
+	// The aggregation rule whose aggregate the series is merged into. Nil if the series
+	// is exported as is.
+	aggregation *aggregationRule
+	// Minimum interval in milliseconds between exported points of the series and the
+	// timestamp of the last exported point.
+	exportInterval int64
+	lastExported   int64
+	// The export priority class of the series.
+	priority priority
 
 	// Tracked counter reset state for conversion to GCM cumulatives.
 	hasReset       bool
 	resetValue     float64
 	lastValue      float64
+	lastTimestamp  int64
 	resetTimestamp int64
+	// Tracked reset state of native histograms. The reset histogram is nil if the
+	// series was reset after it was first seen.
+	resetHistogram *histogram.FloatHistogram
+	lastHistogram  *histogram.FloatHistogram
 }
 
 type hashedSeries struct {
 	hash  uint64
 	proto *monitoring_pb.TimeSeries
+	// The export priority class of the series. It is not part of the hash.
+	priority priority
+}
+
+// seriesWithoutPoints returns a new series with the fields of s except for its points.
+// Unlike copying the proto struct, it does not copy the internal message state.
+func seriesWithoutPoints(s *monitoring_pb.TimeSeries) *monitoring_pb.TimeSeries {
+	return &monitoring_pb.TimeSeries{
+		Metric:     s.Metric,
+		Resource:   s.Resource,
+		Metadata:   s.Metadata,
+		MetricKind: s.MetricKind,
+		ValueType:  s.ValueType,
+		Unit:       s.Unit,
+	}
 }
 
 type cachedProtos struct {
@@ -112,15 +242,25 @@ const (
 
 // valid returns true if the Prometheus series can be converted to a GCM series.
 func (e *seriesCacheEntry) valid() bool {
-	return e.lset != nil && (e.dropped || !e.protos.empty())
+	return e.lset != nil && (e.dropped || e.created || e.gcmLimitsExceeded || !e.protos.empty())
 }
 
 // shouldRefresh returns true if the cached state should be refreshed.
 func (e *seriesCacheEntry) shouldRefresh() bool {
-	// Matchers cannot be changed at runtime and are applied to the local time series labels
-	// without external labels. Thus the dropped status can never change at runtime and thus
+	// Matchers are applied to the local time series labels without external labels. Thus the
+	// dropped status only changes if the matchers change, which is handled by setMatchers, and
 	// no refresh is required.
-	return !e.dropped && time.Now().Unix() > e.nextRefresh
+	// Series dropped for exceeding the cardinality limit are refreshed to check whether
+	// the limit admits them again.
+	return (!e.dropped || e.limitDropped) && time.Now().Unix() > e.nextRefresh
+}
+
+// clearResetState discards the counter reset state. It must be cleared for series that
+// are exported again after being dropped as they may have been reset in the meantime.
+func (e *seriesCacheEntry) clearResetState() {
+	e.hasReset = false
+	e.resetHistogram = nil
+	e.lastHistogram = nil
 }
 
 // setNextRefresh determines a timestamp for the next refresh.
@@ -141,14 +281,20 @@ func newSeriesCache(
 	if logger == nil {
 		logger = log.NewNopLogger()
 	}
-	return &seriesCache{
+	c := &seriesCache{
 		logger:           logger,
 		now:              time.Now,
 		pool:             newPool(reg),
-		entries:          map[storage.SeriesRef]*seriesCacheEntry{},
 		matchers:         matchers,
 		metricTypePrefix: metricTypePrefix,
+		created:          map[uint64]int64{},
+		leaseStart:       math.MaxInt64,
+		aggregator:       newAggregator(),
 	}
+	for i := range c.stripes {
+		c.stripes[i].entries = map[storage.SeriesRef]*seriesCacheEntry{}
+	}
+	return c
 }
 
 func (c *seriesCache) run(ctx context.Context) {
@@ -170,33 +316,174 @@ func (c *seriesCache) run(ctx context.Context) {
 // forceRefresh forces all series to be reconstructed on the next sample. This will not
 // invalidate counter reset state.
 func (c *seriesCache) forceRefresh() {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-
 	// Set next refresh to the zero timestamp to trigger a refresh.
-	for _, e := range c.entries {
+	c.forEach(func(_ storage.SeriesRef, e *seriesCacheEntry) {
 		e.nextRefresh = 0
-	}
+	})
+}
+
+// setResourceMappings updates the resource mappings and forces all series to be
+// reconstructed with them.
+func (c *seriesCache) setResourceMappings(mappings []*resourceMapping) {
+	c.cfgMtx.Lock()
+	c.resourceMappings = mappings
+	c.cfgMtx.Unlock()
+
+	c.forceRefresh()
+}
+
+// setExportIntervals sets the minimum export intervals of series and refreshes all
+// cached series.
+func (c *seriesCache) setExportIntervals(intervals []*exportInterval) {
+	c.cfgMtx.Lock()
+	c.exportIntervals = intervals
+	c.cfgMtx.Unlock()
+
+	c.forceRefresh()
+}
+
+// setAggregationRules sets the aggregation rules of series and refreshes all cached series.
+func (c *seriesCache) setAggregationRules(rules []*aggregationRule) {
+	c.cfgMtx.Lock()
+	c.aggregationRules = rules
+	c.cfgMtx.Unlock()
+
+	c.forceRefresh()
+}
+
+// setPriorityClasses sets the export priority classes of series and refreshes all cached
+// series.
+func (c *seriesCache) setPriorityClasses(classes []*priorityClass) {
+	c.cfgMtx.Lock()
+	c.priorityClasses = classes
+	c.cfgMtx.Unlock()
+
+	c.forceRefresh()
+}
+
+// setLimits sets the handling of series exceeding GCM limits and refreshes all cached
+// series.
+func (c *seriesCache) setLimits(limits *gcmLimits) {
+	c.cfgMtx.Lock()
+	c.limits = limits
+	c.cfgMtx.Unlock()
+
+	c.forceRefresh()
+}
+
+// setMatchers updates the matchers and re-evaluates which of the cached series are dropped.
+func (c *seriesCache) setMatchers(matchers Matchers) {
+	c.cfgMtx.Lock()
+	c.matchers = matchers
+	c.cfgMtx.Unlock()
+
+	c.forEach(func(_ storage.SeriesRef, e *seriesCacheEntry) {
+		if e.lset == nil {
+			return
+		}
+		dropped := !matchers.Matches(e.lset)
+		if dropped == e.dropped && !e.relabelDropped && !e.limitDropped {
+			return
+		}
+		c.releaseBudget(e)
+		e.dropped = dropped
+		e.relabelDropped = false
+		e.limitDropped = false
+		// Series that are no longer dropped by matchers must be populated again, which
+		// applies the relabeling rules.
+		if !dropped {
+			e.nextRefresh = 0
+			e.clearResetState()
+		}
+	})
+}
+
+// setRelabelConfigs updates the relabeling rules and forces all series that are not
+// dropped by matchers to be reconstructed with them.
+func (c *seriesCache) setRelabelConfigs(cfgs []*relabel.Config) {
+	c.cfgMtx.Lock()
+	c.relabelConfigs = cfgs
+	c.cfgMtx.Unlock()
+
+	c.forEach(func(_ storage.SeriesRef, e *seriesCacheEntry) {
+		if e.relabelDropped || e.limitDropped {
+			c.releaseBudget(e)
+			e.dropped = false
+			e.relabelDropped = false
+			e.limitDropped = false
+			e.clearResetState()
+		}
+		e.nextRefresh = 0
+	})
 }
 
 // clear the entire cache state.
 func (c *seriesCache) clear() {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
+	for i := range c.stripes {
+		s := &c.stripes[i]
+		s.mtx.Lock()
+		for ref, entry := range s.entries {
+			c.releaseEntry(entry)
+			delete(s.entries, ref)
+		}
+		s.mtx.Unlock()
+	}
+	c.aggregator.clear()
+}
 
-	for ref, entry := range c.entries {
-		c.pool.release(entry.protos.gauge.proto)
-		c.pool.release(entry.protos.cumulative.proto)
-		delete(c.entries, ref)
+// releaseEntry releases the resources held by an entry that is removed from the cache.
+func (c *seriesCache) releaseEntry(e *seriesCacheEntry) {
+	if e.created {
+		c.resetMtx.Lock()
+		delete(c.created, e.createdKey)
+		c.resetMtx.Unlock()
 	}
+	c.releaseBudget(e)
+	c.releaseProtos(e)
+}
+
+// releaseProtos releases the cached protos of an entry that is no longer exported.
+func (c *seriesCache) releaseProtos(e *seriesCacheEntry) {
+	c.pool.release(e.protos.gauge.proto)
+	c.pool.release(e.protos.cumulative.proto)
+	e.protos = cachedProtos{}
+}
+
+// countViolations counts the GCM limits the series violates that it did not violate when
+// it was last populated.
+func (c *seriesCache) countViolations(e *seriesCacheEntry, metric string, violations []string) {
+	for i, v := range violations {
+		if containsString(e.limitViolations, v) || containsString(violations[:i], v) {
+			continue
+		}
+		countViolation(metric, v)
+	}
+	e.limitViolations = violations
+}
+
+func containsString(l []string, s string) bool {
+	for _, x := range l {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// releaseBudget removes the entry from the cardinality limit it was counted against.
+func (c *seriesCache) releaseBudget(e *seriesCacheEntry) {
+	if c.budget == nil || e.budgetKey == "" {
+		return
+	}
+	c.budget.remove(e.budgetKey, e.budgetGroup, e.limitDropped)
+	e.budgetKey = ""
 }
 
 // garbageCollect drops obsolete cache entries that have not been updated for
 // the given delay duration.
+// Stripes are collected one at a time so that lookups for series in other stripes
+// are never blocked.
 func (c *seriesCache) garbageCollect(delay time.Duration) error {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-
 	start := c.now()
 
 	// Drop all series that haven't been used in 10 minutes.
@@ -209,14 +496,23 @@ func (c *seriesCache) garbageCollect(delay time.Duration) error {
 	deleteBefore := start.Add(-delay).Unix()
 	i := 0
 
-	for ref, entry := range c.entries {
-		if entry.lastUsed >= deleteBefore {
-			continue
+	for j := range c.stripes {
+		s := &c.stripes[j]
+		s.mtx.Lock()
+		for ref, entry := range s.entries {
+			if entry.lastUsed >= deleteBefore {
+				continue
+			}
+			c.releaseEntry(entry)
+			delete(s.entries, ref)
+			i++
 		}
-		c.pool.release(entry.protos.gauge.proto)
-		c.pool.release(entry.protos.cumulative.proto)
-		delete(c.entries, ref)
-		i++
+		s.mtx.Unlock()
+	}
+	// Cached series are observed again on every refresh. Descriptors of series that were
+	// collected above are no longer observed.
+	if c.descriptors != nil {
+		c.descriptors.garbageCollect(start.Add(-delay - refreshInterval - refreshJitter))
 	}
 	level.Info(c.logger).Log("msg", "garbage collection completed", "took", time.Since(start), "seriesPurged", i)
 
@@ -227,15 +523,16 @@ func (c *seriesCache) garbageCollect(delay time.Duration) error {
 // last seen for the entry.
 // If the series cannot be converted the returned boolean is false.
 func (c *seriesCache) get(s record.RefSample, externalLabels labels.Labels, metadata MetadataFunc) (*seriesCacheEntry, bool) {
-	c.mtx.Lock()
-	defer c.mtx.Unlock()
-
 	ref := storage.SeriesRef(s.Ref)
 
-	e, ok := c.entries[ref]
+	stripe := c.stripe(ref)
+	stripe.mtx.Lock()
+	defer stripe.mtx.Unlock()
+
+	e, ok := stripe.entries[ref]
 	if !ok {
 		e = &seriesCacheEntry{}
-		c.entries[ref] = e
+		stripe.entries[ref] = e
 	}
 	if e.shouldRefresh() {
 		if err := c.populate(ref, e, externalLabels, metadata); err != nil {
@@ -248,21 +545,117 @@ func (c *seriesCache) get(s record.RefSample, externalLabels labels.Labels, meta
 	return e, e.valid()
 }
 
+// getLabels returns the labels of an already cached series merged with the external labels.
+// Series labels take precedence over external labels. If the series is not cached or is
+// dropped from exporting, the returned boolean is false.
+func (c *seriesCache) getLabels(ref storage.SeriesRef, externalLabels labels.Labels) (labels.Labels, bool) {
+	stripe := c.stripe(ref)
+	stripe.mtx.Lock()
+	e, ok := stripe.entries[ref]
+	var lset labels.Labels
+	if ok && !e.dropped {
+		lset = e.lset
+	}
+	stripe.mtx.Unlock()
+	if lset == nil {
+		return nil, false
+	}
+	builder := labels.NewBuilder(lset)
+
+	for _, l := range externalLabels {
+		if !lset.Has(l.Name) {
+			builder.Set(l.Name, l.Value)
+		}
+	}
+	return builder.Labels(labels.EmptyLabels()), true
+}
+
+// lookup returns the cache entry for the series reference if it exists.
+// The stripe lock is not held when it returns.
+func (c *seriesCache) lookup(ref storage.SeriesRef) (*seriesCacheEntry, bool) {
+	stripe := c.stripe(ref)
+	stripe.mtx.Lock()
+	defer stripe.mtx.Unlock()
+
+	e, ok := stripe.entries[ref]
+	return e, ok
+}
+
+// lookupCreated returns the key of the series whose creation timestamp an already cached
+// _created series holds. The first boolean is false if the series is not cached and the
+// second one is false if it is no exported _created series.
+func (c *seriesCache) lookupCreated(ref storage.SeriesRef) (uint64, bool, bool) {
+	stripe := c.stripe(ref)
+	stripe.mtx.Lock()
+	defer stripe.mtx.Unlock()
+
+	e, ok := stripe.entries[ref]
+	if !ok || !e.valid() {
+		return 0, false, false
+	}
+	return e.createdKey, true, e.created && !e.dropped
+}
+
+// skipExport returns true if a point of the series at timestamp t is within the minimum
+// export interval of the last exported point. Otherwise t is recorded as the timestamp of
+// the last exported point.
+func (c *seriesCache) skipExport(ref storage.SeriesRef, t int64) bool {
+	stripe := c.stripe(ref)
+	stripe.mtx.Lock()
+	defer stripe.mtx.Unlock()
+
+	e, ok := stripe.entries[ref]
+	if !ok || e.exportInterval <= 0 {
+		return false
+	}
+	if e.lastExported != 0 && t-e.lastExported < e.exportInterval {
+		return true
+	}
+	e.lastExported = t
+	return false
+}
+
 // getResetAdjusted takes a sample for a referenced series and returns
 // its reset timestamp and adjusted value.
 // If the last return argument is false, the sample should be dropped.
 func (c *seriesCache) getResetAdjusted(ref storage.SeriesRef, t int64, v float64) (int64, float64, bool) {
-	c.mtx.Lock()
-	e, ok := c.entries[ref]
-	c.mtx.Unlock()
+	stripe := c.stripe(ref)
+	stripe.mtx.Lock()
+	defer stripe.mtx.Unlock()
+
+	e, ok := stripe.entries[ref]
 	if !ok {
 		return 0, 0, false
 	}
+	created, hasCreated := c.getCreated(e.createdKey, t)
+
 	hasReset := e.hasReset
 	e.hasReset = true
+	if !hasReset {
+		if hasCreated {
+			// The creation timestamp exposed by the target is the start of the cumulative
+			// range and the first sample can be used right away.
+			e.resetTimestamp = created
+			e.resetValue = 0
+			e.lastValue = 0
+			hasReset = true
+		} else if rs, ok := c.takeRestoredResetState(e.lset, t); ok {
+			// Continue from the reset state of the series before a restart.
+			e.resetTimestamp = rs.resetTimestamp
+			e.resetValue = rs.resetValue
+			e.lastValue = rs.lastValue
+			e.lastTimestamp = rs.lastTimestamp
+			// Drop samples that were already processed before the restart.
+			if t <= rs.lastTimestamp {
+				return 0, 0, false
+			}
+			hasReset = true
+		}
+	}
 	if !hasReset {
 		e.resetTimestamp = t
 		e.resetValue = v
+		e.lastTimestamp = t
 		// If we just initialized the reset timestamp, this sample should be skipped.
 		// We don't know the window over which the current cumulative value was built up over.
 		// The next sample for will be considered from this point onwards.
@@ -275,11 +668,16 @@ func (c *seriesCache) getResetAdjusted(ref storage.SeriesRef, t int64, v float64
 		// - attempting to update a previous point, resulting in an error response.
 		//
 		// Note: this will only omit duplicates of the initial "reset" sample.
-		// Omitting duplicates of all incoming samples would require
-		// more sophisticated state management.
+		// Duplicates of all other samples are dropped by the out-of-order guard
+		// of the shards before they are enqueued.
 		return 0, 0, false
 	}
-	if v < e.lastValue {
+	if hasCreated && created > e.resetTimestamp {
+		// The series was created again since the range started, i.e. it was reset
+		// at the exact creation time.
+		e.resetValue = 0
+		e.resetTimestamp = created
+	} else if v < e.lastValue {
 		// If the series was reset, set the reset timestamp to be one millisecond
 		// before the timestamp of the current sample.
 		// We don't know the true reset time but this ensures the range is non-zero
@@ -288,10 +686,93 @@ func (c *seriesCache) getResetAdjusted(ref storage.SeriesRef, t int64, v float64
 		e.resetTimestamp = t - 1
 	}
 	e.lastValue = v
+	e.lastTimestamp = t
 
 	return e.resetTimestamp, v - e.resetValue, true
 }
 
+// getHistogramResetAdjusted is like getResetAdjusted for native histograms. It returns the
+// reset timestamp and the histogram with the observations since then.
+func (c *seriesCache) getHistogramResetAdjusted(ref storage.SeriesRef, t int64, h *histogram.Histogram) (int64, *histogram.FloatHistogram, bool) {
+	stripe := c.stripe(ref)
+	stripe.mtx.Lock()
+	defer stripe.mtx.Unlock()
+
+	e, ok := stripe.entries[ref]
+	if !ok {
+		return 0, nil, false
+	}
+	fh := h.ToFloat()
+
+	hasReset := e.hasReset
+	e.hasReset = true
+	if !hasReset {
+		e.resetTimestamp = t
+		e.resetHistogram = fh
+		e.lastHistogram = fh
+		return 0, nil, false
+	} else if t <= e.resetTimestamp {
+		return 0, nil, false
+	}
+	if nativeHistogramReset(fh, e.lastHistogram) {
+		e.resetHistogram = nil
+		e.resetTimestamp = t - 1
+	}
+	e.lastHistogram = fh
+
+	if e.resetHistogram == nil {
+		return e.resetTimestamp, fh.Copy(), true
+	}
+	// Subtraction requires the reset histogram to have an equal or higher resolution.
+	res := fh.Copy()
+	if res.Schema > e.resetHistogram.Schema {
+		res = fh.CopyToSchema(e.resetHistogram.Schema)
+	}
+	return e.resetTimestamp, res.Sub(e.resetHistogram), true
+}
+
+// setCreated records the creation timestamp in seconds exposed by a _created series for
+// the series with the given key.
+func (c *seriesCache) setCreated(key uint64, v float64) {
+	if math.IsNaN(v) || v <= 0 {
+		return
+	}
+	c.resetMtx.Lock()
+	defer c.resetMtx.Unlock()
+
+	c.created[key] = int64(v * 1000)
+}
+
+// getCreated returns the creation timestamp for the series with the given key if it is
+// known and usable as the start time of a sample with timestamp t.
+func (c *seriesCache) getCreated(key uint64, t int64) (int64, bool) {
+	if key == 0 {
+		return 0, false
+	}
+	c.resetMtx.Lock()
+	defer c.resetMtx.Unlock()
+
+	ct, ok := c.created[key]
+	// Start times before the lease would cause samples to be dropped as they may
+	// conflict with samples written by another replica.
+	if !ok || ct < c.leaseStart || ct >= t {
+		return 0, false
+	}
+	return ct, true
+}
+
+// createdKey returns the key that correlates the series of a metric with the _created
+// series holding their creation timestamp. The series labels are taken without the metric
+// name suffix and the labels that distinguish histogram buckets and summary quantiles.
+func createdKey(lset labels.Labels) uint64 {
+	name, _, _ := splitMetricSuffix(lset.Get(labels.MetricName))
+
+	b := labels.NewBuilder(lset)
+	b.Set(labels.MetricName, name)
+	b.Del(labels.BucketLabel, "quantile")
+	return b.Labels(labels.EmptyLabels()).Hash()
+}
+
 // getMetricType creates a GCM metric type from the Prometheus metric name and a type suffix.
 // Optionally, a secondary type suffix may be provided for series for which a Prometheus type
 // may be written as different GCM series.
@@ -314,6 +795,12 @@ const (
 	metricSuffixBucket metricSuffix = "_bucket"
 	metricSuffixSum    metricSuffix = "_sum"
 	metricSuffixCount  metricSuffix = "_count"
+	// OpenMetrics series holding the creation timestamp of counters, histograms, and summaries.
+	metricSuffixCreated metricSuffix = "_created"
+	// OpenMetrics suffixes of gauge histograms and info metrics.
+	metricSuffixGSum   metricSuffix = "_gsum"
+	metricSuffixGCount metricSuffix = "_gcount"
+	metricSuffixInfo   metricSuffix = "_info"
 )
 
 // Suffixes appended to GCM metric types. They are equivalent to the respective
@@ -328,27 +815,119 @@ const (
 	gcmMetricSuffixCounter   gcmMetricSuffix = "counter"
 	gcmMetricSuffixHistogram gcmMetricSuffix = "histogram"
 	gcmMetricSuffixSummary   gcmMetricSuffix = "summary"
+	// OpenMetrics types without an equivalent in the Prometheus text format.
+	gcmMetricSuffixInfo           gcmMetricSuffix = "info"
+	gcmMetricSuffixStateset       gcmMetricSuffix = "stateset"
+	gcmMetricSuffixGaugeHistogram gcmMetricSuffix = "gaugehistogram"
 )
 
-// Maximum number of labels allowed on GCM series.
-const maxLabelCount = 100
-
 // populate cached state for the given entry.
 func (c *seriesCache) populate(ref storage.SeriesRef, entry *seriesCacheEntry, externalLabels labels.Labels, getMetadata MetadataFunc) error {
+	c.cfgMtx.RLock()
+	matchers, relabelConfigs, resourceMappings := c.matchers, c.relabelConfigs, c.resourceMappings
+	exportIntervals, aggregationRules, priorityClasses := c.exportIntervals, c.aggregationRules, c.priorityClasses
+	limits := c.limits
+	c.cfgMtx.RUnlock()
+
 	if entry.lset == nil {
 		entry.lset = c.getLabelsByRef(ref)
 		if entry.lset == nil {
 			return errors.New("series reference invalid")
 		}
-		entry.dropped = !c.matchers.Matches(entry.lset)
+		entry.dropped = !matchers.Matches(entry.lset)
+	}
+	// Check again whether series that exceeded the cardinality limit are admitted now.
+	// The matchers may have changed since the series was dropped.
+	if entry.limitDropped {
+		c.releaseBudget(entry)
+		entry.dropped = !matchers.Matches(entry.lset)
+		entry.limitDropped = false
+		entry.clearResetState()
 	}
 	if entry.dropped {
 		return nil
 	}
+	// Apply relabeling rules, which only affect the exported series and not the cached
+	// local series labels.
+	lset := entry.lset
+	if len(relabelConfigs) > 0 {
+		lset = relabel.Process(lset, relabelConfigs...)
+		if lset == nil {
+			c.releaseBudget(entry)
+			c.releaseProtos(entry)
+			entry.dropped = true
+			entry.relabelDropped = true
+			return nil
+		}
+	}
+	var (
+		metricName     = lset.Get("__name__")
+		baseMetricName = metricName
+		suffix         metricSuffix
+	)
+	metadata, ok := getMetadata(metricName)
+	if !ok {
+		// The full name didn't turn anything up. Check again in case it's a summary
+		// or histogram without the metric name suffix. If the underlying target
+		// returned the OpenMetrics format, counter metadata is also stored with the
+		// _total suffix stripped.
+		if baseMetricName, suffix, metadata, ok = getSuffixedMetadata(getMetadata, metricName); !ok {
+			return fmt.Errorf("no metadata found for metric name %q", metricName)
+		}
+	}
+	// Count the series against the cardinality limit of its metric unless it already is.
+	// Series are counted under the base name of their metric so that all series of a
+	// histogram or summary are admitted or rejected together.
+	if c.budget != nil {
+		key, group := c.budget.key(baseMetricName, lset), cardinalityGroup(lset)
+		if key != entry.budgetKey || group != entry.budgetGroup {
+			c.releaseBudget(entry)
+			entry.budgetKey, entry.budgetGroup = key, group
+
+			if !c.budget.add(key, group) {
+				c.releaseProtos(entry)
+				entry.dropped = true
+				entry.limitDropped = true
+				return nil
+			}
+		}
+	}
+	entry.exportInterval = 0
+	for _, ei := range exportIntervals {
+		if ei.selector.Matches(lset) {
+			entry.exportInterval = ei.interval
+			break
+		}
+	}
+	entry.priority = priorityNormal
+	for _, pc := range priorityClasses {
+		if pc.selector.Matches(lset) {
+			entry.priority = pc.priority
+			break
+		}
+	}
+	// Series matching an aggregation rule are exported as their aggregate without the
+	// aggregated labels. Distributions cannot be aggregated and _created series keep their
+	// labels to correlate with the other series of their metric.
+	exported := lset
+	entry.aggregation = nil
+
+	switch {
+	case metadata.Type == textparse.MetricTypeHistogram, metadata.Type == textparse.MetricTypeGaugeHistogram:
+	case suffix == metricSuffixCreated:
+	default:
+		for _, r := range aggregationRules {
+			if r.selector.Matches(lset) {
+				entry.aggregation = r
+				exported = labels.NewBuilder(lset).Del(r.without...).Labels(labels.EmptyLabels())
+				break
+			}
+		}
+	}
 	// Break the series into resource and metric labels.
-	resource, metricLabels, err := extractResource(externalLabels, entry.lset)
+	resource, metricLabels, err := extractResource(externalLabels, exported, resourceMappings)
 	if err != nil {
-		return fmt.Errorf("extracting resource for series %s failed: %w", entry.lset, err)
+		return fmt.Errorf("extracting resource for series %s failed: %w", exported, err)
 	}
 
 	// Remove the __name__ label as it becomes the metric type in the GCM time series.
@@ -358,34 +937,53 @@ func (c *seriesCache) populate(ref storage.SeriesRef, entry *seriesCacheEntry, e
 			break
 		}
 	}
-	// Drop series with too many labels.
-	// TODO: remove once field limit is lifted in the GCM API.
-	if len(metricLabels) > maxLabelCount {
-		return fmt.Errorf("metric labels %s exceed the limit of %d", metricLabels, maxLabelCount)
+	// Series exceeding GCM limits are dropped or adjusted to fit them. Their samples
+	// would be rejected otherwise.
+	if limits == nil {
+		limits = defaultLimits
+	}
+	entry.created = false
+	entry.createdKey = 0
+	entry.gcmLimitsExceeded = false
+
+	dropForLimits := func() error {
+		c.releaseProtos(entry)
+		entry.metadata = metadata
+		entry.suffix = suffix
+		entry.gcmLimitsExceeded = true
+		return nil
 	}
+	var violations []string
+	defer func() {
+		c.countViolations(entry, metricName, violations)
+	}()
 
-	var (
-		metricName     = entry.lset.Get("__name__")
-		baseMetricName = metricName
-		suffix         metricSuffix
-	)
-	metadata, ok := getMetadata(metricName)
+	metricLabels, violations, ok = limits.enforceLabels(metricLabels)
 	if !ok {
-		// The full name didn't turn anything up. Check again in case it's a summary
-		// or histogram without the metric name suffix. If the underlying target
-		// returned the OpenMetrics format, counter metadata is also stored with the
-		// _total suffix stripped.
-		var ok bool
-		if baseMetricName, suffix, ok = splitMetricSuffix(metricName); ok {
-			metadata, ok = getMetadata(baseMetricName)
-		}
-		if !ok {
-			return fmt.Errorf("no metadata found for metric name %q", metricName)
+		return dropForLimits()
+	}
+
+	// The _created series of OpenMetrics counters, histograms, and summaries are not exported
+	// but provide the start time of the other series of their metric.
+	if suffix == metricSuffixCreated {
+		switch metadata.Type {
+		case textparse.MetricTypeCounter, textparse.MetricTypeHistogram, textparse.MetricTypeSummary:
+		default:
+			return fmt.Errorf("unexpected metric name suffix %q for metric %q", suffix, metricName)
 		}
+		c.pool.release(entry.protos.gauge.proto)
+		c.pool.release(entry.protos.cumulative.proto)
+
+		entry.protos = cachedProtos{}
+		entry.metadata = metadata
+		entry.suffix = suffix
+		entry.created = true
+		entry.createdKey = createdKey(lset)
+		return nil
 	}
 	// Handle label modifications for histograms early so we don't build the label map twice.
 	// We have to remove the 'le' label which defines the bucket boundary.
-	if metadata.Type == textparse.MetricTypeHistogram {
+	if metadata.Type == textparse.MetricTypeHistogram || metadata.Type == textparse.MetricTypeGaugeHistogram {
 		for i, l := range metricLabels {
 			if l.Name == "le" {
 				metricLabels = append(metricLabels[:i], metricLabels[i+1:]...)
@@ -394,7 +992,16 @@ func (c *seriesCache) populate(ref storage.SeriesRef, entry *seriesCacheEntry, e
 		}
 	}
 
+	var typeExceeded bool
+
 	newSeries := func(mtype string, kind metric_pb.MetricDescriptor_MetricKind, vtype metric_pb.MetricDescriptor_ValueType) hashedSeries {
+		mtype, exceeded, ok := limits.enforceMetricType(mtype)
+		if exceeded {
+			violations = append(violations, limitMetricTypeLength)
+		}
+		if !ok {
+			typeExceeded = true
+		}
 		s := &monitoring_pb.TimeSeries{
 			Resource:   resource,
 			Metric:     &metric_pb.Metric{Type: mtype, Labels: metricLabels.Map()},
@@ -458,9 +1065,32 @@ func (c *seriesCache) populate(ref storage.SeriesRef, entry *seriesCacheEntry, e
 			metric_pb.MetricDescriptor_CUMULATIVE,
 			metric_pb.MetricDescriptor_DISTRIBUTION)
 
+	case textparse.MetricTypeGaugeHistogram:
+		protos.gauge = newSeries(
+			c.getMetricType(baseMetricName, gcmMetricSuffixGaugeHistogram, gcmMetricSuffixNone),
+			metric_pb.MetricDescriptor_GAUGE,
+			metric_pb.MetricDescriptor_DISTRIBUTION)
+
+	// Info and stateset series have the values 0 or 1 and are written as gauges. The
+	// info labels and the state label are regular metric labels.
+	case textparse.MetricTypeInfo:
+		protos.gauge = newSeries(
+			c.getMetricType(metricName, gcmMetricSuffixInfo, gcmMetricSuffixNone),
+			metric_pb.MetricDescriptor_GAUGE,
+			metric_pb.MetricDescriptor_DOUBLE)
+
+	case textparse.MetricTypeStateset:
+		protos.gauge = newSeries(
+			c.getMetricType(metricName, gcmMetricSuffixStateset, gcmMetricSuffixNone),
+			metric_pb.MetricDescriptor_GAUGE,
+			metric_pb.MetricDescriptor_DOUBLE)
+
 	default:
 		return fmt.Errorf("unexpected metric type %s for metric %q", metadata.Type, metricName)
 	}
+	if typeExceeded {
+		return dropForLimits()
+	}
 
 	c.pool.release(entry.protos.gauge.proto)
 	c.pool.release(entry.protos.cumulative.proto)
@@ -471,13 +1101,27 @@ func (c *seriesCache) populate(ref storage.SeriesRef, entry *seriesCacheEntry, e
 	entry.metadata = metadata
 	entry.suffix = suffix
 
+	if c.descriptors != nil {
+		c.descriptors.observe(protos.gauge.proto, metadata, suffix)
+		c.descriptors.observe(protos.cumulative.proto, metadata, suffix)
+	}
+
+	switch metadata.Type {
+	case textparse.MetricTypeCounter, textparse.MetricTypeHistogram, textparse.MetricTypeSummary:
+		if protos.cumulative.proto != nil {
+			entry.createdKey = createdKey(lset)
+		}
+	}
+
 	return nil
 }
 
 // extractResource returns the monitored resource, the entry labels, and whether the operation succeeded
 // for the provided external labels and Prometheus series labels.
+// The resource is built by the first of the mappings that matches the series or as a prometheus_target
+// if none matches.
 // The returned entry labels are a subset of `lset` without the labels that were used as resource labels.
-func extractResource(externalLabels, lset labels.Labels) (*monitoredres_pb.MonitoredResource, labels.Labels, error) {
+func extractResource(externalLabels, lset labels.Labels, mappings []*resourceMapping) (*monitoredres_pb.MonitoredResource, labels.Labels, error) {
 	// Prometheus allows to configure external labels, which are attached when exporting data out of
 	// the instance to disambiguate data across instances. For us they generally include 'project_id',
 	// 'location' and 'cluster'.
@@ -506,38 +1150,49 @@ func extractResource(externalLabels, lset labels.Labels) (*monitoredres_pb.Monit
 	}
 	lset = builder.Labels(labels.EmptyLabels())
 
-	// Ensure project_id and location are set but leave validating of the values to the API.
-	if lset.Get(KeyProjectID) == "" {
-		return nil, nil, fmt.Errorf("missing required resource field %q", KeyProjectID)
-	}
-	if lset.Get(KeyLocation) == "" {
-		return nil, nil, fmt.Errorf("missing required resource field %q", KeyLocation)
+	mapping := defaultResourceMapping
+	for _, m := range mappings {
+		if m.selector.Matches(lset) {
+			mapping = m
+			break
+		}
 	}
-
 	// Transfer resource fields from label set onto the resource. If they are not set,
 	// the respective field is set to an empty string. This explicitly is a valid value
 	// in Cloud Monitoring and not the same as being unset.
 	mres := &monitoredres_pb.MonitoredResource{
-		Type: "prometheus_target",
-		Labels: map[string]string{
-			KeyProjectID: lset.Get(KeyProjectID),
-			KeyLocation:  lset.Get(KeyLocation),
-			KeyCluster:   lset.Get(KeyCluster),
-			KeyNamespace: lset.Get(KeyNamespace),
-			KeyJob:       lset.Get(KeyJob),
-			KeyInstance:  lset.Get(KeyInstance),
-		},
-	}
-	builder.Del(KeyProjectID)
-	builder.Del(KeyLocation)
-	builder.Del(KeyCluster)
-	builder.Del(KeyNamespace)
-	builder.Del(KeyJob)
-	builder.Del(KeyInstance)
-
+		Type:   mapping.typ,
+		Labels: make(map[string]string, len(mapping.fields)),
+	}
+	for field, label := range mapping.fields {
+		mres.Labels[field] = lset.Get(label)
+		builder.Del(label)
+	}
+	// Ensure project_id and location are set but leave validating of the values to the API.
+	if mres.Labels[KeyProjectID] == "" {
+		return nil, nil, fmt.Errorf("missing required resource field %q", KeyProjectID)
+	}
+	if mres.Labels[KeyLocation] == "" {
+		return nil, nil, fmt.Errorf("missing required resource field %q", KeyLocation)
+	}
 	return mres, builder.Labels(labels.EmptyLabels()), nil
 }
 
+// getSuffixedMetadata returns the base name, suffix, and metadata of a series whose metric
+// name has a suffix of its metric family. The _info suffix is only stripped for info metrics
+// as other metrics may end in it.
+func getSuffixedMetadata(getMetadata MetadataFunc, name string) (string, metricSuffix, MetricMetadata, bool) {
+	baseName, suffix, ok := splitMetricSuffix(name)
+	if !ok {
+		return name, metricSuffixNone, MetricMetadata{}, false
+	}
+	md, ok := getMetadata(baseName)
+	if !ok || (suffix == metricSuffixInfo && md.Type != textparse.MetricTypeInfo) {
+		return name, metricSuffixNone, MetricMetadata{}, false
+	}
+	return baseName, suffix, md, true
+}
+
 func splitMetricSuffix(name string) (prefix string, suffix metricSuffix, ok bool) {
 	if strings.HasSuffix(name, string(metricSuffixTotal)) {
 		return name[:len(name)-len(metricSuffixTotal)], metricSuffixTotal, true
@@ -545,12 +1200,25 @@ func splitMetricSuffix(name string) (prefix string, suffix metricSuffix, ok bool
 	if strings.HasSuffix(name, string(metricSuffixBucket)) {
 		return name[:len(name)-len(metricSuffixBucket)], metricSuffixBucket, true
 	}
+	// Gauge histogram suffixes must be checked before the _count and _sum suffixes they end with.
+	if strings.HasSuffix(name, string(metricSuffixGCount)) {
+		return name[:len(name)-len(metricSuffixGCount)], metricSuffixGCount, true
+	}
+	if strings.HasSuffix(name, string(metricSuffixGSum)) {
+		return name[:len(name)-len(metricSuffixGSum)], metricSuffixGSum, true
+	}
 	if strings.HasSuffix(name, string(metricSuffixCount)) {
 		return name[:len(name)-len(metricSuffixCount)], metricSuffixCount, true
 	}
 	if strings.HasSuffix(name, string(metricSuffixSum)) {
 		return name[:len(name)-len(metricSuffixSum)], metricSuffixSum, true
 	}
+	if strings.HasSuffix(name, string(metricSuffixCreated)) {
+		return name[:len(name)-len(metricSuffixCreated)], metricSuffixCreated, true
+	}
+	if strings.HasSuffix(name, string(metricSuffixInfo)) {
+		return name[:len(name)-len(metricSuffixInfo)], metricSuffixInfo, true
+	}
 	return name, metricSuffixNone, false
 }
 
@@ -15,12 +15,19 @@
 package export
 
 import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/record"
 	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
 	"google.golang.org/protobuf/testing/protocmp"
@@ -31,6 +38,7 @@ func TestExtractResource(t *testing.T) {
 		doc            string
 		externalLabels labels.Labels
 		seriesLabels   labels.Labels
+		mappings       []ResourceMapping
 		wantResource   *monitoredres_pb.MonitoredResource
 		wantLabels     labels.Labels
 		wantOk         bool
@@ -110,6 +118,71 @@ func TestExtractResource(t *testing.T) {
 			},
 			wantLabels: labels.FromStrings("key1", "v1", "key2", "v2"),
 			wantOk:     true,
+		}, {
+			doc: "mapped to k8s_container",
+			externalLabels: labels.FromMap(map[string]string{
+				"project_id": "p1",
+				"location":   "l1",
+				"cluster":    "c1",
+			}),
+			seriesLabels: labels.FromMap(map[string]string{
+				"namespace": "n1",
+				"pod":       "p1",
+				"container": "c1",
+				"job":       "j1",
+				"key":       "v1",
+			}),
+			mappings: []ResourceMapping{
+				{
+					Match: `{job="j2"}`,
+					Type:  "generic_task",
+				}, {
+					Match: `{job="j1"}`,
+					Type:  "k8s_container",
+					Labels: map[string]string{
+						"cluster":   "cluster_name",
+						"namespace": "namespace_name",
+						"pod":       "pod_name",
+						"container": "container_name",
+					},
+				},
+			},
+			wantResource: &monitoredres_pb.MonitoredResource{
+				Type: "k8s_container",
+				Labels: map[string]string{
+					"project_id":     "p1",
+					"location":       "l1",
+					"cluster_name":   "c1",
+					"namespace_name": "n1",
+					"pod_name":       "p1",
+					"container_name": "c1",
+				},
+			},
+			wantLabels: labels.FromStrings("job", "j1", "key", "v1"),
+			wantOk:     true,
+		}, {
+			doc: "no matching mapping",
+			seriesLabels: labels.FromMap(map[string]string{
+				"project_id": "p1",
+				"location":   "l1",
+				"job":        "j1",
+			}),
+			mappings: []ResourceMapping{
+				{Match: `{job="j2"}`, Type: "generic_task"},
+			},
+			wantResource: &monitoredres_pb.MonitoredResource{
+				Type: "prometheus_target",
+				Labels: map[string]string{
+					"project_id": "p1",
+					"location":   "l1",
+					"cluster":    "",
+					"namespace":  "",
+					"job":        "j1",
+					"instance":   "",
+				},
+			},
+			wantLabels: labels.EmptyLabels(),
+			wantOk:     true,
 		}, {
 			doc: "location must be set",
 			seriesLabels: labels.FromMap(map[string]string{
@@ -134,7 +207,11 @@ func TestExtractResource(t *testing.T) {
 	}
 	for _, c := range cases {
 		t.Run(c.doc, func(t *testing.T) {
-			resource, lset, err := extractResource(c.externalLabels, c.seriesLabels)
+			mappings, err := (&Config{ResourceMappings: c.mappings}).resourceMappings()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resource, lset, err := extractResource(c.externalLabels, c.seriesLabels, mappings)
 			if c.wantOk && err != nil {
 				t.Errorf("expected no error but got: %s", err)
 			}
@@ -168,10 +245,177 @@ func TestSeriesCache_garbageCollect(t *testing.T) {
 	cache.garbageCollect(100 * time.Second)
 
 	// Entry for series 1 should remain while 2 got dropped.
-	if len(cache.entries) != 1 {
-		t.Errorf("Expected exactly one cache entry left, but cache is %v", cache.entries)
+	if n := cache.len(); n != 1 {
+		t.Errorf("Expected exactly one cache entry left, but cache has %d", n)
 	}
-	if _, ok := cache.entries[1]; !ok {
-		t.Errorf("Expected cache entry for series 1 but cache is %v", cache.entries)
+	if _, ok := cache.lookup(1); !ok {
+		t.Errorf("Expected cache entry for series 1")
 	}
 }
+
+func TestSeriesCache_setMatchers(t *testing.T) {
+	var matchers Matchers
+	if err := matchers.Set(`{job="j1"}`); err != nil {
+		t.Fatal(err)
+	}
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, matchers)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		if ref == 1 {
+			return labels.FromStrings("__name__", "metric1", "job", "j1")
+		}
+		return labels.FromStrings("__name__", "metric1", "job", "j2")
+	}
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1")
+
+	dropped := func(ref chunks.HeadSeriesRef) bool {
+		entry, ok := cache.get(record.RefSample{Ref: ref, T: 1000}, externalLabels, gaugeMetadata)
+		if !ok {
+			t.Fatalf("series %d not found", ref)
+		}
+		return entry.dropped
+	}
+	if dropped(1) || !dropped(2) {
+		t.Fatal("expected only series 2 to be dropped")
+	}
+
+	// Changed matchers apply to already cached series.
+	matchers = nil
+	if err := matchers.Set(`{job="j2"}`); err != nil {
+		t.Fatal(err)
+	}
+	cache.setMatchers(matchers)
+
+	if !dropped(1) || dropped(2) {
+		t.Fatal("expected only series 1 to be dropped")
+	}
+	// Series that are no longer dropped are populated on their next sample.
+	if e, _ := cache.lookup(2); e.protos.gauge.proto == nil {
+		t.Fatal("expected series 2 to be populated")
+	}
+}
+
+func TestSeriesCache_relabel(t *testing.T) {
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		if ref == 1 {
+			return labels.FromStrings("__name__", "metric1", "job", "j1", "pod_template_hash", "abc")
+		}
+		return labels.FromStrings("__name__", "metric1", "job", "j2", "pod_template_hash", "abc")
+	}
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1")
+
+	cache.setRelabelConfigs([]*relabel.Config{
+		{
+			Action: relabel.LabelDrop,
+			Regex:  relabel.MustNewRegexp("pod_template_hash"),
+		}, {
+			Action:       relabel.Drop,
+			SourceLabels: model.LabelNames{"job"},
+			Separator:    ";",
+			Regex:        relabel.MustNewRegexp("j2"),
+		},
+	})
+	get := func(ref chunks.HeadSeriesRef) *seriesCacheEntry {
+		entry, ok := cache.get(record.RefSample{Ref: ref, T: 1000}, externalLabels, gaugeMetadata)
+		if !ok {
+			t.Fatalf("series %d not found", ref)
+		}
+		return entry
+	}
+	e1 := get(1)
+	if e1.dropped {
+		t.Fatal("expected series 1 to be exported")
+	}
+	if diff := cmp.Diff(map[string]string{}, e1.protos.gauge.proto.Metric.Labels); diff != "" {
+		t.Fatalf("unexpected metric labels (-want, +got): %s", diff)
+	}
+	// The cached local series labels remain unchanged.
+	if !e1.lset.Has("pod_template_hash") {
+		t.Fatalf("expected local series labels to be retained, got %s", e1.lset)
+	}
+	if e2 := get(2); !e2.dropped || !e2.relabelDropped {
+		t.Fatal("expected series 2 to be dropped by relabeling")
+	}
+
+	// Series dropped by relabeling are exported again once the rules change.
+	cache.setRelabelConfigs(nil)
+
+	if e2 := get(2); e2.dropped || e2.relabelDropped {
+		t.Fatal("expected series 2 to be exported")
+	}
+	if got := get(1).protos.gauge.proto.Metric.Labels["pod_template_hash"]; got != "abc" {
+		t.Fatalf("expected label pod_template_hash to be exported, got %q", got)
+	}
+}
+
+func newBenchmarkSeriesCache(series int) (*seriesCache, labels.Labels) {
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return labels.FromStrings("__name__", "metric1", "job", "job1", "instance", fmt.Sprint(ref))
+	}
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1", "cluster", "c1")
+
+	for i := 0; i < series; i++ {
+		cache.get(record.RefSample{Ref: chunks.HeadSeriesRef(i), T: time.Now().UnixMilli()}, externalLabels, gaugeMetadata)
+	}
+	return cache, externalLabels
+}
+
+func BenchmarkSeriesCache_get(b *testing.B) {
+	const series = 100000
+	cache, externalLabels := newBenchmarkSeriesCache(series)
+	now := time.Now().UnixMilli()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		// Each goroutine walks through all series from a different offset, like
+		// concurrent appenders of different scrape targets.
+		i := rand.Intn(series)
+		for pb.Next() {
+			cache.get(record.RefSample{Ref: chunks.HeadSeriesRef(i % series), T: now}, externalLabels, gaugeMetadata)
+			cache.getResetAdjusted(storage.SeriesRef(i%series), now, 1)
+			i++
+		}
+	})
+}
+
+// BenchmarkSeriesCache_getDuringGarbageCollect measures lookups while garbage collection
+// frequently runs over a large cache, which must not block lookups of other stripes.
+func BenchmarkSeriesCache_getDuringGarbageCollect(b *testing.B) {
+	const series = 100000
+	cache, externalLabels := newBenchmarkSeriesCache(series)
+	now := time.Now().UnixMilli()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		tick := time.NewTicker(10 * time.Millisecond)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				// Nothing is old enough to be deleted so every run scans the entire cache.
+				cache.garbageCollect(time.Hour)
+			}
+		}
+	}()
+	defer wg.Wait()
+	defer cancel()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Intn(series)
+		for pb.Next() {
+			cache.get(record.RefSample{Ref: chunks.HeadSeriesRef(i % series), T: now}, externalLabels, gaugeMetadata)
+			i++
+		}
+	})
+}
@@ -27,7 +27,9 @@ import (
 	"github.com/go-kit/log"
 	"github.com/google/shlex"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/relabel"
 	kingpin "gopkg.in/alecthomas/kingpin.v2"
+	yaml "gopkg.in/yaml.v2"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
@@ -148,12 +150,27 @@ func FromFlags(a *kingpin.Application, userAgentProduct string) func(log.Logger,
 	a.Flag("export.match", `A Prometheus time series matcher. Can be repeated. Every time series must match at least one of the matchers to be exported. This flag can be used equivalently to the match[] parameter of the Prometheus federation endpoint to selectively export data. (Example: --export.match='{job="prometheus"}' --export.match='{__name__=~"job:.*"})`).
 		Default("").SetValue(&opts.Matchers)
 
+	relabelConfigs := a.Flag("export.relabel-config", `A Prometheus relabeling rule in YAML format that is applied to series before they are exported. Can be repeated. Series dropped by the rules are not exported. (Example: --export.relabel-config='{action: labeldrop, regex: pod_template_hash}')`).
+		Strings()
+
+	a.Flag("export.config-file", "File with exporter configuration that is reloaded along with the Prometheus configuration. Supports the sections match (in addition to --export.match), relabel_configs (in addition to --export.relabel-config), resource_mappings, metadata_overrides, export_intervals, aggregation_rules, priority_classes, and limits. See the export.Config type for their format.").
+		Default("").StringVar(&opts.ConfigFile)
+
 	a.Flag("export.debug.metric-prefix", "Google Cloud Monitoring metric prefix to use.").
 		Default(export.MetricTypePrefix).StringVar(&opts.MetricTypePrefix)
 
 	a.Flag("export.debug.disable-auth", "Disable authentication (for debugging purposes).").
 		Default("false").BoolVar(&opts.DisableAuth)
 
+	a.Flag("export.debug.enable-handler", "Serve the internal exporter state on the /debug/export HTTP endpoint.").
+		Default("false").BoolVar(&opts.EnableDebugHandler)
+
+	a.Flag("export.debug.record-file", "File to which all outgoing requests to the GCM API are recorded. Disabled if empty.").
+		Default("").StringVar(&opts.RecordFile)
+
+	a.Flag("export.debug.record-format", fmt.Sprintf("Format of recorded requests. Valid values are %q or %q.", export.RecordFormatJSON, export.RecordFormatProto)).
+		Default(export.RecordFormatJSON).EnumVar(&opts.RecordFormat, export.RecordFormatJSON, export.RecordFormatProto)
+
 	a.Flag("export.debug.batch-size", "Maximum number of points to send in one batch to the GCM API.").
 		Default(strconv.Itoa(export.BatchSizeMax)).UintVar(&opts.Efficiency.BatchSize)
 
@@ -172,6 +189,63 @@ func FromFlags(a *kingpin.Application, userAgentProduct string) func(log.Logger,
 	a.Flag("export.quota-project", "The projectID of an alternative project for quota attribution.").
 		StringVar(&opts.QuotaProject)
 
+	a.Flag("export.wal.dir", "Directory of an on-disk write-ahead buffer for samples that were not sent yet. Buffered samples survive restarts and outages of the GCM API. Disabled if empty.").
+		Default("").StringVar(&opts.WALDir)
+
+	walMaxSize := a.Flag("export.wal.max-size", "Maximum size of the on-disk write-ahead buffer.").
+		Default("1GiB").Bytes()
+
+	a.Flag("export.metric-descriptors.create", "Create metric descriptors with the help text and unit from the Prometheus metadata of exported metrics.").
+		Default("false").BoolVar(&opts.CreateMetricDescriptors)
+
+	a.Flag("export.reset-state-file", "File to which the counter reset state of series is periodically checkpointed. After a restart, counters continue from the checkpointed state instead of starting a new cumulative range. Disabled if empty.").
+		Default("").StringVar(&opts.ResetStateFile)
+
+	a.Flag("export.retry.disable", "Disable retrying samples for which sending to the GCM API failed with a transient error.").
+		Default("false").BoolVar(&opts.Retry.Disable)
+
+	a.Flag("export.retry.max-attempts", "Maximum number of times a sample is retried after a transient error.").
+		Default(strconv.Itoa(export.DefaultRetryMaxAttempts)).UintVar(&opts.Retry.MaxAttempts)
+
+	a.Flag("export.retry.budget-ratio", "Number of retries permitted per successfully sent sample. Limits the backlog retries can produce during outages.").
+		Default(strconv.FormatFloat(export.DefaultRetryBudgetRatio, 'f', -1, 64)).Float64Var(&opts.Retry.BudgetRatio)
+
+	a.Flag("export.concurrency.enable", "Adaptively limit the number of concurrent requests to the GCM API. The limit starts at 32 and increases by about one per round trip of successful requests up to the maximum. It decreases by 10% at most once per round trip when requests are throttled or slower than the latency target.").
+		Default("false").BoolVar(&opts.Concurrency.Enable)
+
+	a.Flag("export.concurrency.max", "Upper bound of the adaptive limit of concurrent requests to the GCM API.").
+		Default(strconv.Itoa(export.DefaultConcurrencyMax)).UintVar(&opts.Concurrency.Max)
+
+	a.Flag("export.concurrency.latency-target", "Request latency above which the limit of concurrent requests to the GCM API is decreased.").
+		Default(export.DefaultConcurrencyLatencyTarget.String()).DurationVar(&opts.Concurrency.LatencyTarget)
+
+	a.Flag("export.project-rate-limit.default", "Samples per second that can be written to each project without an explicit limit. If 0, projects are not limited.").
+		Default("0").Float64Var(&opts.ProjectRateLimits.Default)
+
+	projectRateLimits := a.Flag("export.project-rate-limit", "Samples per second that can be written to a project in the format <project_id>=<rate>. May be repeated.").
+		StringMap()
+
+	a.Flag("export.project-rate-limit.policy", fmt.Sprintf("Policy for samples of projects that exceed their rate limit. Valid values are %q or %q.", export.RateLimitPolicyDelay, export.RateLimitPolicyDropOldest)).
+		Default(export.RateLimitPolicyDelay).EnumVar(&opts.ProjectRateLimits.Policy, export.RateLimitPolicyDelay, export.RateLimitPolicyDropOldest)
+
+	a.Flag("export.cardinality-limit.series-per-metric", "Maximum number of active series exported per metric. New series above the limit are dropped. If 0, the number of series is not limited.").
+		Default("0").UintVar(&opts.CardinalityLimit.SeriesPerMetric)
+
+	a.Flag("export.cardinality-limit.per-namespace", "Apply the cardinality limit to the series of a metric in each namespace separately.").
+		Default("false").BoolVar(&opts.CardinalityLimit.PerNamespace)
+
+	a.Flag("export.drain-timeout", "Maximum duration for which buffered samples are still sent on shutdown. If 0, buffered samples are discarded immediately.").
+		Default("10s").DurationVar(&opts.DrainTimeout)
+
+	a.Flag("export.remote-write.url", "URL of a Prometheus remote write endpoint to which samples are written in addition to the GCM API. Disabled if empty.").
+		Default("").StringVar(&opts.RemoteWrite.URL)
+
+	a.Flag("export.remote-write.queue-size", "Number of samples buffered for the remote write endpoint. Samples are dropped for the endpoint once the buffer is full.").
+		Default(strconv.Itoa(export.DefaultRemoteWriteQueueSize)).UintVar(&opts.RemoteWrite.QueueSize)
+
+	a.Flag("export.remote-write.batch-size", "Maximum number of samples per request to the remote write endpoint.").
+		Default(strconv.Itoa(export.DefaultRemoteWriteBatchSize)).UintVar(&opts.RemoteWrite.BatchSize)
+
 	haBackend := a.Flag("export.ha.backend", fmt.Sprintf("Which backend to use to coordinate HA pairs that both send metric data to the GCM API. Valid values are %q or %q", HABackendNone, HABackendKubernetes)).
 		Default(HABackendNone).Enum(HABackendNone, HABackendKubernetes)
 
@@ -183,6 +257,27 @@ func FromFlags(a *kingpin.Application, userAgentProduct string) func(log.Logger,
 		Default("").OverrideDefaultFromEnvar("KUBE_NAME").String()
 
 	return func(logger log.Logger, metrics prometheus.Registerer) (*export.Exporter, error) {
+		opts.WALMaxSize = int64(*walMaxSize)
+
+		for _, s := range *relabelConfigs {
+			var rc relabel.Config
+			if err := yaml.UnmarshalStrict([]byte(s), &rc); err != nil {
+				return nil, fmt.Errorf("invalid relabel config %q: %w", s, err)
+			}
+			opts.RelabelConfigs = append(opts.RelabelConfigs, &rc)
+		}
+
+		for project, v := range *projectRateLimits {
+			limit, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rate limit for project %q: %w", project, err)
+			}
+			if opts.ProjectRateLimits.Limits == nil {
+				opts.ProjectRateLimits.Limits = map[string]float64{}
+			}
+			opts.ProjectRateLimits.Limits[project] = limit
+		}
+
 		switch *haBackend {
 		case HABackendNone:
 		case HABackendKubernetes:
@@ -23,37 +23,176 @@ import (
 
 // shard holds a queue of data for a subset of samples.
 type shard struct {
-	mtx     sync.Mutex
-	queue   *queue
+	mtx sync.Mutex
+	// One queue per priority class. Their combined length is bounded by the size.
+	queues  [priorityCount]*queue
+	size    int
 	pending bool
 
 	// A cache of series IDs that have been added to the batch in fill already.
 	// It's only part of the struct to not re-allocate on each call to fill.
 	seen map[uint64]struct{}
+
+	// Entries of projects that exceeded their write rate limit, in queue order. They are
+	// held outside of the queue so they don't block entries of other projects.
+	delayed    map[string][]queueEntry
+	delayedLen int
+
+	// Series with entries that are queued, delayed, or in flight by hash. Further entries of
+	// a series are added to the same queue so that they are sent in order even if the
+	// priority class of the series changes.
+	pinned map[uint64]*pinnedSeries
+	// Hashes of the entries taken by fill that are in flight.
+	inflight []uint64
+
+	// Guards lastEnqueued separately so that enqueueing does not wait for fill.
+	lastMtx sync.Mutex
+	// The end timestamps in milliseconds of the most recently enqueued points by series hash.
+	lastEnqueued map[uint64]int64
 }
 
 func newShard(queueSize uint) *shard {
-	return &shard{
-		queue: newQueue(queueSize),
-		seen:  map[uint64]struct{}{},
+	s := &shard{
+		size:         int(queueSize),
+		seen:         map[uint64]struct{}{},
+		pinned:       map[uint64]*pinnedSeries{},
+		lastEnqueued: map[uint64]int64{},
+	}
+	for i := range s.queues {
+		s.queues[i] = newQueue(queueSize)
 	}
+	return s
 }
 
-func (s *shard) enqueue(hash uint64, sample *monitoring_pb.TimeSeries) {
+func (s *shard) enqueue(hash uint64, sample *monitoring_pb.TimeSeries, p priority) {
+	e := queueEntry{
+		hash:     hash,
+		sample:   sample,
+		priority: p,
+	}
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 
-	e := queueEntry{
-		hash:   hash,
-		sample: sample,
+	e.priority = s.queueFor(hash, p)
+
+	// Tail drop is not a great solution. With the write-ahead buffer enabled, entries are
+	// enqueued through tryEnqueue instead, which allows waiting until there is space.
+	if s.queuedLen() >= s.size {
+		if _, ok := s.evict(e.priority, "queue-full"); !ok {
+			dropQueued("queue-full", e.priority, 1)
+			return
+		}
+	}
+	if s.queues[e.priority.index()].add(e) {
+		s.pin(hash, e.priority)
+	}
+}
+
+// advance records t as the end timestamp of the most recently enqueued point of the series.
+// It returns false if a point at or after t was already enqueued for the series. GCM rejects
+// such points and fails the entire request they are part of.
+func (s *shard) advance(hash uint64, t int64) bool {
+	s.lastMtx.Lock()
+	defer s.lastMtx.Unlock()
+
+	if last, ok := s.lastEnqueued[hash]; ok && t <= last {
+		return false
 	}
-	if !s.queue.add(e) {
-		// TODO(freinartz): tail drop is not a great solution. Once we have the WAL buffer,
-		// we can just block here when enqueueing from it.
-		samplesDropped.WithLabelValues("queue-full").Inc()
+	s.lastEnqueued[hash] = t
+	return true
+}
+
+// pruneLastEnqueued forgets the series whose most recent point ended before the given
+// timestamp in milliseconds.
+func (s *shard) pruneLastEnqueued(before int64) {
+	s.lastMtx.Lock()
+	defer s.lastMtx.Unlock()
+
+	for h, t := range s.lastEnqueued {
+		if t < before {
+			delete(s.lastEnqueued, h)
+		}
 	}
 }
 
+// tryEnqueue adds the entry to the queue. It returns false if the queue is full.
+func (s *shard) tryEnqueue(e queueEntry) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.queuedLen() >= s.size {
+		return false
+	}
+	e.priority = s.queueFor(e.hash, e.priority)
+
+	if !s.queues[e.priority.index()].add(e) {
+		return false
+	}
+	s.pin(e.hash, e.priority)
+	return true
+}
+
+// pinnedSeries is the queue of a series with entries in the shard.
+type pinnedSeries struct {
+	priority priority
+	// Number of entries of the series in the shard.
+	entries int
+}
+
+// queueFor returns the priority class of the queue to which an entry of the series with
+// priority p is added. Must be called with mtx held.
+func (s *shard) queueFor(hash uint64, p priority) priority {
+	if ps, ok := s.pinned[hash]; ok {
+		return ps.priority
+	}
+	return p
+}
+
+// pin records an entry of the series as added to the queue of priority p. Must be called
+// with mtx held.
+func (s *shard) pin(hash uint64, p priority) {
+	if ps, ok := s.pinned[hash]; ok {
+		ps.entries++
+		return
+	}
+	s.pinned[hash] = &pinnedSeries{priority: p, entries: 1}
+}
+
+// unpin records an entry of the series as no longer being in the shard. Must be called
+// with mtx held.
+func (s *shard) unpin(hash uint64) {
+	ps, ok := s.pinned[hash]
+	if !ok {
+		return
+	}
+	if ps.entries--; ps.entries <= 0 {
+		delete(s.pinned, hash)
+	}
+}
+
+// evict drops the newest entry of the lowest priority class below p to make room for
+// an entry of priority p and returns it. It returns false if there is no such entry.
+// Must be called with mtx held.
+func (s *shard) evict(p priority, reason string) (queueEntry, bool) {
+	for q := priorityLow; q < p; q++ {
+		if e, ok := s.queues[q.index()].removeLast(); ok {
+			dropQueued(reason, e.priority, 1)
+			s.unpin(e.hash)
+			return e, true
+		}
+	}
+	return queueEntry{}, false
+}
+
+// queuedLen returns the number of entries in all queues. Must be called with mtx held.
+func (s *shard) queuedLen() int {
+	n := 0
+	for _, q := range s.queues {
+		n += q.length()
+	}
+	return n
+}
+
 // fill adds samples to the batch until its capacity is reached or the shard
 // has no more samples for series that are not in the batch yet.
 func (s *shard) fill(batch *batch) (took, remaining int) {
@@ -64,26 +203,59 @@ func (s *shard) fill(batch *batch) (took, remaining int) {
 
 	if s.pending {
 		shardProcessPending.Inc()
-		return 0, s.queue.length()
+		return 0, s.queuedLen()
 	}
 	n := 0
 
-	for !batch.full() {
-		e, ok := s.queue.peek()
-		if !ok {
-			break
+	// Delayed entries are older than any queued entries of the same project and are
+	// thus added first.
+	for pid, entries := range s.delayed {
+		i := 0
+		for ; i < len(entries) && !batch.full(); i++ {
+			if _, ok := s.seen[entries[i].hash]; ok {
+				break
+			}
+			if !batch.allowProject(pid) {
+				break
+			}
+			batch.addEntry(s, entries[i])
+			s.seen[entries[i].hash] = struct{}{}
+			s.inflight = append(s.inflight, entries[i].hash)
+			n++
 		}
+		s.removeDelayed(batch, pid, i)
+	}
 
-		// If we already added a sample for the same series to the batch, stop
-		// the filling entirely.
-		if _, ok := s.seen[e.hash]; ok {
-			break
-		}
-		s.queue.remove()
+	// Take entries of higher priority classes first. All samples of a series are in
+	// the same queue.
+	for p := priorityHigh; p >= priorityLow && !batch.full(); p-- {
+		q := s.queues[p.index()]
+
+		for !batch.full() {
+			e, ok := q.peek()
+			if !ok {
+				break
+			}
 
-		batch.add(e.sample)
-		s.seen[e.hash] = struct{}{}
-		n++
+			// If we already added a sample for the same series to the batch, stop
+			// filling from the queue entirely.
+			if _, ok := s.seen[e.hash]; ok {
+				break
+			}
+			q.remove()
+
+			// Entries of a project with delayed entries must be delayed as well to retain
+			// their order.
+			pid := e.sample.Resource.Labels[KeyProjectID]
+			if len(s.delayed[pid]) > 0 || !batch.allowProject(pid) {
+				s.rateLimited(batch, pid, e)
+				continue
+			}
+			batch.addEntry(s, e)
+			s.seen[e.hash] = struct{}{}
+			s.inflight = append(s.inflight, e.hash)
+			n++
+		}
 	}
 
 	if n > 0 {
@@ -96,7 +268,117 @@ func (s *shard) fill(batch *batch) (took, remaining int) {
 	for k := range s.seen {
 		delete(s.seen, k)
 	}
-	return n, s.queue.length()
+	return n, s.queuedLen() + s.delayedLen
+}
+
+// rateLimited handles an entry of a project that exceeded its write rate limit
+// according to the limit policy.
+func (s *shard) rateLimited(batch *batch, pid string, e queueEntry) {
+	if !batch.projectLimiter.delay() {
+		batch.dropRateLimited(pid, e)
+		s.unpin(e.hash)
+		return
+	}
+	// The delayed entries are bounded by the queue size. Beyond that, the oldest entries
+	// of the project are dropped.
+	if s.delayedLen >= s.size {
+		if len(s.delayed[pid]) == 0 {
+			batch.dropRateLimited(pid, e)
+			s.unpin(e.hash)
+			return
+		}
+		batch.dropRateLimited(pid, s.delayed[pid][0])
+		s.unpin(s.delayed[pid][0].hash)
+		s.removeDelayed(batch, pid, 1)
+	}
+	if s.delayed == nil {
+		s.delayed = map[string][]queueEntry{}
+	}
+	s.delayed[pid] = append(s.delayed[pid], e)
+	s.delayedLen++
+	batch.projectLimiter.addDelayed(1)
+	projectSamplesThrottled.WithLabelValues(pid).Inc()
+}
+
+// removeDelayed removes the first n delayed entries of the project.
+func (s *shard) removeDelayed(batch *batch, pid string, n int) {
+	if n == 0 {
+		return
+	}
+	if rest := s.delayed[pid][n:]; len(rest) > 0 {
+		s.delayed[pid] = rest
+	} else {
+		delete(s.delayed, pid)
+	}
+	s.delayedLen -= n
+	batch.projectLimiter.addDelayed(-n)
+}
+
+// requeue adds entries of a failed request back to the front of their queues so they are
+// sent before any newer samples of the same series. Must only be called while the shard
+// is pending. It returns the number of requeued entries and the entries that were dropped
+// for good, which includes entries of lower priority evicted to make room.
+func (s *shard) requeue(entries []queueEntry) (retried int, dropped []queueEntry) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	// Prepend in reverse order to retain the original order. Entries of series that have newer
+	// entries in another queue are prepended to that one.
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		e.priority = s.queueFor(e.hash, e.priority)
+
+		if s.queuedLen() >= s.size {
+			evicted, ok := s.evict(e.priority, "retry-queue-full")
+			if !ok {
+				dropQueued("retry-queue-full", e.priority, 1)
+				dropped = append(dropped, e)
+				continue
+			}
+			dropped = append(dropped, evicted)
+		}
+		s.queues[e.priority.index()].prepend(e)
+		s.pin(e.hash, e.priority)
+		retried++
+	}
+	return retried, dropped
+}
+
+// dropAll removes all queued and delayed entries and returns them.
+func (s *shard) dropAll() []queueEntry {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var res []queueEntry
+	for _, q := range s.queues {
+		for {
+			e, ok := q.peek()
+			if !ok {
+				break
+			}
+			q.remove()
+			res = append(res, e)
+		}
+	}
+	for pid, l := range s.delayed {
+		res = append(res, l...)
+		delete(s.delayed, pid)
+	}
+	s.delayedLen = 0
+
+	for _, e := range res {
+		s.unpin(e.hash)
+	}
+
+	return res
+}
+
+// length returns the number of queued and delayed entries.
+func (s *shard) length() int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return s.queuedLen() + s.delayedLen
 }
 
 func (s *shard) setPending(b bool) {
@@ -111,29 +393,74 @@ func (s *shard) notifyDone() {
 	s.mtx.Lock()
 	defer s.mtx.Unlock()
 	s.setPending(false)
+
+	// Entries of the batch were sent, dropped, or requeued by now.
+	for _, h := range s.inflight {
+		s.unpin(h)
+	}
+	s.inflight = s.inflight[:0]
 }
 
 type queue struct {
 	buf        []queueEntry
 	head, tail int
 	len        int
+	// Maximum number of entries. The buffer grows up to this size as needed.
+	size int
 }
 
 type queueEntry struct {
 	hash   uint64
 	sample *monitoring_pb.TimeSeries
+	// Reference of the entry in the write-ahead buffer. Zero if the entry
+	// was not read from the buffer.
+	walRef uint64
+	// Number of times sending the entry was retried.
+	attempts uint
+	// Priority class of the series of the entry.
+	priority priority
 }
 
+// Initial buffer size of queues.
+const queueMinSize = 64
+
 func newQueue(size uint) *queue {
-	return &queue{buf: make([]queueEntry, size)}
+	return &queue{size: int(size)}
 }
 
 func (q *queue) length() int {
 	return q.len
 }
 
+// grow increases the buffer size if the queue is at capacity. It returns false if
+// the queue is at its maximum size.
+func (q *queue) grow() bool {
+	if q.len < len(q.buf) {
+		return true
+	}
+	if q.len >= q.size {
+		return false
+	}
+	n := 2 * len(q.buf)
+	if n < queueMinSize {
+		n = queueMinSize
+	}
+	if n > q.size {
+		n = q.size
+	}
+	buf := make([]queueEntry, n)
+	for i := 0; i < q.len; i++ {
+		buf[i] = q.buf[(q.head+i)%len(q.buf)]
+	}
+	q.buf = buf
+	q.head = 0
+	q.tail = q.len % n
+
+	return true
+}
+
 func (q *queue) add(e queueEntry) bool {
-	if q.len == len(q.buf) {
+	if !q.grow() {
 		return false
 	}
 	q.buf[q.tail] = e
@@ -143,6 +470,18 @@ func (q *queue) add(e queueEntry) bool {
 	return true
 }
 
+// prepend adds the entry to the front of the queue.
+func (q *queue) prepend(e queueEntry) bool {
+	if !q.grow() {
+		return false
+	}
+	q.head = (q.head - 1 + len(q.buf)) % len(q.buf)
+	q.buf[q.head] = e
+	q.len++
+
+	return true
+}
+
 func (q *queue) peek() (queueEntry, bool) {
 	if q.len < 1 {
 		return queueEntry{}, false
@@ -160,3 +499,16 @@ func (q *queue) remove() bool {
 
 	return true
 }
+
+// removeLast removes and returns the last entry of the queue.
+func (q *queue) removeLast() (queueEntry, bool) {
+	if q.len < 1 {
+		return queueEntry{}, false
+	}
+	q.tail = (q.tail - 1 + len(q.buf)) % len(q.buf)
+	e := q.buf[q.tail]
+	q.buf[q.tail] = queueEntry{}
+	q.len--
+
+	return e, true
+}
@@ -3,6 +3,10 @@ package export
 import (
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
 )
 
 func TestEnqueue(t *testing.T) {
@@ -12,7 +16,7 @@ func TestEnqueue(t *testing.T) {
 
 	ch := make(chan bool)
 	go func() {
-		s.enqueue(1, nil)
+		s.enqueue(1, nil, priorityNormal)
 		ch <- true
 	}()
 
@@ -32,3 +36,188 @@ func TestEnqueue(t *testing.T) {
 		}
 	}
 }
+
+func TestShardFill_projectRateLimit(t *testing.T) {
+	for _, policy := range []string{RateLimitPolicyDelay, RateLimitPolicyDropOldest} {
+		t.Run(policy, func(t *testing.T) {
+			s := newShard(100)
+			// Interleave samples of a limited and an unlimited project.
+			for i := 0; i < 20; i++ {
+				pid := "limited"
+				if i%2 == 1 {
+					pid = "unlimited"
+				}
+				s.enqueue(uint64(i), &monitoring_pb.TimeSeries{
+					Resource: &monitoredres_pb.MonitoredResource{
+						Labels: map[string]string{KeyProjectID: pid},
+					},
+				}, priorityNormal)
+			}
+			limiter := newProjectLimiter(ProjectRateLimitOpts{
+				Limits: map[string]float64{"limited": 2},
+				Policy: policy,
+			})
+			dropped := testutil.ToFloat64(projectSamplesDropped.WithLabelValues("limited"))
+
+			b := newBatch(nil, DefaultShardCount, 100)
+			b.projectLimiter = limiter
+			s.fill(b)
+
+			// The limited project must not hold up the other one.
+			if got := len(b.m["unlimited"]); got != 10 {
+				t.Fatalf("expected 10 samples for unlimited project, got %d", got)
+			}
+			if got := len(b.m["limited"]); got != 2 {
+				t.Fatalf("expected 2 samples for limited project, got %d", got)
+			}
+			switch policy {
+			case RateLimitPolicyDelay:
+				if got := s.length(); got != 8 {
+					t.Fatalf("expected 8 delayed samples, got %d", got)
+				}
+				if !limiter.hasDelayed() {
+					t.Fatalf("expected limiter to report delayed samples")
+				}
+				// Delayed samples keep their order.
+				for i, e := range s.delayed["limited"] {
+					if want := uint64(4 + 2*i); e.hash != want {
+						t.Fatalf("unexpected delayed entry %d: want hash %d, got %d", i, want, e.hash)
+					}
+				}
+			case RateLimitPolicyDropOldest:
+				if got := s.length(); got != 0 {
+					t.Fatalf("expected no remaining samples, got %d", got)
+				}
+				if got := testutil.ToFloat64(projectSamplesDropped.WithLabelValues("limited")) - dropped; got != 8 {
+					t.Fatalf("expected 8 dropped samples, got %v", got)
+				}
+			}
+		})
+	}
+}
+
+func TestShardEnqueue_priority(t *testing.T) {
+	s := newShard(4)
+
+	sample := &monitoring_pb.TimeSeries{
+		Resource: &monitoredres_pb.MonitoredResource{
+			Labels: map[string]string{KeyProjectID: "project"},
+		},
+	}
+	evicted := testutil.ToFloat64(samplesDroppedByPriority.WithLabelValues("queue-full", "low"))
+	dropped := testutil.ToFloat64(samplesDroppedByPriority.WithLabelValues("queue-full", "normal"))
+
+	s.enqueue(1, sample, priorityLow)
+	s.enqueue(2, sample, priorityLow)
+	s.enqueue(3, sample, priorityNormal)
+	s.enqueue(4, sample, priorityNormal)
+	// The queue is full. Samples of higher priority evict the newest ones of the lowest
+	// priority while samples of equal priority are dropped.
+	s.enqueue(5, sample, priorityHigh)
+	s.enqueue(6, sample, priorityNormal)
+	s.enqueue(7, sample, priorityHigh)
+	s.enqueue(8, sample, priorityHigh)
+
+	if got := testutil.ToFloat64(samplesDroppedByPriority.WithLabelValues("queue-full", "low")) - evicted; got != 2 {
+		t.Fatalf("expected 2 low priority samples dropped, got %v", got)
+	}
+	if got := testutil.ToFloat64(samplesDroppedByPriority.WithLabelValues("queue-full", "normal")) - dropped; got != 2 {
+		t.Fatalf("expected 2 normal priority samples dropped, got %v", got)
+	}
+	// Batches are filled with samples of higher priority first.
+	b := newBatch(nil, DefaultShardCount, 100)
+	s.fill(b)
+
+	var got []uint64
+	for _, e := range b.entries["project"] {
+		got = append(got, e.hash)
+	}
+	want := []uint64{5, 7, 8, 3}
+	if len(got) != len(want) {
+		t.Fatalf("expected batch %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected batch %v, got %v", want, got)
+		}
+	}
+}
+
+func TestShardEnqueue_priorityChange(t *testing.T) {
+	s := newShard(10)
+
+	sample := func() *monitoring_pb.TimeSeries {
+		return &monitoring_pb.TimeSeries{
+			Resource: &monitoredres_pb.MonitoredResource{
+				Labels: map[string]string{KeyProjectID: "project"},
+			},
+		}
+	}
+	first, second := sample(), sample()
+
+	// The priority of series 1 changes while it has a queued sample. Its newer sample
+	// must stay behind the older one.
+	s.enqueue(1, first, priorityLow)
+	s.enqueue(2, sample(), priorityNormal)
+	s.enqueue(1, second, priorityHigh)
+
+	if n := s.queues[priorityHigh.index()].length(); n != 0 {
+		t.Fatalf("expected no high priority samples, got %d", n)
+	}
+	fill := func() []*monitoring_pb.TimeSeries {
+		b := newBatch(nil, DefaultShardCount, 100)
+		s.fill(b)
+		s.notifyDone()
+
+		var res []*monitoring_pb.TimeSeries
+		for _, e := range b.entries["project"] {
+			if e.hash == 1 {
+				res = append(res, e.sample)
+			}
+		}
+		return res
+	}
+	if got := fill(); len(got) != 1 || got[0] != first {
+		t.Fatalf("expected first sample of series 1 in first batch")
+	}
+	if got := fill(); len(got) != 1 || got[0] != second {
+		t.Fatalf("expected second sample of series 1 in second batch")
+	}
+	// Once the series has no more samples in the shard, its new priority applies.
+	if len(s.pinned) != 0 {
+		t.Fatalf("expected no pinned series, got %d", len(s.pinned))
+	}
+	s.enqueue(1, sample(), priorityHigh)
+
+	if n := s.queues[priorityHigh.index()].length(); n != 1 {
+		t.Fatalf("expected 1 high priority sample, got %d", n)
+	}
+}
+
+func TestShardAdvance(t *testing.T) {
+	s := newShard(4)
+
+	for _, c := range []struct {
+		hash uint64
+		t    int64
+		want bool
+	}{
+		{hash: 1, t: 1000, want: true},
+		{hash: 1, t: 1000, want: false},
+		{hash: 1, t: 999, want: false},
+		{hash: 2, t: 999, want: true},
+		{hash: 1, t: 1001, want: true},
+	} {
+		if got := s.advance(c.hash, c.t); got != c.want {
+			t.Fatalf("advance(%d, %d): expected %v, got %v", c.hash, c.t, c.want, got)
+		}
+	}
+	// Pruned series accept any point again.
+	s.pruneLastEnqueued(1000)
+	if !s.advance(2, 500) {
+		t.Fatal("expected pruned series to advance")
+	}
+	if s.advance(1, 1001) {
+		t.Fatal("expected series that was not pruned to remain guarded")
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Sink is the destination of converted time series. The exporter calls Send concurrently
+// with batches of at most BatchSizeMax series that all belong to the same project. It
+// guarantees that there is at most one in-flight call with a point for any given series.
+//
+// Errors carrying a gRPC status are classified like GCM API errors for the purpose of
+// retries and dropped sample accounting.
+type Sink interface {
+	// Send writes the time series to the given project.
+	Send(ctx context.Context, projectID string, series []*monitoring_pb.TimeSeries) error
+	// Close releases resources held by the sink. Send is not called after Close.
+	Close() error
+}
+
+// gcmSink writes time series to the GCM API.
+type gcmSink struct {
+	client *monitoring.MetricClient
+}
+
+// NewGCMSink returns a sink that writes time series to the GCM API through the client.
+// Closing the sink closes the client.
+func NewGCMSink(client *monitoring.MetricClient) Sink {
+	return &gcmSink{client: client}
+}
+
+func (s *gcmSink) Send(ctx context.Context, projectID string, series []*monitoring_pb.TimeSeries) error {
+	return s.client.CreateTimeSeries(ctx, &monitoring_pb.CreateTimeSeriesRequest{
+		Name:       fmt.Sprintf("projects/%s", projectID),
+		TimeSeries: series,
+	})
+}
+
+func (s *gcmSink) Close() error {
+	return s.client.Close()
+}
+
+// MemorySink is a sink that retains all time series in memory.
+type MemorySink struct {
+	mtx    sync.Mutex
+	series map[string][]*monitoring_pb.TimeSeries
+}
+
+// NewMemorySink returns a new in-memory sink.
+func NewMemorySink() *MemorySink {
+	return &MemorySink{series: map[string][]*monitoring_pb.TimeSeries{}}
+}
+
+func (s *MemorySink) Send(_ context.Context, projectID string, series []*monitoring_pb.TimeSeries) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.series[projectID] = append(s.series[projectID], series...)
+	return nil
+}
+
+func (s *MemorySink) Close() error {
+	return nil
+}
+
+// Series returns all time series written to the project so far.
+func (s *MemorySink) Series(projectID string) []*monitoring_pb.TimeSeries {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]*monitoring_pb.TimeSeries(nil), s.series[projectID]...)
+}
+
+// Projects returns all projects written to so far.
+func (s *MemorySink) Projects() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var projects []string
+	for p := range s.series {
+		projects = append(projects, p)
+	}
+	return projects
+}
+
+// FileSink is a sink that writes each batch as a JSON-encoded CreateTimeSeriesRequest
+// on a separate line to a file.
+type FileSink struct {
+	mtx sync.Mutex
+	f   *os.File
+	w   *bufio.Writer
+}
+
+// NewFileSink returns a sink that appends to the file at the given path.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &FileSink{f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (s *FileSink) Send(_ context.Context, projectID string, series []*monitoring_pb.TimeSeries) error {
+	b, err := protojson.Marshal(&monitoring_pb.CreateTimeSeriesRequest{
+		Name:       fmt.Sprintf("projects/%s", projectID),
+		TimeSeries: series,
+	})
+	if err != nil {
+		return fmt.Errorf("encode request: %w", err)
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if _, err := s.w.Write(b); err != nil {
+		return err
+	}
+	return s.w.WriteByte('\n')
+}
+
+func (s *FileSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"bufio"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "requests.jsonl")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*monitoring_pb.CreateTimeSeriesRequest{
+		{
+			Name:       "projects/p1",
+			TimeSeries: []*monitoring_pb.TimeSeries{testWALSeries(1).proto, testWALSeries(2).proto},
+		}, {
+			Name:       "projects/p2",
+			TimeSeries: []*monitoring_pb.TimeSeries{testWALSeries(3).proto},
+		},
+	}
+	if err := sink.Send(context.Background(), "p1", want[0].TimeSeries); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send(context.Background(), "p2", want[1].TimeSeries); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var got []*monitoring_pb.CreateTimeSeriesRequest
+	for sc := bufio.NewScanner(f); sc.Scan(); {
+		var req monitoring_pb.CreateTimeSeriesRequest
+		if err := protojson.Unmarshal(sc.Bytes(), &req); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, &req)
+	}
+	if diff := cmp.Diff(want, got, protocmp.Transform()); diff != "" {
+		t.Fatalf("unexpected requests (-want, +got): %s", diff)
+	}
+}
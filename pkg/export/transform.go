@@ -108,6 +108,22 @@ func (b *sampleBuilder) next(metadata MetadataFunc, externalLabels labels.Labels
 		return nil, tailSamples, nil
 	}
 	if entry.dropped {
+		if entry.relabelDropped {
+			prometheusSamplesDiscarded.WithLabelValues("relabel-dropped").Inc()
+			discardExemplarIncIfExists(storage.SeriesRef(sample.Ref), exemplars, "relabel-dropped")
+		} else if entry.limitDropped {
+			samplesDropped.WithLabelValues("cardinality-limit").Inc()
+			discardExemplarIncIfExists(storage.SeriesRef(sample.Ref), exemplars, "cardinality-limit")
+		}
+		return nil, tailSamples, nil
+	}
+	if entry.gcmLimitsExceeded {
+		samplesDropped.WithLabelValues("gcm-limits-exceeded").Inc()
+		discardExemplarIncIfExists(storage.SeriesRef(sample.Ref), exemplars, "gcm-limits-exceeded")
+		return nil, tailSamples, nil
+	}
+	if entry.created {
+		b.series.setCreated(entry.createdKey, sample.V)
 		return nil, tailSamples, nil
 	}
 
@@ -118,17 +134,45 @@ func (b *sampleBuilder) next(metadata MetadataFunc, externalLabels labels.Labels
 	// based on the type determined in the series cache.
 	// If both are set, we double-write the series as a gauge and a cumulative.
 	if g := entry.protos.gauge; g.proto != nil {
-		ts := *g.proto
+		value := &monitoring_pb.TypedValue{
+			Value: &monitoring_pb.TypedValue_DoubleValue{sample.V},
+		}
+		if entry.metadata.Type == textparse.MetricTypeGaugeHistogram {
+			// Consume a set of series as a single distribution sample like for histograms.
+			// The distribution is not reset-adjusted as gauge histograms may decrease.
+			var (
+				v   *distribution_pb.Distribution
+				err error
+			)
+			v, _, tailSamples, err = b.buildDistribution(
+				entry.metadata.Metric,
+				entry.lset,
+				samples,
+				exemplars,
+				externalLabels,
+				metadata,
+			)
+			if err != nil {
+				return nil, tailSamples, err
+			}
+			value = nil
+			if v != nil {
+				value = &monitoring_pb.TypedValue{
+					Value: &monitoring_pb.TypedValue_DistributionValue{v},
+				}
+			}
+		}
+		if value != nil {
+			ts := *g.proto
 
-		ts.Points = []*monitoring_pb.Point{{
-			Interval: &monitoring_pb.TimeInterval{
-				EndTime: getTimestamp(sample.T),
-			},
-			Value: &monitoring_pb.TypedValue{
-				Value: &monitoring_pb.TypedValue_DoubleValue{sample.V},
-			},
-		}}
-		result = append(result, hashedSeries{hash: g.hash, proto: &ts})
+			ts.Points = []*monitoring_pb.Point{{
+				Interval: &monitoring_pb.TimeInterval{
+					EndTime: getTimestamp(sample.T),
+				},
+				Value: value,
+			}}
+			result = append(result, hashedSeries{hash: g.hash, proto: &ts, priority: entry.priority})
+		}
 	}
 	if c := entry.protos.cumulative; c.proto != nil {
 		var (
@@ -183,9 +227,22 @@ func (b *sampleBuilder) next(metadata MetadataFunc, externalLabels labels.Labels
 				},
 				Value: value,
 			}}
-			result = append(result, hashedSeries{hash: c.hash, proto: &ts})
+			result = append(result, hashedSeries{hash: c.hash, proto: &ts, priority: entry.priority})
 		}
 	}
+	// Points of aggregated series are merged into their aggregate, which is exported
+	// separately.
+	if len(result) > 0 && entry.aggregation != nil {
+		b.series.aggregator.add(entry.aggregation, storage.SeriesRef(sample.Ref), result, b.series.now())
+		samplesAggregated.Add(float64(len(result)))
+		return nil, tailSamples, nil
+	}
+	// Skip points within the minimum export interval of the series. Cumulative points
+	// remain correct as the reset state was still updated with the skipped samples.
+	if len(result) > 0 && entry.exportInterval > 0 && b.series.skipExport(storage.SeriesRef(sample.Ref), sample.T) {
+		samplesSkipped.Add(float64(len(result)))
+		return nil, tailSamples, nil
+	}
 	return result, tailSamples, nil
 }
 
@@ -297,7 +354,8 @@ func (d *distribution) build(lset labels.Labels) (*distribution_pb.Distribution,
 	// For the sum series this has been observed in the wild.
 	// As NaN is not a permitted mean value in Cloud Monitoring, we leave it at the default 0 in this case.
 	// For the count we overrode it with the inf bucket value anyway and thus don't need special handling.
-	if !math.IsNaN(d.sum) && d.count > 0 {
+	// Gauge histograms may not have a sum at all, in which case the mean is unknown as well.
+	if d.hasSum && !math.IsNaN(d.sum) && d.count > 0 {
 		mean = d.sum / d.count
 	}
 
@@ -318,8 +376,10 @@ func (d *distribution) build(lset labels.Labels) (*distribution_pb.Distribution,
 				lset, d.count, d.sum, dev, i, d.values[i], prevVal)
 			return nil, err
 		}
-		x := (prevBound + bound) / 2
-		dev += float64(val) * (x - mean) * (x - mean)
+		if d.hasSum {
+			x := (prevBound + bound) / 2
+			dev += float64(val) * (x - mean) * (x - mean)
+		}
 
 		prevBound = bound
 		prevVal = d.values[i]
@@ -363,8 +423,31 @@ func isHistogramSeries(metric, name string) bool {
 	if !strings.HasPrefix(name, metric) {
 		return false
 	}
-	s := metricSuffix(name[len(metric):])
-	return s == metricSuffixBucket || s == metricSuffixSum || s == metricSuffixCount
+	switch metricSuffix(name[len(metric):]) {
+	case metricSuffixBucket, metricSuffixSum, metricSuffixCount, metricSuffixCreated, metricSuffixGSum, metricSuffixGCount:
+		return true
+	}
+	return false
+}
+
+// observeCreated records the creation timestamps of all _created series in the batch. They
+// generally follow the series they apply to and must be known before those are converted.
+// Cached series are only looked up. Others are populated, which converting them does
+// otherwise.
+func (b *sampleBuilder) observeCreated(metadata MetadataFunc, externalLabels labels.Labels, samples []record.RefSample) {
+	for _, s := range samples {
+		if value.IsStaleNaN(s.V) {
+			continue
+		}
+		key, cached, created := b.series.lookupCreated(storage.SeriesRef(s.Ref))
+		if !cached {
+			e, ok := b.series.get(s, externalLabels, metadata)
+			key, created = e.createdKey, ok && e.created && !e.dropped
+		}
+		if created {
+			b.series.setCreated(key, s.V)
+		}
+	}
 }
 
 // buildDistribution consumes series from the input slice and populates the histogram cache with it.
@@ -402,12 +485,40 @@ Loop:
 		}
 		consumed++
 
+		// Dropped bucket series, e.g. through relabeling, must not be merged into the
+		// distribution.
+		if e.dropped {
+			if e.relabelDropped {
+				prometheusSamplesDiscarded.WithLabelValues("relabel-dropped").Inc()
+				discardExemplarIncIfExists(storage.SeriesRef(s.Ref), exemplars, "relabel-dropped")
+			} else if e.limitDropped {
+				samplesDropped.WithLabelValues("cardinality-limit").Inc()
+				discardExemplarIncIfExists(storage.SeriesRef(s.Ref), exemplars, "cardinality-limit")
+			}
+			continue
+		}
+		if e.gcmLimitsExceeded {
+			samplesDropped.WithLabelValues("gcm-limits-exceeded").Inc()
+			discardExemplarIncIfExists(storage.SeriesRef(s.Ref), exemplars, "gcm-limits-exceeded")
+			continue
+		}
+		if e.created {
+			b.series.setCreated(e.createdKey, s.V)
+			continue
+		}
+
+		// Gauge histograms are written as gauges and their samples are used as is.
+		gauge := e.metadata.Type == textparse.MetricTypeGaugeHistogram
+		key := e.protos.cumulative.hash
+		if gauge {
+			key = e.protos.gauge.hash
+		}
 		// Create or update the cached distribution for the given histogram series
-		dist, ok := b.dists[e.protos.cumulative.hash]
+		dist, ok := b.dists[key]
 		if !ok {
 			dist = getDistribution()
 			dist.timestamp = s.T
-			b.dists[e.protos.cumulative.hash] = dist
+			b.dists[key] = dist
 		}
 		// If there are diverging timestamps within a single batch, the histogram is not valid.
 		if s.T != dist.timestamp {
@@ -417,23 +528,26 @@ Loop:
 			continue
 		}
 
-		rt, v, ok := b.series.getResetAdjusted(storage.SeriesRef(s.Ref), s.T, s.V)
-		// If a series appeared for the first time, we won't get a valid reset timestamp yet.
-		// This may happen if the histogram is entirely new or if new series appeared through bucket changes.
-		// We skip the entire distribution sample in this case.
-		if !ok {
-			dist.skip = true
-			continue
+		rt, v := int64(0), s.V
+		if !gauge {
+			rt, v, ok = b.series.getResetAdjusted(storage.SeriesRef(s.Ref), s.T, s.V)
+			// If a series appeared for the first time, we won't get a valid reset timestamp yet.
+			// This may happen if the histogram is entirely new or if new series appeared through bucket changes.
+			// We skip the entire distribution sample in this case.
+			if !ok {
+				dist.skip = true
+				continue
+			}
 		}
 
 		// All series can in principle have a NaN value (staleness NaNs already filtered).
 		// We permit this for sum and count as we handle it explicitly when building the distribution.
 		// For buckets there's not sensible way to handle it however and we discard those bucket samples.
 		switch metricSuffix(name[len(metric):]) {
-		case metricSuffixSum:
+		case metricSuffixSum, metricSuffixGSum:
 			dist.hasSum, dist.sum = true, v
 
-		case metricSuffixCount:
+		case metricSuffixCount, metricSuffixGCount:
 			dist.hasCount, dist.count = true, v
 			// We take the count series as the authoritative source for the overall reset timestamp.
 			dist.resetTimestamp = rt
@@ -464,7 +578,11 @@ Loop:
 			break Loop
 		}
 
-		if !dist.complete() {
+		// The sum of gauge histograms is optional. Without it, their distribution is complete
+		// once the count and +Inf bucket were observed and takes a directly following sum.
+		if gauge && !dist.skip && !dist.hasSum && dist.hasCount && dist.hasInfBucket {
+			consumed += b.gaugeHistogramSum(dist, key, samples[consumed:], externalLabels, metadata)
+		} else if !dist.complete() {
 			continue
 		}
 		dp, err := dist.build(e.lset)
@@ -482,6 +600,27 @@ Loop:
 	return nil, 0, samples[consumed:], nil
 }
 
+// gaugeHistogramSum sets the sum of the gauge histogram distribution with the given key if
+// the first sample is its _gsum series. It returns the number of consumed samples.
+func (b *sampleBuilder) gaugeHistogramSum(
+	dist *distribution,
+	key uint64,
+	samples []record.RefSample,
+	externalLabels labels.Labels,
+	metadata MetadataFunc,
+) int {
+	if len(samples) == 0 {
+		return 0
+	}
+	s := samples[0]
+	e, ok := b.series.get(s, externalLabels, metadata)
+	if !ok || e.dropped || e.gcmLimitsExceeded || e.suffix != metricSuffixGSum || e.protos.gauge.hash != key || s.T != dist.timestamp {
+		return 0
+	}
+	dist.hasSum, dist.sum = true, s.V
+	return 1
+}
+
 func buildExemplars(exemplars []record.RefExemplar) []*distribution_pb.Distribution_Exemplar {
 	// The exemplars field of a distribution value field must be in increasing order of value
 	// (https://cloud.google.com/monitoring/api/ref_v3/rpc/google.api#distribution) -- let's sort them.
@@ -18,13 +18,18 @@ import (
 	"fmt"
 	"math"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/model/textparse"
 	"github.com/prometheus/prometheus/model/value"
 	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunks"
 	"github.com/prometheus/prometheus/tsdb/record"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/testing/protocmp"
@@ -1474,6 +1479,327 @@ func TestSampleBuilder(t *testing.T) {
 					}},
 				},
 			},
+		}, {
+			doc: "convert info",
+			metadata: testMetadataFunc(metricMetadataMap{
+				"metric1": {Type: textparse.MetricTypeInfo, Help: "metric1 help text"},
+			}),
+			series: seriesMap{
+				1: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_info", "version", "1.2.3"),
+			},
+			samples: [][]record.RefSample{
+				{{Ref: 1, T: 1000, V: 1}},
+				{{Ref: 1, T: 2000, V: 1}},
+			},
+			wantSeries: []*monitoring_pb.TimeSeries{
+				{
+					Resource: &monitoredres_pb.MonitoredResource{
+						Type: "prometheus_target",
+						Labels: map[string]string{
+							"project_id": "example-project",
+							"location":   "europe",
+							"cluster":    "foo-cluster",
+							"namespace":  "",
+							"job":        "job1",
+							"instance":   "instance1",
+						},
+					},
+					Metric: &metric_pb.Metric{
+						Type:   "prometheus.googleapis.com/metric1_info/info",
+						Labels: map[string]string{"version": "1.2.3"},
+					},
+					MetricKind: metric_pb.MetricDescriptor_GAUGE,
+					ValueType:  metric_pb.MetricDescriptor_DOUBLE,
+					Points: []*monitoring_pb.Point{{
+						Interval: &monitoring_pb.TimeInterval{
+							EndTime: &timestamp_pb.Timestamp{Seconds: 1},
+						},
+						Value: &monitoring_pb.TypedValue{
+							Value: &monitoring_pb.TypedValue_DoubleValue{1},
+						},
+					}},
+				},
+				{
+					Resource: &monitoredres_pb.MonitoredResource{
+						Type: "prometheus_target",
+						Labels: map[string]string{
+							"project_id": "example-project",
+							"location":   "europe",
+							"cluster":    "foo-cluster",
+							"namespace":  "",
+							"job":        "job1",
+							"instance":   "instance1",
+						},
+					},
+					Metric: &metric_pb.Metric{
+						Type:   "prometheus.googleapis.com/metric1_info/info",
+						Labels: map[string]string{"version": "1.2.3"},
+					},
+					MetricKind: metric_pb.MetricDescriptor_GAUGE,
+					ValueType:  metric_pb.MetricDescriptor_DOUBLE,
+					Points: []*monitoring_pb.Point{{
+						Interval: &monitoring_pb.TimeInterval{
+							EndTime: &timestamp_pb.Timestamp{Seconds: 2},
+						},
+						Value: &monitoring_pb.TypedValue{
+							Value: &monitoring_pb.TypedValue_DoubleValue{1},
+						},
+					}},
+				},
+			},
+		}, {
+			doc: "convert stateset",
+			metadata: testMetadataFunc(metricMetadataMap{
+				"metric1": {Type: textparse.MetricTypeStateset, Help: "metric1 help text"},
+			}),
+			series: seriesMap{
+				1: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1", "metric1", "a"),
+				2: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1", "metric1", "b"),
+			},
+			samples: [][]record.RefSample{
+				{{Ref: 1, T: 1000, V: 1}, {Ref: 2, T: 1000, V: 0}},
+			},
+			wantSeries: []*monitoring_pb.TimeSeries{
+				{
+					Resource: &monitoredres_pb.MonitoredResource{
+						Type: "prometheus_target",
+						Labels: map[string]string{
+							"project_id": "example-project",
+							"location":   "europe",
+							"cluster":    "foo-cluster",
+							"namespace":  "",
+							"job":        "job1",
+							"instance":   "instance1",
+						},
+					},
+					Metric: &metric_pb.Metric{
+						Type:   "prometheus.googleapis.com/metric1/stateset",
+						Labels: map[string]string{"metric1": "a"},
+					},
+					MetricKind: metric_pb.MetricDescriptor_GAUGE,
+					ValueType:  metric_pb.MetricDescriptor_DOUBLE,
+					Points: []*monitoring_pb.Point{{
+						Interval: &monitoring_pb.TimeInterval{
+							EndTime: &timestamp_pb.Timestamp{Seconds: 1},
+						},
+						Value: &monitoring_pb.TypedValue{
+							Value: &monitoring_pb.TypedValue_DoubleValue{1},
+						},
+					}},
+				},
+				{
+					Resource: &monitoredres_pb.MonitoredResource{
+						Type: "prometheus_target",
+						Labels: map[string]string{
+							"project_id": "example-project",
+							"location":   "europe",
+							"cluster":    "foo-cluster",
+							"namespace":  "",
+							"job":        "job1",
+							"instance":   "instance1",
+						},
+					},
+					Metric: &metric_pb.Metric{
+						Type:   "prometheus.googleapis.com/metric1/stateset",
+						Labels: map[string]string{"metric1": "b"},
+					},
+					MetricKind: metric_pb.MetricDescriptor_GAUGE,
+					ValueType:  metric_pb.MetricDescriptor_DOUBLE,
+					Points: []*monitoring_pb.Point{{
+						Interval: &monitoring_pb.TimeInterval{
+							EndTime: &timestamp_pb.Timestamp{Seconds: 1},
+						},
+						Value: &monitoring_pb.TypedValue{
+							Value: &monitoring_pb.TypedValue_DoubleValue{0},
+						},
+					}},
+				},
+			},
+		}, {
+			doc: "convert gauge histogram",
+			metadata: testMetadataFunc(metricMetadataMap{
+				"metric1": {Type: textparse.MetricTypeGaugeHistogram, Help: "metric1 help text"},
+			}),
+			series: seriesMap{
+				1: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_bucket", "le", "1"),
+				2: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_bucket", "le", "2"),
+				3: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_bucket", "le", "+Inf"),
+				4: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_gcount"),
+				5: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_gsum"),
+			},
+			samples: [][]record.RefSample{
+				// Gauge histograms are written from the first sample on and may decrease.
+				{
+					{Ref: 1, T: 1000, V: 2},
+					{Ref: 2, T: 1000, V: 3},
+					{Ref: 3, T: 1000, V: 4},
+					{Ref: 4, T: 1000, V: 4},
+					{Ref: 5, T: 1000, V: 6},
+				},
+				{
+					{Ref: 1, T: 2000, V: 1},
+					{Ref: 2, T: 2000, V: 1},
+					{Ref: 3, T: 2000, V: 2},
+					{Ref: 4, T: 2000, V: 2},
+					{Ref: 5, T: 2000, V: 3},
+				},
+			},
+			wantSeries: []*monitoring_pb.TimeSeries{
+				{
+					Resource: &monitoredres_pb.MonitoredResource{
+						Type: "prometheus_target",
+						Labels: map[string]string{
+							"project_id": "example-project",
+							"location":   "europe",
+							"cluster":    "foo-cluster",
+							"namespace":  "",
+							"job":        "job1",
+							"instance":   "instance1",
+						},
+					},
+					Metric: &metric_pb.Metric{
+						Type:   "prometheus.googleapis.com/metric1/gaugehistogram",
+						Labels: map[string]string{},
+					},
+					MetricKind: metric_pb.MetricDescriptor_GAUGE,
+					ValueType:  metric_pb.MetricDescriptor_DISTRIBUTION,
+					Points: []*monitoring_pb.Point{{
+						Interval: &monitoring_pb.TimeInterval{
+							EndTime: &timestamp_pb.Timestamp{Seconds: 1},
+						},
+						Value: &monitoring_pb.TypedValue{
+							Value: &monitoring_pb.TypedValue_DistributionValue{
+								DistributionValue: &distribution_pb.Distribution{
+									Count:                 4,
+									Mean:                  1.5,
+									SumOfSquaredDeviation: 2.25,
+									BucketOptions: &distribution_pb.Distribution_BucketOptions{
+										Options: &distribution_pb.Distribution_BucketOptions_ExplicitBuckets{
+											ExplicitBuckets: &distribution_pb.Distribution_BucketOptions_Explicit{
+												Bounds: []float64{1, 2},
+											},
+										},
+									},
+									BucketCounts: []int64{2, 1, 1},
+								},
+							},
+						},
+					}},
+				},
+				{
+					Resource: &monitoredres_pb.MonitoredResource{
+						Type: "prometheus_target",
+						Labels: map[string]string{
+							"project_id": "example-project",
+							"location":   "europe",
+							"cluster":    "foo-cluster",
+							"namespace":  "",
+							"job":        "job1",
+							"instance":   "instance1",
+						},
+					},
+					Metric: &metric_pb.Metric{
+						Type:   "prometheus.googleapis.com/metric1/gaugehistogram",
+						Labels: map[string]string{},
+					},
+					MetricKind: metric_pb.MetricDescriptor_GAUGE,
+					ValueType:  metric_pb.MetricDescriptor_DISTRIBUTION,
+					Points: []*monitoring_pb.Point{{
+						Interval: &monitoring_pb.TimeInterval{
+							EndTime: &timestamp_pb.Timestamp{Seconds: 2},
+						},
+						Value: &monitoring_pb.TypedValue{
+							Value: &monitoring_pb.TypedValue_DistributionValue{
+								DistributionValue: &distribution_pb.Distribution{
+									Count:                 2,
+									Mean:                  1.5,
+									SumOfSquaredDeviation: 1.25,
+									BucketOptions: &distribution_pb.Distribution_BucketOptions{
+										Options: &distribution_pb.Distribution_BucketOptions_ExplicitBuckets{
+											ExplicitBuckets: &distribution_pb.Distribution_BucketOptions_Explicit{
+												Bounds: []float64{1, 2},
+											},
+										},
+									},
+									BucketCounts: []int64{1, 0, 1},
+								},
+							},
+						},
+					}},
+				},
+			},
+		}, {
+			doc: "convert gauge histogram without sum",
+			metadata: testMetadataFunc(metricMetadataMap{
+				"metric1": {Type: textparse.MetricTypeGaugeHistogram, Help: "metric1 help text"},
+			}),
+			series: seriesMap{
+				1: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_bucket", "le", "1"),
+				2: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_bucket", "le", "2"),
+				3: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_bucket", "le", "+Inf"),
+				4: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_gcount"),
+			},
+			samples: [][]record.RefSample{
+				{
+					{Ref: 1, T: 1000, V: 2},
+					{Ref: 2, T: 1000, V: 3},
+					{Ref: 3, T: 1000, V: 4},
+					{Ref: 4, T: 1000, V: 4},
+				},
+			},
+			wantSeries: []*monitoring_pb.TimeSeries{
+				{
+					Resource: &monitoredres_pb.MonitoredResource{
+						Type: "prometheus_target",
+						Labels: map[string]string{
+							"project_id": "example-project",
+							"location":   "europe",
+							"cluster":    "foo-cluster",
+							"namespace":  "",
+							"job":        "job1",
+							"instance":   "instance1",
+						},
+					},
+					Metric: &metric_pb.Metric{
+						Type:   "prometheus.googleapis.com/metric1/gaugehistogram",
+						Labels: map[string]string{},
+					},
+					MetricKind: metric_pb.MetricDescriptor_GAUGE,
+					ValueType:  metric_pb.MetricDescriptor_DISTRIBUTION,
+					Points: []*monitoring_pb.Point{{
+						Interval: &monitoring_pb.TimeInterval{
+							EndTime: &timestamp_pb.Timestamp{Seconds: 1},
+						},
+						Value: &monitoring_pb.TypedValue{
+							Value: &monitoring_pb.TypedValue_DistributionValue{
+								DistributionValue: &distribution_pb.Distribution{
+									Count: 4,
+									BucketOptions: &distribution_pb.Distribution_BucketOptions{
+										Options: &distribution_pb.Distribution_BucketOptions_ExplicitBuckets{
+											ExplicitBuckets: &distribution_pb.Distribution_BucketOptions_Explicit{
+												Bounds: []float64{1, 2},
+											},
+										},
+									},
+									BucketCounts: []int64{2, 1, 1},
+								},
+							},
+						},
+					}},
+				},
+			},
+		}, {
+			doc: "metric ending in _info without metadata",
+			// The metadata of another metric with the base name does not apply.
+			metadata: testMetadataFunc(metricMetadataMap{
+				"metric1": {Type: textparse.MetricTypeGauge, Help: "metric1 help text"},
+			}),
+			series: seriesMap{
+				1: labels.FromStrings("job", "job1", "instance", "instance1", "__name__", "metric1_info"),
+			},
+			samples: [][]record.RefSample{
+				{{Ref: 1, T: 1000, V: 1}},
+			},
 		},
 	}
 
@@ -1522,3 +1848,220 @@ func TestSampleBuilder(t *testing.T) {
 		})
 	}
 }
+
+func TestSampleBuilder_created(t *testing.T) {
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1", "cluster", "c1")
+	series := seriesMap{
+		1: labels.FromStrings("__name__", "metric1_total", "job", "j1", "instance", "i1"),
+		2: labels.FromStrings("__name__", "metric1_created", "job", "j1", "instance", "i1"),
+		3: labels.FromStrings("__name__", "metric2_bucket", "job", "j1", "instance", "i1", "le", "1"),
+		4: labels.FromStrings("__name__", "metric2_bucket", "job", "j1", "instance", "i1", "le", "+Inf"),
+		5: labels.FromStrings("__name__", "metric2_count", "job", "j1", "instance", "i1"),
+		6: labels.FromStrings("__name__", "metric2_sum", "job", "j1", "instance", "i1"),
+		7: labels.FromStrings("__name__", "metric2_created", "job", "j1", "instance", "i1"),
+		// Creation timestamps before the lease are not used.
+		8: labels.FromStrings("__name__", "metric1_total", "job", "j2", "instance", "i1"),
+		9: labels.FromStrings("__name__", "metric1_created", "job", "j2", "instance", "i1"),
+	}
+	metadata := testMetadataFunc(metricMetadataMap{
+		"metric1": {Type: textparse.MetricTypeCounter},
+		"metric2": {Type: textparse.MetricTypeHistogram},
+	})
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return series[ref]
+	}
+	cache.setLeaseStart(time.Unix(1, 0))
+
+	type result struct {
+		Type       string
+		Start, End int64
+		Value      float64
+	}
+	var got []result
+
+	for _, batch := range [][]record.RefSample{
+		{
+			{Ref: 1, T: 10000, V: 5}, {Ref: 2, T: 10000, V: 2.5},
+			{Ref: 3, T: 10000, V: 1}, {Ref: 4, T: 10000, V: 2}, {Ref: 5, T: 10000, V: 2}, {Ref: 6, T: 10000, V: 3}, {Ref: 7, T: 10000, V: 3},
+			{Ref: 8, T: 10000, V: 5}, {Ref: 9, T: 10000, V: 0.5},
+		},
+		{
+			{Ref: 1, T: 20000, V: 7}, {Ref: 2, T: 20000, V: 2.5},
+			{Ref: 8, T: 20000, V: 7}, {Ref: 9, T: 20000, V: 0.5},
+		},
+		// The counter was created again without its value decreasing.
+		{
+			{Ref: 1, T: 30000, V: 8}, {Ref: 2, T: 30000, V: 25},
+		},
+	} {
+		b := newSampleBuilder(cache)
+		b.observeCreated(metadata, externalLabels, batch)
+
+		for len(batch) > 0 {
+			out, tail, err := b.next(metadata, externalLabels, batch, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range out {
+				p := s.proto.Points[0]
+				r := result{
+					Type:  s.proto.Metric.Type,
+					Start: p.Interval.StartTime.AsTime().UnixMilli(),
+					End:   p.Interval.EndTime.AsTime().UnixMilli(),
+				}
+				if d := p.Value.GetDistributionValue(); d != nil {
+					r.Value = float64(d.Count)
+				} else {
+					r.Value = p.Value.GetDoubleValue()
+				}
+				got = append(got, r)
+			}
+			batch = tail
+		}
+		b.close()
+	}
+	want := []result{
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Start: 2500, End: 10000, Value: 5},
+		{Type: "prometheus.googleapis.com/metric2/histogram", Start: 3000, End: 10000, Value: 2},
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Start: 2500, End: 20000, Value: 7},
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Start: 10000, End: 20000, Value: 2},
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Start: 25000, End: 30000, Value: 8},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected results (-want, +got): %s", diff)
+	}
+}
+
+func TestSampleBuilder_exportInterval(t *testing.T) {
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1", "cluster", "c1")
+	series := seriesMap{
+		1: labels.FromStrings("__name__", "metric1_total", "job", "j1", "instance", "i1"),
+		2: labels.FromStrings("__name__", "metric1_total", "job", "j2", "instance", "i1"),
+		3: labels.FromStrings("__name__", "metric2", "job", "j1", "instance", "i1"),
+	}
+	metadata := testMetadataFunc(metricMetadataMap{
+		"metric1_total": {Type: textparse.MetricTypeCounter},
+		"metric2":       {Type: textparse.MetricTypeGauge},
+	})
+	intervals, err := (&Config{
+		ExportIntervals: []ExportInterval{{Match: `{job="j1"}`, Interval: model.Duration(30 * time.Second)}},
+	}).exportIntervals()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return series[ref]
+	}
+	cache.setExportIntervals(intervals)
+
+	type result struct {
+		Type       string
+		Job        string
+		Start, End int64
+		Value      float64
+	}
+	var got []result
+
+	// Samples are scraped every 15 seconds and the counters are reset at 55 seconds.
+	for i, v := range []float64{1, 3, 5, 2, 4} {
+		ts := 10000 + int64(i)*15000
+		batch := []record.RefSample{{Ref: 1, T: ts, V: v}, {Ref: 2, T: ts, V: v}, {Ref: 3, T: ts, V: v}}
+
+		b := newSampleBuilder(cache)
+		for len(batch) > 0 {
+			out, tail, err := b.next(metadata, externalLabels, batch, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range out {
+				p := s.proto.Points[0]
+				got = append(got, result{
+					Type:  s.proto.Metric.Type,
+					Job:   s.proto.Resource.Labels["job"],
+					Start: p.Interval.GetStartTime().AsTime().UnixMilli(),
+					End:   p.Interval.EndTime.AsTime().UnixMilli(),
+					Value: p.Value.GetDoubleValue(),
+				})
+			}
+			batch = tail
+		}
+		b.close()
+	}
+	want := []result{
+		{Type: "prometheus.googleapis.com/metric2/gauge", Job: "j1", Start: 0, End: 10000, Value: 1},
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Job: "j1", Start: 10000, End: 25000, Value: 2},
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Job: "j2", Start: 10000, End: 25000, Value: 2},
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Job: "j2", Start: 10000, End: 40000, Value: 4},
+		{Type: "prometheus.googleapis.com/metric2/gauge", Job: "j1", Start: 0, End: 40000, Value: 5},
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Job: "j1", Start: 54999, End: 55000, Value: 2},
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Job: "j2", Start: 54999, End: 55000, Value: 2},
+		{Type: "prometheus.googleapis.com/metric1_total/counter", Job: "j2", Start: 54999, End: 70000, Value: 4},
+		{Type: "prometheus.googleapis.com/metric2/gauge", Job: "j1", Start: 0, End: 70000, Value: 4},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected results (-want, +got): %s", diff)
+	}
+}
+
+func TestSampleBuilder_droppedBuckets(t *testing.T) {
+	externalLabels := labels.FromStrings("project_id", "p1", "location", "l1")
+	series := seriesMap{
+		1: labels.FromStrings("__name__", "metric1_bucket", "job", "j1", "le", "1"),
+		2: labels.FromStrings("__name__", "metric1_bucket", "job", "j1", "le", "5"),
+		3: labels.FromStrings("__name__", "metric1_bucket", "job", "j1", "le", "+Inf"),
+		4: labels.FromStrings("__name__", "metric1_sum", "job", "j1"),
+		5: labels.FromStrings("__name__", "metric1_count", "job", "j1"),
+	}
+	metadata := testMetadataFunc(metricMetadataMap{
+		"metric1": {Type: textparse.MetricTypeHistogram},
+	})
+	cache := newSeriesCache(nil, nil, MetricTypePrefix, nil)
+	cache.getLabelsByRef = func(ref storage.SeriesRef) labels.Labels {
+		return series[ref]
+	}
+	build := func(ts int64, values ...float64) []hashedSeries {
+		var batch []record.RefSample
+		for i, v := range values {
+			batch = append(batch, record.RefSample{Ref: chunks.HeadSeriesRef(i + 1), T: ts, V: v})
+		}
+		b := newSampleBuilder(cache)
+		defer b.close()
+
+		var res []hashedSeries
+		for len(batch) > 0 {
+			out, tail, err := b.next(metadata, externalLabels, batch, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, out...)
+			batch = tail
+		}
+		return res
+	}
+	build(1000, 1, 2, 3, 10, 3)
+
+	// Drop the second bucket after its series was populated.
+	cache.setRelabelConfigs([]*relabel.Config{{
+		Action:       relabel.Drop,
+		SourceLabels: model.LabelNames{"le"},
+		Regex:        relabel.MustNewRegexp("5"),
+	}})
+	discarded := testutil.ToFloat64(prometheusSamplesDiscarded.WithLabelValues("relabel-dropped"))
+
+	got := build(2000, 2, 4, 6, 20, 6)
+	if n := testutil.ToFloat64(prometheusSamplesDiscarded.WithLabelValues("relabel-dropped")) - discarded; n != 1 {
+		t.Fatalf("expected 1 discarded sample, got %v", n)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 distribution, got %d", len(got))
+	}
+	dist := got[0].proto.Points[0].Value.GetDistributionValue()
+	if diff := cmp.Diff([]float64{1}, dist.BucketOptions.GetExplicitBuckets().Bounds); diff != "" {
+		t.Fatalf("unexpected bounds (-want, +got): %s", diff)
+	}
+	if diff := cmp.Diff([]int64{1, 2}, dist.BucketCounts); diff != "" {
+		t.Fatalf("unexpected bucket counts (-want, +got): %s", diff)
+	}
+}
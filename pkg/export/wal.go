@@ -0,0 +1,600 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/proto"
+)
+
+var (
+	walSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "gcm_export_wal_size_bytes",
+		Help: "Size of the on-disk write-ahead buffer in bytes.",
+	})
+	walSamplesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_wal_samples_written_total",
+		Help: "Number of samples written to the on-disk write-ahead buffer.",
+	})
+	walSamplesRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_wal_samples_read_total",
+		Help: "Number of samples read from the on-disk write-ahead buffer.",
+	})
+	walCorruptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "gcm_export_wal_corruptions_total",
+		Help: "Number of corrupted segments encountered while reading the write-ahead buffer.",
+	})
+)
+
+const (
+	// DefaultWALMaxSize is the default maximum size of the on-disk write-ahead buffer.
+	DefaultWALMaxSize = 1 << 30
+
+	// Size at which a new segment file is started.
+	walSegmentSize = 16 << 20
+	// Interval at which the checkpoint is persisted and acknowledged segments are deleted.
+	walCheckpointInterval = 10 * time.Second
+	// Name of the file holding the checkpoint within the buffer directory.
+	walCheckpointFile = "checkpoint"
+	// Maximum number of bytes read from a segment at once.
+	walReadChunkSize = 1 << 20
+)
+
+var walCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// walPos is a position within the segment log.
+type walPos struct {
+	segment int
+	offset  int64
+}
+
+type walSegment struct {
+	index int
+	size  int64
+}
+
+type walPending struct {
+	pos  walPos
+	done bool
+}
+
+// wal is an on-disk segment log that buffers converted samples between Export() and the shards.
+//
+// Records are appended to the head segment and read back in order by a single reader,
+// which hands them to the shards. Every record that is read is assigned a reference which
+// must be acknowledged once the record was successfully sent. The checkpoint is the position
+// of the oldest unacknowledged record and is the point from which the log is replayed after
+// a restart. Segments before the checkpoint are deleted.
+//
+// If the log reaches its maximum size, segments that were already read are deleted even
+// if they were not fully acknowledged. If that does not free up enough space, new data is dropped.
+type wal struct {
+	logger      log.Logger
+	dir         string
+	maxSize     int64
+	segmentSize int64
+
+	mtx sync.Mutex
+	// Segments on disk in ascending order. The last one is the head segment.
+	segments []walSegment
+	head     *os.File
+	size     int64
+	// Channel for signaling that new records were written.
+	writec chan struct{}
+
+	// Position up to which records were read.
+	readPos walPos
+	// Reference that is assigned to the next record that is read.
+	nextRef uint64
+	// Records that were read but not acknowledged yet. The first entry
+	// has reference firstRef.
+	pending  []walPending
+	firstRef uint64
+
+	// State only accessed by the reader.
+	readFile *os.File
+	readBuf  []byte
+}
+
+// walRecord is a single sample read from the log.
+type walRecord struct {
+	ref      uint64
+	hash     uint64
+	priority priority
+	sample   *monitoring_pb.TimeSeries
+}
+
+// Size of the record payload before the encoded sample. It holds the series hash
+// followed by the priority class.
+const walRecordPrefixSize = 9
+
+func walSegmentName(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d", index))
+}
+
+// openWAL opens the segment log in dir. Records after the last persisted checkpoint
+// will be read again.
+func openWAL(logger log.Logger, dir string, maxSize int64) (*wal, error) {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if maxSize <= 0 {
+		maxSize = DefaultWALMaxSize
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, fmt.Errorf("create buffer directory: %w", err)
+	}
+	w := &wal{
+		logger:      logger,
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: walSegmentSize,
+		writec:      make(chan struct{}, 1),
+		nextRef:     1,
+		firstRef:    1,
+	}
+	checkpoint, err := w.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("list buffer directory: %w", err)
+	}
+	for _, f := range files {
+		index, err := strconv.Atoi(f.Name())
+		if err != nil || f.IsDir() {
+			continue
+		}
+		// Segments before the checkpoint were fully acknowledged but not deleted yet.
+		if index < checkpoint.segment {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return nil, fmt.Errorf("delete segment: %w", err)
+			}
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			return nil, fmt.Errorf("stat segment: %w", err)
+		}
+		w.segments = append(w.segments, walSegment{index: index, size: info.Size()})
+		w.size += info.Size()
+	}
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].index < w.segments[j].index
+	})
+
+	w.readPos = checkpoint
+
+	headIndex := checkpoint.segment
+	if len(w.segments) > 0 {
+		headIndex = w.segments[len(w.segments)-1].index + 1
+	}
+	if w.size > 0 {
+		level.Info(logger).Log("msg", "replaying write-ahead buffer", "dir", dir, "segments", len(w.segments), "bytes", w.size)
+	}
+	// Always start writing into a new segment so that a torn write at the end of
+	// a previous segment cannot be followed by valid data.
+	if err := w.cut(headIndex); err != nil {
+		return nil, err
+	}
+	walSize.Set(float64(w.size))
+
+	return w, nil
+}
+
+func (w *wal) readCheckpoint() (walPos, error) {
+	b, err := os.ReadFile(filepath.Join(w.dir, walCheckpointFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return walPos{}, nil
+	}
+	if err != nil {
+		return walPos{}, fmt.Errorf("read checkpoint: %w", err)
+	}
+	var p walPos
+	if _, err := fmt.Sscanf(string(b), "%d %d", &p.segment, &p.offset); err != nil {
+		level.Warn(w.logger).Log("msg", "ignoring invalid checkpoint", "err", err)
+		return walPos{}, nil
+	}
+	return p, nil
+}
+
+func (w *wal) writeCheckpoint(p walPos) error {
+	fn := filepath.Join(w.dir, walCheckpointFile)
+	tmp := fn + ".tmp"
+
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%d %d", p.segment, p.offset)), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// cut closes the current head segment and starts a new one with the given index.
+// Must be called with mtx held.
+func (w *wal) cut(index int) error {
+	if w.head != nil {
+		if err := w.head.Sync(); err != nil {
+			return fmt.Errorf("sync segment: %w", err)
+		}
+		if err := w.head.Close(); err != nil {
+			return fmt.Errorf("close segment: %w", err)
+		}
+	}
+	f, err := os.OpenFile(walSegmentName(w.dir, index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("create segment: %w", err)
+	}
+	w.head = f
+	w.segments = append(w.segments, walSegment{index: index})
+	return nil
+}
+
+// write appends the samples to the log. It returns the number of samples that were
+// dropped because the log reached its maximum size.
+func (w *wal) write(samples []hashedSeries) (int, error) {
+	if len(samples) == 0 {
+		return 0, nil
+	}
+	var (
+		buf    []byte
+		header [binary.MaxVarintLen64 + 4]byte
+	)
+	for _, s := range samples {
+		payload := make([]byte, walRecordPrefixSize, walRecordPrefixSize+proto.Size(s.proto))
+		binary.LittleEndian.PutUint64(payload, s.hash)
+		payload[8] = byte(s.priority)
+
+		payload, err := proto.MarshalOptions{}.MarshalAppend(payload, s.proto)
+		if err != nil {
+			return 0, fmt.Errorf("encode sample: %w", err)
+		}
+		n := binary.PutUvarint(header[:], uint64(len(payload)))
+		binary.LittleEndian.PutUint32(header[n:], crc32.Checksum(payload, walCastagnoli))
+
+		buf = append(buf, header[:n+4]...)
+		buf = append(buf, payload...)
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if !w.ensureSpace(int64(len(buf))) {
+		return len(samples), nil
+	}
+	head := &w.segments[len(w.segments)-1]
+
+	if head.size > 0 && head.size+int64(len(buf)) > w.segmentSize {
+		if err := w.cut(head.index + 1); err != nil {
+			return 0, err
+		}
+		head = &w.segments[len(w.segments)-1]
+	}
+	if _, err := w.head.Write(buf); err != nil {
+		// Partial writes are invalidated by starting a new segment.
+		if cerr := w.cut(head.index + 1); cerr != nil {
+			level.Error(w.logger).Log("msg", "starting new segment failed", "err", cerr)
+		}
+		return 0, fmt.Errorf("write segment: %w", err)
+	}
+	head.size += int64(len(buf))
+	w.size += int64(len(buf))
+
+	walSize.Set(float64(w.size))
+	walSamplesWritten.Add(float64(len(samples)))
+
+	select {
+	case w.writec <- struct{}{}:
+	default:
+	}
+	return 0, nil
+}
+
+// ensureSpace deletes segments that were already read until n more bytes can be written.
+// It returns false if not enough space could be freed.
+// Must be called with mtx held.
+func (w *wal) ensureSpace(n int64) bool {
+	for w.size+n > w.maxSize {
+		if len(w.segments) < 2 || w.segments[0].index >= w.readPos.segment {
+			return false
+		}
+		s := w.segments[0]
+		if err := os.Remove(walSegmentName(w.dir, s.index)); err != nil {
+			level.Error(w.logger).Log("msg", "deleting segment failed", "segment", s.index, "err", err)
+			return false
+		}
+		w.segments = w.segments[1:]
+		w.size -= s.size
+
+		// Unacknowledged records in the segment are given up on.
+		for len(w.pending) > 0 && w.pending[0].pos.segment <= s.index {
+			w.pending = w.pending[1:]
+			w.firstRef++
+		}
+		level.Warn(w.logger).Log("msg", "write-ahead buffer full, deleted unacknowledged segment", "segment", s.index)
+	}
+	return true
+}
+
+// read returns the next records in the log. It blocks until records are available
+// or the context is canceled.
+func (w *wal) read(ctx context.Context) ([]walRecord, error) {
+	for {
+		w.mtx.Lock()
+		seg, isHead := w.readSegmentInfo()
+		w.mtx.Unlock()
+
+		if w.readPos.offset < seg.size {
+			records, err := w.readSegment(seg)
+			if err != nil {
+				walCorruptions.Inc()
+				level.Warn(w.logger).Log("msg", "skipping remainder of corrupted segment", "segment", seg.index, "err", err)
+				w.skipSegment(seg)
+			}
+			if len(records) > 0 {
+				return records, nil
+			}
+			continue
+		}
+		if !isHead {
+			w.skipSegment(seg)
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			w.closeReadFile()
+			return nil, ctx.Err()
+		case <-w.writec:
+		}
+	}
+}
+
+// readSegmentInfo returns the segment at the read position and whether it is the head segment.
+// If the segment no longer exists, the read position is moved to the next one.
+// Must be called with mtx held.
+func (w *wal) readSegmentInfo() (walSegment, bool) {
+	head := w.segments[len(w.segments)-1]
+
+	for _, s := range w.segments {
+		if s.index < w.readPos.segment {
+			continue
+		}
+		if s.index != w.readPos.segment {
+			// The segment was deleted due to the size limit.
+			w.closeReadFile()
+			w.readPos = walPos{segment: s.index}
+		}
+		return s, s.index == head.index
+	}
+	// Unreachable as long as the read position never moves past the head segment.
+	return head, true
+}
+
+// skipSegment moves the read position to the start of the segment after seg.
+func (w *wal) skipSegment(seg walSegment) {
+	w.closeReadFile()
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	// Start a new head segment so that there is a segment to move on to.
+	if head := w.segments[len(w.segments)-1]; head.index == seg.index {
+		if err := w.cut(head.index + 1); err != nil {
+			level.Error(w.logger).Log("msg", "starting new segment failed", "err", err)
+			return
+		}
+	}
+	w.readPos = walPos{segment: seg.index + 1}
+}
+
+func (w *wal) closeReadFile() {
+	if w.readFile != nil {
+		w.readFile.Close()
+		w.readFile = nil
+	}
+}
+
+// readSegment reads complete records from the segment starting at the current read position.
+func (w *wal) readSegment(seg walSegment) ([]walRecord, error) {
+	if w.readFile == nil {
+		f, err := os.Open(walSegmentName(w.dir, seg.index))
+		if err != nil {
+			return nil, err
+		}
+		w.readFile = f
+	}
+	start := w.readPos.offset
+
+	n := int64(walReadChunkSize)
+	if int64(cap(w.readBuf)) > n {
+		n = int64(cap(w.readBuf))
+	}
+	if n > seg.size-start {
+		n = seg.size - start
+	}
+	if int64(cap(w.readBuf)) < n {
+		w.readBuf = make([]byte, n)
+	}
+	buf := w.readBuf[:n]
+
+	if _, err := w.readFile.ReadAt(buf, start); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	var (
+		records []walRecord
+		offsets []int64
+		offset  int64
+		err     error
+	)
+	for offset < n {
+		l, k := binary.Uvarint(buf[offset:])
+		if k < 0 || (k == 0 && start+n == seg.size) {
+			err = fmt.Errorf("invalid record header at offset %d", start+offset)
+			break
+		}
+		if k == 0 {
+			break
+		}
+		end := offset + int64(k) + 4 + int64(l)
+		if end > n {
+			if start+end > seg.size {
+				err = fmt.Errorf("truncated record at offset %d", start+offset)
+			} else if offset == 0 {
+				// The record does not fit into the buffer at all.
+				w.readBuf = make([]byte, end)
+			}
+			break
+		}
+		crc := binary.LittleEndian.Uint32(buf[offset+int64(k):])
+		payload := buf[offset+int64(k)+4 : end]
+
+		if len(payload) < walRecordPrefixSize || crc32.Checksum(payload, walCastagnoli) != crc {
+			err = fmt.Errorf("invalid record at offset %d", start+offset)
+			break
+		}
+		var ts monitoring_pb.TimeSeries
+		if uerr := proto.Unmarshal(payload[walRecordPrefixSize:], &ts); uerr != nil {
+			err = fmt.Errorf("decode record at offset %d: %w", start+offset, uerr)
+			break
+		}
+		records = append(records, walRecord{
+			hash:     binary.LittleEndian.Uint64(payload),
+			priority: priority(int8(payload[8])),
+			sample:   &ts,
+		})
+		offsets = append(offsets, start+offset)
+		offset = end
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	// Assign references and track records as pending until they are acknowledged.
+	for i := range records {
+		records[i].ref = w.nextRef
+		w.nextRef++
+		w.pending = append(w.pending, walPending{pos: walPos{segment: seg.index, offset: offsets[i]}})
+	}
+	w.readPos.offset = start + offset
+	walSamplesRead.Add(float64(len(records)))
+
+	return records, err
+}
+
+// ack acknowledges that the records with the given references were successfully sent.
+func (w *wal) ack(refs []uint64) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	for _, ref := range refs {
+		if ref < w.firstRef {
+			continue
+		}
+		if i := ref - w.firstRef; i < uint64(len(w.pending)) {
+			w.pending[i].done = true
+		}
+	}
+	for len(w.pending) > 0 && w.pending[0].done {
+		w.pending = w.pending[1:]
+		w.firstRef++
+	}
+}
+
+// ackEntries acknowledges the records of the given queue entries.
+func (w *wal) ackEntries(entries []queueEntry) {
+	refs := make([]uint64, 0, len(entries))
+	for _, e := range entries {
+		if e.walRef != 0 {
+			refs = append(refs, e.walRef)
+		}
+	}
+	w.ack(refs)
+}
+
+// checkpoint returns the position before which all records were acknowledged.
+// Must be called with mtx held.
+func (w *wal) checkpoint() walPos {
+	if len(w.pending) > 0 {
+		return w.pending[0].pos
+	}
+	return w.readPos
+}
+
+// truncate persists the current checkpoint and deletes segments before it.
+func (w *wal) truncate() error {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	cp := w.checkpoint()
+	if err := w.writeCheckpoint(cp); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	for len(w.segments) > 1 && w.segments[0].index < cp.segment {
+		s := w.segments[0]
+		if err := os.Remove(walSegmentName(w.dir, s.index)); err != nil {
+			return fmt.Errorf("delete segment: %w", err)
+		}
+		w.segments = w.segments[1:]
+		w.size -= s.size
+	}
+	walSize.Set(float64(w.size))
+	return nil
+}
+
+// run periodically persists the checkpoint until the context is canceled.
+func (w *wal) run(ctx context.Context) {
+	tick := time.NewTicker(walCheckpointInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if err := w.truncate(); err != nil {
+				level.Error(w.logger).Log("msg", "truncating write-ahead buffer failed", "err", err)
+			}
+		}
+	}
+}
+
+// close persists the final checkpoint and closes the head segment.
+func (w *wal) close() error {
+	if err := w.truncate(); err != nil {
+		return err
+	}
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+
+	if err := w.head.Sync(); err != nil {
+		return err
+	}
+	return w.head.Close()
+}
@@ -0,0 +1,192 @@
+// Copyright 2023 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	metric_pb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredres_pb "google.golang.org/genproto/googleapis/api/monitoredres"
+	monitoring_pb "google.golang.org/genproto/googleapis/monitoring/v3"
+	"google.golang.org/protobuf/testing/protocmp"
+)
+
+func testWALSeries(i int) hashedSeries {
+	return hashedSeries{
+		hash:     uint64(i),
+		priority: priority(i%priorityCount) + priorityLow,
+		proto: &monitoring_pb.TimeSeries{
+			Resource: &monitoredres_pb.MonitoredResource{
+				Type:   "prometheus_target",
+				Labels: map[string]string{KeyProjectID: "p1"},
+			},
+			Metric: &metric_pb.Metric{
+				Type:   fmt.Sprintf("prometheus.googleapis.com/metric_%d/gauge", i),
+				Labels: map[string]string{"k": "v"},
+			},
+			Points: []*monitoring_pb.Point{{
+				Interval: &monitoring_pb.TimeInterval{EndTime: getTimestamp(int64(i) * 1000)},
+				Value: &monitoring_pb.TypedValue{
+					Value: &monitoring_pb.TypedValue_DoubleValue{DoubleValue: float64(i)},
+				},
+			}},
+		},
+	}
+}
+
+func readWALRecords(t *testing.T, w *wal, n int) []walRecord {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var result []walRecord
+	for len(result) < n {
+		records, err := w.read(ctx)
+		if err != nil {
+			t.Fatalf("reading %d records failed after %d: %s", n, len(result), err)
+		}
+		result = append(result, records...)
+	}
+	return result
+}
+
+func TestWAL_writeRead(t *testing.T) {
+	w, err := openWAL(nil, t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	// Use small segments to cover reading across segment boundaries.
+	w.segmentSize = 500
+
+	var want []hashedSeries
+	for i := 0; i < 100; i++ {
+		s := testWALSeries(i)
+		want = append(want, s)
+
+		if dropped, err := w.write([]hashedSeries{s}); err != nil || dropped > 0 {
+			t.Fatalf("unexpected write result: dropped=%d, err=%v", dropped, err)
+		}
+	}
+	if len(w.segments) < 2 {
+		t.Fatalf("expected multiple segments, got %d", len(w.segments))
+	}
+	records := readWALRecords(t, w, len(want))
+
+	for i, r := range records {
+		if r.hash != want[i].hash {
+			t.Fatalf("unexpected hash %d for record %d", r.hash, i)
+		}
+		if r.priority != want[i].priority {
+			t.Fatalf("unexpected priority %s for record %d", r.priority, i)
+		}
+		if diff := cmp.Diff(want[i].proto, r.sample, protocmp.Transform()); diff != "" {
+			t.Fatalf("unexpected sample %d (-want, +got): %s", i, diff)
+		}
+	}
+}
+
+func TestWAL_replayUnacknowledged(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := openWAL(nil, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.segmentSize = 500
+
+	for i := 0; i < 100; i++ {
+		if _, err := w.write([]hashedSeries{testWALSeries(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	records := readWALRecords(t, w, 100)
+
+	// Acknowledge all records except for a gap at 60. Acknowledgements may
+	// arrive out of order.
+	var refs []uint64
+	for i := len(records) - 1; i >= 0; i-- {
+		if i != 60 {
+			refs = append(refs, records[i].ref)
+		}
+	}
+	w.ack(refs)
+
+	if err := w.truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = openWAL(nil, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+
+	// Records are replayed from the first unacknowledged one.
+	records = readWALRecords(t, w, 40)
+	if got := records[0].hash; got != 60 {
+		t.Fatalf("expected replay to start at record 60, got %d", got)
+	}
+	if got := records[len(records)-1].hash; got != 99 {
+		t.Fatalf("expected replay to end at record 99, got %d", got)
+	}
+	// Fully acknowledged segments must have been deleted.
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) >= 20 {
+		t.Fatalf("expected acknowledged segments to be deleted, got %d files", len(files))
+	}
+}
+
+func TestWAL_maxSize(t *testing.T) {
+	w, err := openWAL(nil, t.TempDir(), 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.close()
+	w.segmentSize = 500
+
+	// Without reading, the buffer fills up and new samples are dropped.
+	var dropped int
+	for i := 0; i < 100; i++ {
+		n, err := w.write([]hashedSeries{testWALSeries(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped += n
+	}
+	if dropped == 0 {
+		t.Fatalf("expected samples to be dropped")
+	}
+	if w.size > w.maxSize {
+		t.Fatalf("buffer size %d exceeds maximum %d", w.size, w.maxSize)
+	}
+	// Once everything was read, segments are deleted to make room even if they
+	// are not acknowledged.
+	readWALRecords(t, w, 100-dropped)
+
+	if n, err := w.write([]hashedSeries{testWALSeries(100)}); err != nil || n > 0 {
+		t.Fatalf("unexpected write result: dropped=%d, err=%v", n, err)
+	}
+}
@@ -111,6 +111,25 @@ type CollectionSpec struct {
 	KubeletScraping *KubeletScraping `json:"kubeletScraping,omitempty"`
 	// Compression enables compression of metrics collection data
 	Compression CompressionType `json:"compression,omitempty"`
+	// Metadata of metrics by name. The first override matching a metric name is used
+	// instead of the metadata scraped for the metric, if any. This avoids exporting
+	// metrics without metadata, e.g. created by metric relabeling, as untyped metrics.
+	MetadataOverrides []MetadataOverride `json:"metadataOverrides,omitempty"`
+}
+
+// MetadataOverride sets the metadata of metrics whose name matches a pattern.
+type MetadataOverride struct {
+	// An RE2 regular expression that must match the full metric name. Histograms,
+	// summaries, and counters are matched by their name without the _bucket, _sum,
+	// _count, and _total suffixes.
+	Match string `json:"match"`
+	// The metric type.
+	// +kubebuilder:validation:Enum=counter;gauge;histogram;gaugehistogram;summary;info;stateset;unknown
+	Type string `json:"type"`
+	// The unit of the metric. It is not changed if empty.
+	Unit string `json:"unit,omitempty"`
+	// The help text of the metric. It is not changed if empty.
+	Help string `json:"help,omitempty"`
 }
 
 // OperatorFeatures holds configuration for optional managed-collection features.
@@ -141,6 +160,25 @@ type ExportFilters struct {
 	// parameter of the Prometheus federation endpoint to selectively export data.
 	// Example: `["{job!='foobar'}", "{__name__!~'container_foo.*|container_bar.*'}"]`
 	MatchOneOf []string `json:"matchOneOf,omitempty"`
+	// Relabeling rules applied to all series before they are exported. They only affect
+	// exported data and not the locally stored series.
+	// Relabeling rules that override protected target labels (project_id, location, cluster,
+	// namespace, job, instance, or __address__) are not permitted. The labelmap action is not
+	// permitted in general.
+	MetricRelabeling []RelabelingRule `json:"metricRelabeling,omitempty"`
+}
+
+// RelabelConfigs returns the metric relabeling rules as Prometheus relabeling configs.
+func (f *ExportFilters) RelabelConfigs() ([]*relabel.Config, error) {
+	var cfgs []*relabel.Config
+	for _, r := range f.MetricRelabeling {
+		rcfg, err := convertRelabelingRule(r)
+		if err != nil {
+			return nil, err
+		}
+		cfgs = append(cfgs, rcfg)
+	}
+	return cfgs, nil
 }
 
 // AlertingSpec defines alerting configuration.
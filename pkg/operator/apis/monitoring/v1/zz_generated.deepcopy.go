@@ -269,6 +269,11 @@ func (in *CollectionSpec) DeepCopyInto(out *CollectionSpec) {
 		*out = new(KubeletScraping)
 		**out = **in
 	}
+	if in.MetadataOverrides != nil {
+		in, out := &in.MetadataOverrides, &out.MetadataOverrides
+		*out = make([]MetadataOverride, len(*in))
+		copy(*out, *in)
+	}
 	return
 }
 
@@ -290,6 +295,13 @@ func (in *ExportFilters) DeepCopyInto(out *ExportFilters) {
 		*out = make([]string, len(*in))
 		copy(*out, *in)
 	}
+	if in.MetricRelabeling != nil {
+		in, out := &in.MetricRelabeling, &out.MetricRelabeling
+		*out = make([]RelabelingRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 	return
 }
 
@@ -417,6 +429,22 @@ func (in *ManagedAlertmanagerSpec) DeepCopy() *ManagedAlertmanagerSpec {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *MetadataOverride) DeepCopyInto(out *MetadataOverride) {
+	*out = *in
+	return
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetadataOverride.
+func (in *MetadataOverride) DeepCopy() *MetadataOverride {
+	if in == nil {
+		return nil
+	}
+	out := new(MetadataOverride)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MonitoringCondition) DeepCopyInto(out *MonitoringCondition) {
 	*out = *in
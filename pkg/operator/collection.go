@@ -245,10 +245,9 @@ func (r *collectionReconciler) ensureCollectorDaemonSet(ctx context.Context, spe
 		fmt.Sprintf("--export.label.project-id=%q", projectID),
 		fmt.Sprintf("--export.label.location=%q", location),
 		fmt.Sprintf("--export.label.cluster=%q", cluster),
-	}
-	// Populate export filtering from OperatorConfig.
-	for _, matcher := range spec.Filter.MatchOneOf {
-		flags = append(flags, fmt.Sprintf("--export.match=%q", matcher))
+		// Export filtering from the OperatorConfig is populated in the exporter configuration
+		// so changes are applied on config reload without restarting the collectors.
+		fmt.Sprintf("--export.config-file=%q", path.Join(collectorConfigDir, exportConfigFilename)),
 	}
 	if spec.Credentials != nil {
 		p := path.Join(secretsDir, pathForSelector(r.opts.PublicNamespace, &monitoringv1.SecretOrConfigMap{Secret: spec.Credentials}))
@@ -310,6 +309,14 @@ func (r *collectionReconciler) ensureCollectorConfig(ctx context.Context, spec *
 	if err != nil {
 		return fmt.Errorf("marshal Prometheus config: %w", err)
 	}
+	exportCfg, err := makeExportConfig(spec)
+	if err != nil {
+		return fmt.Errorf("generate exporter config: %w", err)
+	}
+	exportCfgEncoded, err := yaml.Marshal(exportCfg)
+	if err != nil {
+		return fmt.Errorf("marshal exporter config: %w", err)
+	}
 
 	cm := &corev1.ConfigMap{
 		ObjectMeta: metav1.ObjectMeta{
@@ -317,7 +324,8 @@ func (r *collectionReconciler) ensureCollectorConfig(ctx context.Context, spec *
 			Name:      NameCollector,
 		},
 		Data: map[string]string{
-			configFilename: string(cfgEncoded),
+			configFilename:       string(cfgEncoded),
+			exportConfigFilename: string(exportCfgEncoded),
 		},
 	}
 
@@ -331,6 +339,30 @@ func (r *collectionReconciler) ensureCollectorConfig(ctx context.Context, spec *
 	return nil
 }
 
+// makeExportConfig generates the exporter configuration of the collectors.
+func makeExportConfig(spec *monitoringv1.CollectionSpec) (*export.Config, error) {
+	relabelCfgs, err := spec.Filter.RelabelConfigs()
+	if err != nil {
+		return nil, fmt.Errorf("invalid metric relabeling: %w", err)
+	}
+	cfg := &export.Config{
+		Match:          spec.Filter.MatchOneOf,
+		RelabelConfigs: relabelCfgs,
+	}
+	for _, o := range spec.MetadataOverrides {
+		cfg.MetadataOverrides = append(cfg.MetadataOverrides, export.MetadataOverride{
+			Match: o.Match,
+			Type:  o.Type,
+			Unit:  o.Unit,
+			Help:  o.Help,
+		})
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
 func (r *collectionReconciler) makeCollectorConfig(ctx context.Context, spec *monitoringv1.CollectionSpec) (*promconfig.Config, error) {
 	logger, _ := logr.FromContext(ctx)
 
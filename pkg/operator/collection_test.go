@@ -16,14 +16,18 @@ package operator
 
 import (
 	"context"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/GoogleCloudPlatform/prometheus-engine/pkg/export"
 	monitoringv1 "github.com/GoogleCloudPlatform/prometheus-engine/pkg/operator/apis/monitoring/v1"
 	"github.com/go-logr/logr"
 	"github.com/go-logr/logr/testr"
 	"github.com/google/go-cmp/cmp"
 	"github.com/prometheus/common/model"
+	yaml "gopkg.in/yaml.v3"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -157,3 +161,66 @@ func TestCollectionStatus(t *testing.T) {
 		t.Fatalf("invalid PodMonitorings found: %d", amount)
 	}
 }
+
+func TestMakeExportConfig(t *testing.T) {
+	spec := &monitoringv1.CollectionSpec{
+		Filter: monitoringv1.ExportFilters{
+			MatchOneOf: []string{`{job="prometheus"}`},
+			MetricRelabeling: []monitoringv1.RelabelingRule{
+				{Action: "labeldrop", Regex: "pod_template_hash"},
+				{Action: "drop", SourceLabels: []string{"__name__"}, Regex: "go_.*"},
+			},
+		},
+		MetadataOverrides: []monitoringv1.MetadataOverride{
+			{Match: "requests", Type: "counter", Help: "Number of requests."},
+		},
+	}
+	cfg, err := makeExportConfig(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generated config must be valid for the exporter.
+	path := filepath.Join(t.TempDir(), exportConfigFilename)
+	if err := os.WriteFile(path, b, 0666); err != nil {
+		t.Fatal(err)
+	}
+	got, err := export.LoadConfigFile(path)
+	if err != nil {
+		t.Fatalf("loading generated config failed: %s\n%s", err, b)
+	}
+	if diff := cmp.Diff(spec.Filter.MatchOneOf, got.Match); diff != "" {
+		t.Errorf("unexpected matchers (-want, +got): %s", diff)
+	}
+	if len(got.RelabelConfigs) != 2 {
+		t.Fatalf("expected 2 relabel configs, got %d", len(got.RelabelConfigs))
+	}
+	if got.RelabelConfigs[1].Separator != ";" {
+		t.Errorf("expected default separator, got %q", got.RelabelConfigs[1].Separator)
+	}
+
+	wantOverrides := []export.MetadataOverride{
+		{Match: "requests", Type: "counter", Help: "Number of requests."},
+	}
+	if diff := cmp.Diff(wantOverrides, got.MetadataOverrides); diff != "" {
+		t.Errorf("unexpected metadata overrides (-want, +got): %s", diff)
+	}
+
+	// Invalid metadata overrides are rejected.
+	spec.MetadataOverrides[0].Match = "requests("
+	if _, err := makeExportConfig(spec); err == nil {
+		t.Fatal("expected error but got none")
+	}
+	spec.MetadataOverrides = nil
+
+	// Relabeling protected labels is rejected.
+	spec.Filter.MetricRelabeling = []monitoringv1.RelabelingRule{
+		{Action: "labeldrop", Regex: "namespace"},
+	}
+	if _, err := makeExportConfig(spec); err == nil {
+		t.Fatal("expected error but got none")
+	}
+}
@@ -63,6 +63,10 @@ const (
 
 	// Filename for configuration files.
 	configFilename = "config.yaml"
+	// Filename of the collector's exporter configuration.
+	exportConfigFilename = "export.yaml"
+	// Directory in which the collector configuration is mounted.
+	collectorConfigDir = "/prometheus/config"
 
 	// The well-known app name label.
 	LabelAppName = "app.kubernetes.io/name"
@@ -775,6 +775,9 @@ func (v *operatorConfigValidator) ValidateCreate(ctx context.Context, o runtime.
 	if err := validateSecretKeySelector(oc.Collection.Credentials); err != nil {
 		return fmt.Errorf("invalid collection credentials: %w", err)
 	}
+	if _, err := makeExportConfig(&oc.Collection); err != nil {
+		return fmt.Errorf("invalid collection export config: %w", err)
+	}
 	if oc.ManagedAlertmanager != nil {
 		if err := validateSecretKeySelector(oc.ManagedAlertmanager.ConfigSecret); err != nil {
 			return fmt.Errorf("invalid managed alert manager config secret: %w", err)